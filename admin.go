@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// defaultAdminPort is the port the admin API listens on when
+// admin.listen_port isn't set.
+const defaultAdminPort = 60000
+
+// adminServer serves the local HTTP admin API, which lets operators inspect
+// recently launched jobs and trigger stops and held job sweeps without
+// logging into the submit host.
+//
+// The following endpoints are supported:
+//
+//	GET  /jobs?limit=<n>                      lists recently launched invocations
+//	GET  /jobs/<invocation-id>                shows a launch and its submission files
+//	GET  /jobs/<invocation-id>/files/<file>   returns the contents of a submission file
+//	                                          (only the submit file and the logs)
+//	GET  /jobs/<invocation-id>/submit-output  returns the output of condor_submit
+//	POST /jobs/<invocation-id>/stop           stops the job
+//	POST /held-sweep                          applies the held job policy
+//	POST /janitor?dry_run=<bool>              cleans up old submission directories
+//	GET  /metrics                             exposes Prometheus metrics
+type adminServer struct {
+	launcher *CondorLauncher
+	metrics  http.Handler
+}
+
+// servableFiles are the submission files the admin API returns the contents
+// of, in addition to the logs. The API isn't authenticated, so files that
+// might contain secrets, like irods-config, are never served.
+var servableFiles = map[string]bool{
+	"iplant.cmd": true,
+}
+
+// servableFile returns true if the admin API may return the contents of the
+// named submission file.
+func servableFile(name string) bool {
+	return servableFiles[name] || path.Ext(name) == ".log"
+}
+
+// jobDetails is the response body for a single job.
+type jobDetails struct {
+	*LaunchRecord
+	Files []string `json:"files"`
+}
+
+// newAdminServer returns a new *adminServer for the launcher.
+func newAdminServer(launcher *CondorLauncher) *adminServer {
+	return &adminServer{
+		launcher: launcher,
+		metrics:  promhttp.Handler(),
+	}
+}
+
+// adminListenAddr returns the address the admin API should listen on, based
+// on the admin.listen_address and admin.listen_port configuration settings.
+func adminListenAddr(launcher *CondorLauncher) string {
+	port := launcher.cfg.GetInt("admin.listen_port")
+	if port == 0 {
+		port = defaultAdminPort
+	}
+	addr := launcher.cfg.GetString("admin.listen_address")
+	if addr == "" {
+		addr = "127.0.0.1"
+	}
+	return fmt.Sprintf("%s:%d", addr, port)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Errorf("%+v\n", errors.Wrap(err, "failed to encode the admin API response"))
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (a *adminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "metrics" && r.Method == http.MethodGet:
+		a.metrics.ServeHTTP(w, r)
+	case len(parts) == 1 && parts[0] == "jobs" && r.Method == http.MethodGet:
+		a.listJobs(w, r)
+	case len(parts) == 1 && parts[0] == "held-sweep" && r.Method == http.MethodPost:
+		a.heldSweep(w, r)
+	case len(parts) == 1 && parts[0] == "janitor" && r.Method == http.MethodPost:
+		a.runJanitor(w, r)
+	case len(parts) == 2 && parts[0] == "jobs" && r.Method == http.MethodGet:
+		a.showJob(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "jobs" && parts[2] == "submit-output" && r.Method == http.MethodGet:
+		a.submitOutput(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "jobs" && parts[2] == "stop" && r.Method == http.MethodPost:
+		a.stopJob(w, r, parts[1])
+	case len(parts) == 4 && parts[0] == "jobs" && parts[2] == "files" && r.Method == http.MethodGet:
+		a.showFile(w, r, parts[1], parts[3])
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s %s not found", r.Method, r.URL.Path))
+	}
+}
+
+// lookup returns the launch record for the invocation ID, writing an error
+// response and returning nil if it can't be found.
+func (a *adminServer) lookup(w http.ResponseWriter, invocationID string) *LaunchRecord {
+	record, err := a.launcher.ledger.Lookup(invocationID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return nil
+	}
+	if record == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("invocation %s was not launched by this host", invocationID))
+		return nil
+	}
+	return record
+}
+
+func (a *adminServer) listJobs(w http.ResponseWriter, r *http.Request) {
+	limit := 50
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil {
+			writeError(w, http.StatusBadRequest, errors.Wrapf(err, "invalid limit %s", l))
+			return
+		}
+	}
+
+	records, err := a.launcher.ledger.Recent(limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if records == nil {
+		records = []*LaunchRecord{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"jobs": records})
+}
+
+func (a *adminServer) showJob(w http.ResponseWriter, r *http.Request, invocationID string) {
+	record := a.lookup(w, invocationID)
+	if record == nil {
+		return
+	}
+
+	files := []string{}
+	entries, err := a.launcher.fs.ReadDir(record.SubmissionDir)
+	if err != nil && !os.IsNotExist(err) {
+		writeError(w, http.StatusInternalServerError, errors.Wrapf(err, "failed to list %s", record.SubmissionDir))
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			files = append(files, entry.Name())
+		}
+	}
+
+	writeJSON(w, http.StatusOK, &jobDetails{LaunchRecord: record, Files: files})
+}
+
+func (a *adminServer) showFile(w http.ResponseWriter, r *http.Request, invocationID, name string) {
+	record := a.lookup(w, invocationID)
+	if record == nil {
+		return
+	}
+
+	if name != path.Base(name) || name == "." || name == ".." {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid file name %s", name))
+		return
+	}
+	if !servableFile(name) {
+		writeError(w, http.StatusForbidden, fmt.Errorf("%s can't be viewed through the admin API", name))
+		return
+	}
+
+	contents, err := a.launcher.fs.ReadFile(path.Join(record.SubmissionDir, name))
+	if os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s does not exist for invocation %s", name, invocationID))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(contents)
+}
+
+func (a *adminServer) submitOutput(w http.ResponseWriter, r *http.Request, invocationID string) {
+	record := a.lookup(w, invocationID)
+	if record == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(record.SubmitOutput))
+}
+
+// begin registers an admin action as work in flight, so that shutting down
+// waits for it. It writes an error response and returns false if the launcher
+// is shutting down. Every call that returns true must be paired with a call to
+// the launcher's finish.
+func (a *adminServer) begin(w http.ResponseWriter) bool {
+	if !a.launcher.begin() {
+		writeError(w, http.StatusServiceUnavailable, errShuttingDown)
+		return false
+	}
+	return true
+}
+
+func (a *adminServer) stopJob(w http.ResponseWriter, r *http.Request, invocationID string) {
+	if !a.begin(w) {
+		return
+	}
+	defer a.launcher.finish()
+
+	log.Infof("Admin API stop request for invocation id %s", invocationID)
+	if err := a.launcher.stopJob(invocationID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"stopped": invocationID})
+}
+
+func (a *adminServer) heldSweep(w http.ResponseWriter, r *http.Request) {
+	if !a.begin(w) {
+		return
+	}
+	defer a.launcher.finish()
+
+	log.Infoln("Admin API held job sweep request")
+	sweepHeldJobs(a.launcher)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "held job sweep complete"})
+}
+
+func (a *adminServer) runJanitor(w http.ResponseWriter, r *http.Request) {
+	dryRun := a.launcher.janitor.DryRun
+	if d := r.URL.Query().Get("dry_run"); d != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(d); err != nil {
+			writeError(w, http.StatusBadRequest, errors.Wrapf(err, "invalid dry_run %s", d))
+			return
+		}
+	}
+
+	if !a.begin(w) {
+		return
+	}
+	defer a.launcher.finish()
+
+	log.Infof("Admin API janitor request, dry run: %t", dryRun)
+	report, err := cleanSubmissionDirs(a.launcher, dryRun, time.Now())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
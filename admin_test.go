@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// adminFixture has the submission files and launch record for cluster 10000.
+func adminFixture() launcherFixture {
+	sdir := "/submissions/07b04ce2-7757-4b21-9e15-0b4c2f44be26"
+	return launcherFixture{
+		files: map[string]string{
+			path.Join(sdir, "iplant.cmd"):   "universe = vanilla\n",
+			path.Join(sdir, "irods-config"): "irods_password = secret\n",
+		},
+		records: []*LaunchRecord{{
+			InvocationID:  "07b04ce2-7757-4b21-9e15-0b4c2f44be26",
+			ClusterID:     "10000",
+			SubmittedAt:   time.Now(),
+			SubmissionDir: sdir,
+			SubmitOutput:  "1 job(s) submitted to cluster 10000.",
+		}},
+	}
+}
+
+// startTestAdmin serves the launcher's admin API until the test finishes.
+func startTestAdmin(t *testing.T, cl *CondorLauncher) *httptest.Server {
+	srv := httptest.NewServer(newAdminServer(cl))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func adminRequest(t *testing.T, method, url string) (int, string) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestAdminListJobs(t *testing.T) {
+	cl, _, _ := newTestLauncherWith(t, adminFixture())
+	srv := startTestAdmin(t, cl)
+
+	status, body := adminRequest(t, http.MethodGet, srv.URL+"/jobs")
+	if status != http.StatusOK {
+		t.Fatalf("status was %d: %s", status, body)
+	}
+	var listing struct {
+		Jobs []*LaunchRecord `json:"jobs"`
+	}
+	if err := json.Unmarshal([]byte(body), &listing); err != nil {
+		t.Fatal(err)
+	}
+	if len(listing.Jobs) != 1 || listing.Jobs[0].ClusterID != "10000" {
+		t.Errorf("unexpected job listing: %s", body)
+	}
+}
+
+func TestAdminShowJob(t *testing.T) {
+	cl, _, _ := newTestLauncherWith(t, adminFixture())
+	srv := startTestAdmin(t, cl)
+
+	status, body := adminRequest(t, http.MethodGet, srv.URL+"/jobs/07b04ce2-7757-4b21-9e15-0b4c2f44be26")
+	if status != http.StatusOK {
+		t.Fatalf("status was %d: %s", status, body)
+	}
+	if !strings.Contains(body, `"files":["iplant.cmd","irods-config"]`) {
+		t.Errorf("job details did not list the submission files: %s", body)
+	}
+
+	status, body = adminRequest(t, http.MethodGet, srv.URL+"/jobs/07b04ce2-7757-4b21-9e15-0b4c2f44be26/files/iplant.cmd")
+	if status != http.StatusOK || body != "universe = vanilla\n" {
+		t.Errorf("file request returned %d: %s", status, body)
+	}
+
+	status, body = adminRequest(t, http.MethodGet, srv.URL+"/jobs/07b04ce2-7757-4b21-9e15-0b4c2f44be26/files/irods-config")
+	if status != http.StatusForbidden || strings.Contains(body, "secret") {
+		t.Errorf("irods-config request returned %d: %s", status, body)
+	}
+
+	status, _ = adminRequest(t, http.MethodGet, srv.URL+"/jobs/07b04ce2-7757-4b21-9e15-0b4c2f44be26/files/condor.log")
+	if status != http.StatusNotFound {
+		t.Errorf("status for a missing log was %d instead of %d", status, http.StatusNotFound)
+	}
+
+	status, body = adminRequest(t, http.MethodGet, srv.URL+"/jobs/07b04ce2-7757-4b21-9e15-0b4c2f44be26/submit-output")
+	if status != http.StatusOK || !strings.Contains(body, "submitted to cluster 10000") {
+		t.Errorf("submit output request returned %d: %s", status, body)
+	}
+
+	status, _ = adminRequest(t, http.MethodGet, srv.URL+"/jobs/missing")
+	if status != http.StatusNotFound {
+		t.Errorf("status for a missing job was %d instead of %d", status, http.StatusNotFound)
+	}
+}
+
+func TestAdminStopJob(t *testing.T) {
+	cl, scheduler, _ := newTestLauncherWith(t, adminFixture())
+	srv := startTestAdmin(t, cl)
+
+	status, body := adminRequest(t, http.MethodPost, srv.URL+"/jobs/07b04ce2-7757-4b21-9e15-0b4c2f44be26/stop")
+	if status != http.StatusOK {
+		t.Fatalf("status was %d: %s", status, body)
+	}
+	if len(scheduler.clusters) != 1 || scheduler.clusters[0] != "10000" {
+		t.Errorf("removed clusters %v instead of [10000]", scheduler.clusters)
+	}
+}
+
+func TestAdminHeldSweep(t *testing.T) {
+	cl, scheduler, _ := newTestLauncherWith(t, adminFixture())
+	srv := startTestAdmin(t, cl)
+	scheduler.held = []HeldJob{{InvocationID: "63c5523d-d8a5-49bc-addc-99a73566cd89"}}
+
+	status, body := adminRequest(t, http.MethodPost, srv.URL+"/held-sweep")
+	if status != http.StatusOK {
+		t.Fatalf("status was %d: %s", status, body)
+	}
+	if len(scheduler.removed) != 1 {
+		t.Errorf("removed %d held jobs instead of 1", len(scheduler.removed))
+	}
+}
+
+func TestAdminJanitor(t *testing.T) {
+	cl, _, _ := newTestLauncherWith(t, adminFixture())
+	srv := startTestAdmin(t, cl)
+	cl.janitor.Retention = time.Nanosecond
+
+	status, body := adminRequest(t, http.MethodPost, srv.URL+"/janitor?dry_run=true")
+	if status != http.StatusOK {
+		t.Fatalf("status was %d: %s", status, body)
+	}
+	var report JanitorReport
+	if err := json.Unmarshal([]byte(body), &report); err != nil {
+		t.Fatal(err)
+	}
+	if !report.DryRun || len(report.Entries) != 1 || report.Entries[0].InvocationID != "07b04ce2-7757-4b21-9e15-0b4c2f44be26" {
+		t.Errorf("unexpected report %s", body)
+	}
+	if _, err := cl.fs.Stat(path.Join(report.Entries[0].SubmissionDir, "iplant.cmd")); err != nil {
+		t.Errorf("the dry run removed a file: %s", err)
+	}
+
+	if status, _ = adminRequest(t, http.MethodPost, srv.URL+"/janitor?dry_run=maybe"); status != http.StatusBadRequest {
+		t.Errorf("status was %d instead of 400 for an invalid dry_run", status)
+	}
+}
+
+func TestAdminActionsDuringShutdown(t *testing.T) {
+	cl, scheduler, _ := newTestLauncherWith(t, adminFixture())
+	srv := startTestAdmin(t, cl)
+	scheduler.held = []HeldJob{{InvocationID: "63c5523d-d8a5-49bc-addc-99a73566cd89"}}
+	cl.stop()
+
+	for _, p := range []string{"/jobs/07b04ce2-7757-4b21-9e15-0b4c2f44be26/stop", "/held-sweep", "/janitor"} {
+		if status, body := adminRequest(t, http.MethodPost, srv.URL+p); status != http.StatusServiceUnavailable {
+			t.Errorf("status for %s during shutdown was %d: %s", p, status, body)
+		}
+	}
+	if len(scheduler.clusters) != 0 || len(scheduler.removed) != 0 {
+		t.Errorf("removed clusters %v and jobs %v during shutdown", scheduler.clusters, scheduler.removed)
+	}
+	if status, _ := adminRequest(t, http.MethodGet, srv.URL+"/jobs"); status != http.StatusOK {
+		t.Errorf("status for listing jobs during shutdown was %d", status)
+	}
+}
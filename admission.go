@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// tokenBucket limits how often something happens to rate times a second on
+// average, allowing bursts of up to burst at a time.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes a token from the bucket and returns how long to wait before
+// using it. The bucket starts out full.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.last.IsZero() {
+		b.tokens = b.burst
+	} else if now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	if now.After(b.last) {
+		b.last = now
+	}
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// cancel returns a token taken by reserve that won't be used.
+func (b *tokenBucket) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = math.Min(b.burst, b.tokens+1)
+}
+
+// SubmitLimiter protects a pool's schedd from bursts of launches by limiting
+// how often jobs are submitted and how many submissions run at once. It's
+// configured with the condor.submit_limits settings, for example:
+//
+//	condor:
+//	  submit_limits:
+//	    rate: 2
+//	    burst: 10
+//	    max_concurrent: 4
+//
+// rate is the average number of submissions a second, with bursts of up to
+// burst submissions allowed, and max_concurrent is the most submissions that
+// run at the same time. A setting of 0 means there's no limit. Each pool has
+// its own limiter with the same settings. Launches wait for their turn
+// instead of failing, regardless of how many launch requests are prefetched,
+// until the launcher starts shutting down.
+type SubmitLimiter struct {
+	Rate          float64
+	Burst         int
+	MaxConcurrent int
+
+	bucket *tokenBucket
+	slots  chan struct{}
+
+	now   func() time.Time                          // replaced in tests
+	sleep func(time.Duration, <-chan struct{}) bool // replaced in tests
+}
+
+// DefaultSubmitLimiter returns a *SubmitLimiter that doesn't limit
+// submissions.
+func DefaultSubmitLimiter() *SubmitLimiter {
+	return &SubmitLimiter{
+		now:   time.Now,
+		sleep: sleepUntilStopped,
+	}
+}
+
+// NewSubmitLimiter returns a *SubmitLimiter based on the condor.submit_limits
+// settings.
+func NewSubmitLimiter(cfg *viper.Viper) (*SubmitLimiter, error) {
+	l := DefaultSubmitLimiter()
+	l.Rate = cfg.GetFloat64("condor.submit_limits.rate")
+	l.Burst = cfg.GetInt("condor.submit_limits.burst")
+	l.MaxConcurrent = cfg.GetInt("condor.submit_limits.max_concurrent")
+	if l.Rate < 0 || l.Burst < 0 || l.MaxConcurrent < 0 {
+		return nil, fmt.Errorf("invalid condor.submit_limits rate %g, burst %d and max_concurrent %d", l.Rate, l.Burst, l.MaxConcurrent)
+	}
+
+	if l.Rate > 0 {
+		// Without a burst, submissions are spread out evenly.
+		if l.Burst == 0 {
+			l.Burst = 1
+		}
+		l.bucket = &tokenBucket{rate: l.Rate, burst: float64(l.Burst)}
+	}
+	if l.MaxConcurrent > 0 {
+		l.slots = make(chan struct{}, l.MaxConcurrent)
+	}
+	return l, nil
+}
+
+// acquire waits until a job can be submitted to the pool and returns the
+// function to call once the submission has finished. A slot is taken before
+// a token so that tokens aren't used up by launches that are still waiting
+// for a slot. If stop is closed while it's waiting, acquire gives up, gives
+// back the slot and the token, and returns a transient error.
+func (l *SubmitLimiter) acquire(pool string, stop <-chan struct{}) (func(), error) {
+	if l.bucket == nil && l.slots == nil {
+		return func() {}, nil
+	}
+
+	start := l.now()
+	submitQueueLength.WithLabelValues(pool).Inc()
+	defer submitQueueLength.WithLabelValues(pool).Dec()
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		case <-stop:
+			return nil, transientError("submit", errShuttingDown)
+		}
+	}
+	if l.bucket != nil {
+		if d := l.bucket.reserve(l.now()); d > 0 && !l.sleep(d, stop) {
+			l.bucket.cancel()
+			if l.slots != nil {
+				<-l.slots
+			}
+			return nil, transientError("submit", errShuttingDown)
+		}
+	}
+	submitWaitSeconds.WithLabelValues(pool).Observe(l.now().Sub(start).Seconds())
+
+	submitsInFlight.WithLabelValues(pool).Inc()
+	return func() {
+		submitsInFlight.WithLabelValues(pool).Dec()
+		if l.slots != nil {
+			<-l.slots
+		}
+	}, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/condor-launcher/test"
+)
+
+func TestNewSubmitLimiter(t *testing.T) {
+	cfg := test.InitConfig(t)
+	l, err := NewSubmitLimiter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.bucket != nil || l.slots != nil {
+		t.Errorf("unexpected default submit limiter %#v", l)
+	}
+
+	cfg.Set("condor.submit_limits.rate", 0.5)
+	cfg.Set("condor.submit_limits.max_concurrent", 4)
+	if l, err = NewSubmitLimiter(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if l.bucket == nil || l.bucket.rate != 0.5 || l.bucket.burst != 1 || cap(l.slots) != 4 {
+		t.Errorf("unexpected submit limiter %#v", l)
+	}
+
+	cfg.Set("condor.submit_limits.rate", -1)
+	if _, err = NewSubmitLimiter(cfg); err == nil {
+		t.Error("NewSubmitLimiter accepted a negative rate")
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := &tokenBucket{rate: 2, burst: 3}
+	now := time.Now()
+	var waits []time.Duration
+	for i := 0; i < 5; i++ {
+		waits = append(waits, b.reserve(now))
+	}
+	expected := []time.Duration{0, 0, 0, 500 * time.Millisecond, time.Second}
+	for i := range expected {
+		if waits[i] != expected[i] {
+			t.Fatalf("waits were %v instead of %v", waits, expected)
+		}
+	}
+
+	// The two borrowed tokens are paid back after a second, and the bucket
+	// is full again after another second and a half.
+	now = now.Add(3 * time.Second)
+	if d := b.reserve(now); d != 0 {
+		t.Errorf("waited %s after the bucket refilled", d)
+	}
+}
+
+func TestTokenBucketCancel(t *testing.T) {
+	b := &tokenBucket{rate: 1, burst: 1}
+	now := time.Now()
+	b.reserve(now)
+	if d := b.reserve(now); d != time.Second {
+		t.Fatalf("waited %s instead of 1s", d)
+	}
+	b.cancel()
+	if d := b.reserve(now); d != time.Second {
+		t.Errorf("waited %s instead of 1s after the last token was returned", d)
+	}
+
+	// Returning a token doesn't fill the bucket past the burst.
+	b.cancel()
+	b.cancel()
+	b.cancel()
+	if d := b.reserve(now); d != 0 {
+		t.Errorf("waited %s with a full bucket", d)
+	}
+	if d := b.reserve(now); d != time.Second {
+		t.Errorf("waited %s instead of 1s after the burst", d)
+	}
+}
+
+func TestSubmitLimiterConcurrency(t *testing.T) {
+	cfg := test.InitConfig(t)
+	cfg.Set("condor.submit_limits.max_concurrent", 1)
+	l, err := NewSubmitLimiter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release, err := l.acquire("test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan struct{})
+	go func() {
+		if release, err := l.acquire("test", nil); err == nil {
+			release()
+		}
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("a second submission started while the first was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("the second submission didn't start after the first finished")
+	}
+}
+
+func TestSubmitLimiterStops(t *testing.T) {
+	cfg := test.InitConfig(t)
+	cfg.Set("condor.submit_limits.rate", 0.001)
+	cfg.Set("condor.submit_limits.max_concurrent", 1)
+	l, err := NewSubmitLimiter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	close(stop)
+
+	// The first submission takes the only slot and the only token.
+	release, err := l.acquire("test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = l.acquire("test", stop); !interrupted(err) || ErrorClassOf(err) != Transient {
+		t.Errorf("waiting for a slot returned %v instead of a transient shutdown error", err)
+	}
+	release()
+
+	// The next one gets the slot but has to wait for a token, and gives the
+	// slot back when it stops waiting.
+	if _, err = l.acquire("test", stop); !interrupted(err) {
+		t.Errorf("waiting for a token returned %v instead of a shutdown error", err)
+	}
+	if len(l.slots) != 0 {
+		t.Errorf("%d slots are still taken", len(l.slots))
+	}
+
+	// The token it gave back is the next one to be handed out.
+	if d := l.bucket.reserve(l.now()); d > 1000*time.Second {
+		t.Errorf("the next submission would wait %s instead of up to 1000s", d)
+	}
+}
+
+func TestLaunchWaitsForSubmitLimits(t *testing.T) {
+	cl, scheduler, _ := newTestLauncher(t)
+	cl.cfg.Set("condor.submit_limits.rate", 1)
+	limiter, err := NewSubmitLimiter(cl.cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var slept []time.Duration
+	limiter.sleep = func(d time.Duration, _ <-chan struct{}) bool {
+		slept = append(slept, d)
+		return true
+	}
+	cl.pools.Get("").limiter = limiter
+
+	job := testJob(t, cl)
+	for i := 0; i < 2; i++ {
+		if _, err = cl.launch(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(scheduler.submitted) != 2 {
+		t.Errorf("submitted %d jobs instead of 2", len(scheduler.submitted))
+	}
+	if len(slept) != 1 || slept[0] <= 0 || slept[0] > time.Second {
+		t.Errorf("waited %v instead of up to a second for the second submission", slept)
+	}
+}
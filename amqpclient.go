@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+	"gopkg.in/cyverse-de/messaging.v6"
+)
+
+// amqpClient is a Messenger that adds delayed publishing and dead-lettering
+// to a *messaging.Client. The messaging library can't set message headers,
+// so those messages are published over a separate connection. The channel is
+// in confirm mode, and each publish waits for the broker to confirm it, so
+// that the delivery it replaces is only acknowledged once it's safe.
+//
+// Each delay gets its own queue, bound to the delay exchange, with a message
+// TTL equal to the delay. Expired messages are dead-lettered to the
+// destination queue. Since every message in a delay queue has the same TTL,
+// messages expire in the order they were published.
+type amqpClient struct {
+	*messaging.Client
+	uri           string
+	delayExchange string
+	deadLetters   *DeadLetterConfig
+
+	mu       sync.Mutex
+	conn     *amqp.Connection
+	ch       *amqp.Channel
+	confirms chan amqp.Confirmation
+}
+
+// publishConfirmTimeout is how long to wait for the broker to confirm a
+// publish.
+const publishConfirmTimeout = 30 * time.Second
+
+// waitForConfirm waits for the broker to confirm the last publish on a
+// channel in confirm mode.
+func waitForConfirm(confirms <-chan amqp.Confirmation, timeout time.Duration) error {
+	select {
+	case confirm, ok := <-confirms:
+		if !ok {
+			return errors.New("the channel was closed before the publish was confirmed")
+		}
+		if !confirm.Ack {
+			return fmt.Errorf("the broker rejected publish %d", confirm.DeliveryTag)
+		}
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("the publish wasn't confirmed within %s", timeout)
+	}
+}
+
+// newAMQPClient returns a new *amqpClient that publishes delayed messages to
+// the delay exchange and dead letters to the dead-letter exchange on the
+// broker at uri.
+func newAMQPClient(client *messaging.Client, uri, delayExchange string, deadLetters *DeadLetterConfig) *amqpClient {
+	return &amqpClient{
+		Client:        client,
+		uri:           uri,
+		delayExchange: delayExchange,
+		deadLetters:   deadLetters,
+	}
+}
+
+// channel returns the channel used to publish messages with headers,
+// connecting to the broker and declaring the delay and dead-letter exchanges
+// first if necessary. It must be called with c.mu held.
+func (c *amqpClient) channel() (*amqp.Channel, error) {
+	if c.ch != nil {
+		return c.ch, nil
+	}
+
+	conn, err := amqp.Dial(c.uri)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to the broker")
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to open a channel")
+	}
+	if err = ch.ExchangeDeclare(c.delayExchange, amqp.ExchangeDirect, true, false, false, false, nil); err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "failed to declare the delay exchange %s", c.delayExchange)
+	}
+	if err = declareDeadLetters(ch, c.deadLetters); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err = ch.Confirm(false); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to put the channel in confirm mode")
+	}
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	// Reconnect on the next publish if the channel goes away.
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		<-closed
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.ch == ch {
+			c.conn.Close()
+			c.conn, c.ch, c.confirms = nil, nil, nil
+		}
+	}()
+
+	c.conn, c.ch, c.confirms = conn, ch, confirms
+	return ch, nil
+}
+
+// publish publishes the message and waits for the broker to confirm it. The
+// connection is dropped if the publish fails, so that a late confirmation
+// can't be mistaken for the next publish's. It must be called with c.mu held.
+func (c *amqpClient) publish(ch *amqp.Channel, exchange, key string, msg amqp.Publishing) error {
+	err := ch.Publish(exchange, key, false, false, msg)
+	if err == nil {
+		err = waitForConfirm(c.confirms, publishConfirmTimeout)
+	}
+	if err != nil && c.ch == ch {
+		c.conn.Close()
+		c.conn, c.ch, c.confirms = nil, nil, nil
+	}
+	return err
+}
+
+// PublishDelayed publishes body to the destination queue with the given
+// headers once the delay has passed.
+func (c *amqpClient) PublishDelayed(queue string, body []byte, headers amqp.Table, delay time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch, err := c.channel()
+	if err != nil {
+		return err
+	}
+
+	name := delayQueueName(c.delayExchange, queue, delay)
+	if _, err = ch.QueueDeclare(name, true, false, false, false, delayQueueArgs(queue, delay)); err != nil {
+		return errors.Wrapf(err, "failed to declare the delay queue %s", name)
+	}
+	if err = ch.QueueBind(name, name, c.delayExchange, false, nil); err != nil {
+		return errors.Wrapf(err, "failed to bind the delay queue %s", name)
+	}
+
+	err = c.publish(ch, c.delayExchange, name, amqp.Publishing{
+		Headers:      headers,
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Timestamp:    time.Now(),
+		Body:         body,
+	})
+	return errors.Wrapf(err, "failed to publish to the delay queue %s", name)
+}
+
+// PublishDeadLetter publishes body to the dead-letter exchange with the given
+// headers.
+func (c *amqpClient) PublishDeadLetter(body []byte, headers amqp.Table) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch, err := c.channel()
+	if err != nil {
+		return err
+	}
+	err = c.publish(ch, c.deadLetters.Exchange, c.deadLetters.Queue, amqp.Publishing{
+		Headers:      headers,
+		DeliveryMode: amqp.Persistent,
+		Timestamp:    time.Now(),
+		Body:         body,
+	})
+	return errors.Wrapf(err, "failed to publish to the dead-letter exchange %s", c.deadLetters.Exchange)
+}
+
+// Close closes the connection used for publishing messages with headers along
+// with the underlying client.
+func (c *amqpClient) Close() {
+	c.mu.Lock()
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn, c.ch, c.confirms = nil, nil, nil
+	}
+	c.mu.Unlock()
+	c.Client.Close()
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestWaitForConfirm(t *testing.T) {
+	confirms := make(chan amqp.Confirmation, 1)
+	confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	if err := waitForConfirm(confirms, time.Second); err != nil {
+		t.Errorf("an acknowledged publish returned %v", err)
+	}
+
+	confirms <- amqp.Confirmation{DeliveryTag: 2, Ack: false}
+	if err := waitForConfirm(confirms, time.Second); err == nil {
+		t.Error("a rejected publish didn't return an error")
+	}
+
+	if err := waitForConfirm(confirms, 10*time.Millisecond); err == nil {
+		t.Error("an unconfirmed publish didn't return an error")
+	}
+
+	close(confirms)
+	if err := waitForConfirm(confirms, time.Second); err == nil {
+		t.Error("a closed channel didn't return an error")
+	}
+}
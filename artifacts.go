@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/viper"
+	"gopkg.in/cyverse-de/model.v4"
+)
+
+// ArtifactGenerator writes an extra file that a job needs to its submission
+// directory before the job is submitted, such as the porklock iRODS config.
+// The cfg contains the settings for the pool the job is being launched on.
+type ArtifactGenerator interface {
+	Generate(cl *CondorLauncher, cfg *viper.Viper, s *model.Job, sdir string) error
+}
+
+// ArtifactGeneratorFunc is an adapter that allows an ordinary function to be
+// used as an ArtifactGenerator.
+type ArtifactGeneratorFunc func(cl *CondorLauncher, cfg *viper.Viper, s *model.Job, sdir string) error
+
+// Generate calls f(cl, cfg, s, sdir).
+func (f ArtifactGeneratorFunc) Generate(cl *CondorLauncher, cfg *viper.Viper, s *model.Job, sdir string) error {
+	return f(cl, cfg, s, sdir)
+}
+
+// irodsConfigArtifact writes the iRODS config used by porklock to transfer
+// the job's inputs and outputs.
+var irodsConfigArtifact = ArtifactGeneratorFunc((*CondorLauncher).storeConfig)
+
+// artifactGenerators lists the artifact generators for each execution target.
+// Every target that jobs can be launched on must be listed, even if it doesn't
+// need any extra files. OSG jobs transfer their files with the tickets listed
+// in the files written by the job submission builder, so they don't need the
+// iRODS config.
+var artifactGenerators = map[string][]ArtifactGenerator{
+	"condor":    {irodsConfigArtifact},
+	"interapps": {irodsConfigArtifact},
+	"osg":       {},
+}
+
+// RegisterArtifactGenerators sets the artifact generators for the execution
+// target, replacing any that were registered earlier. It isn't safe to call
+// while jobs are being launched.
+func RegisterArtifactGenerators(target string, generators ...ArtifactGenerator) {
+	artifactGenerators[target] = generators
+}
+
+// generateArtifacts runs the artifact generators for the job's execution
+// target.
+func (cl *CondorLauncher) generateArtifacts(cfg *viper.Viper, s *model.Job, sdir string) error {
+	generators, ok := artifactGenerators[s.ExecutionTarget]
+	if !ok {
+		return permanentError("render", fmt.Errorf("unrecognized execution target: %s", s.ExecutionTarget))
+	}
+	for _, generator := range generators {
+		if err := generator.Generate(cl, cfg, s, sdir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
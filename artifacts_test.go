@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/spf13/viper"
+	"gopkg.in/cyverse-de/model.v4"
+)
+
+// prepareTarget writes the submission files for the test job with the given
+// execution target to the launcher's in-memory filesystem and returns the
+// launcher and the directory.
+func prepareTarget(t *testing.T, target string) (*CondorLauncher, string, error) {
+	cl, _, _ := newTestLauncher(t)
+	j := testJob(t, cl)
+	j.ExecutionTarget = target
+
+	sdir := path.Join("/submissions", target)
+	_, err := cl.prepare(j, cl.pools.Route(j), sdir)
+	return cl, sdir, err
+}
+
+func TestArtifactsPerTarget(t *testing.T) {
+	tests := []struct {
+		target      string
+		irodsConfig bool
+	}{
+		{"condor", true},
+		{"interapps", true},
+		{"osg", false},
+	}
+	for _, tt := range tests {
+		cl, sdir, err := prepareTarget(t, tt.target)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.target, err)
+		}
+		if _, err = cl.fs.Stat(path.Join(sdir, "iplant.cmd")); err != nil {
+			t.Errorf("%s: the submission file was not written: %s", tt.target, err)
+		}
+		_, err = cl.fs.Stat(path.Join(sdir, "irods-config"))
+		if tt.irodsConfig && err != nil {
+			t.Errorf("%s: the irods config was not written: %s", tt.target, err)
+		}
+		if !tt.irodsConfig && !os.IsNotExist(err) {
+			t.Errorf("%s: the irods config was written", tt.target)
+		}
+	}
+}
+
+func TestArtifactsUnknownTarget(t *testing.T) {
+	if _, _, err := prepareTarget(t, "bogus"); err == nil {
+		t.Error("prepare did not return an error for an unrecognized execution target")
+	}
+}
+
+func TestRegisterArtifactGenerators(t *testing.T) {
+	original := artifactGenerators["osg"]
+	defer RegisterArtifactGenerators("osg", original...)
+
+	manifest := ArtifactGeneratorFunc(func(cl *CondorLauncher, cfg *viper.Viper, s *model.Job, sdir string) error {
+		return cl.fs.WriteFile(path.Join(sdir, "transfer.manifest"), []byte(s.OutputDirectory()), 0644)
+	})
+	RegisterArtifactGenerators("osg", manifest)
+
+	cl, sdir, err := prepareTarget(t, "osg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cl.fs.Stat(path.Join(sdir, "transfer.manifest")); err != nil {
+		t.Errorf("the registered artifact was not written: %s", err)
+	}
+
+	failure := ArtifactGeneratorFunc(func(*CondorLauncher, *viper.Viper, *model.Job, string) error {
+		return errors.New("credentials unavailable")
+	})
+	RegisterArtifactGenerators("osg", failure)
+	if _, _, err = prepareTarget(t, "osg"); err == nil {
+		t.Error("prepare did not return the artifact generator's error")
+	}
+}
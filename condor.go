@@ -1,4 +1,3 @@
-//
 // condor-launcher launches jobs on an HTCondor cluster.
 //
 // This service connects to an AMQP broker's "jobs" exchange and waits for
@@ -10,16 +9,20 @@
 // run inside a Docker container. Our Condor cluster is moderately large and
 // requires a lot of ports to be opened up, which doesn't play nicely with
 // Docker.
-//
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path"
+	"sync"
+	"syscall"
 	"text/template"
 	"time"
 
@@ -57,6 +60,7 @@ func ackDelivery(delivery amqp.Delivery, logMsgOnErr string) {
 }
 
 func rejectDelivery(delivery amqp.Delivery, requeue bool, logMsgOnErr string) {
+	observeReject(requeue)
 	if err := delivery.Reject(requeue); err != nil {
 		log.Error(errors.Wrap(err, logMsgOnErr))
 	}
@@ -72,183 +76,572 @@ type Messenger interface {
 	SetupPublishing(string) error
 	PublishJobUpdate(*messaging.UpdateMessage) error
 	DeleteQueue(name string) error
+	PublishDelayed(queue string, body []byte, headers amqp.Table, delay time.Duration) error
+	PublishDeadLetter(body []byte, headers amqp.Table) error
 }
 
 // CondorLauncher contains the condor-launcher application state.
 type CondorLauncher struct {
-	cfg          *viper.Viper
-	client       Messenger
-	fs           fsys
-	condorSubmit string //path to the condor_submit executable
-	condorRm     string // path to the condor_rm executable
+	cfg    *viper.Viper
+	client Messenger
+	fs     fsys
+	pools  *Pools
+	ledger Ledger
+
+	heldPolicy     *HeldPolicy
+	janitor        *Janitor
+	statusPoller   *StatusPoller
+	eventLog       *EventLog
+	delayedRetries *DelayedRetryPolicy
+	quotas         *QuotaPolicy
+
+	ledgerRetention time.Duration // how long launch records are kept
+
+	// placeholderCredentials is true if the iRODS config is written with
+	// placeholderCredential instead of a real password or ticket, so that
+	// rendering a job has no side effects.
+	placeholderCredentials bool
+
+	mu       sync.Mutex     // guards draining
+	draining bool           // true once shutdown has started
+	stopping chan struct{}  // closed once shutdown has started
+	inflight sync.WaitGroup // tracks deliveries and sweeps that are being handled
 }
 
 // New returns a new *CondorLauncher
-func New(c *viper.Viper, client Messenger, fs fsys, condorSubmit, condorRm string) *CondorLauncher {
+func New(c *viper.Viper, client Messenger, fs fsys, pools *Pools, ledger Ledger) *CondorLauncher {
 	return &CondorLauncher{
-		cfg:          c,
-		client:       client,
-		fs:           fs,
-		condorSubmit: condorSubmit,
-		condorRm:     condorRm,
+		cfg:    c,
+		client: client,
+		fs:     fs,
+		pools:  pools,
+		ledger: ledger,
+
+		heldPolicy:     DefaultHeldPolicy(),
+		janitor:        DefaultJanitor(),
+		statusPoller:   DefaultStatusPoller(),
+		eventLog:       DefaultEventLog(),
+		delayedRetries: DefaultDelayedRetryPolicy(),
+		quotas:         DefaultQuotaPolicy(),
+
+		ledgerRetention: defaultLedgerRetention,
+
+		stopping: make(chan struct{}),
+	}
+}
+
+// submissionDir returns the path to the logs directory that the submission
+// files for the job are written to.
+func submissionDir(s *model.Job) string {
+	sdir := s.CondorLogDirectory()
+	if path.Base(sdir) != "logs" {
+		sdir = path.Join(sdir, "logs")
 	}
+	return sdir
 }
 
-func (cl *CondorLauncher) storeConfig(s *model.Job) error {
+// placeholderCredential takes the place of the iRODS password or ticket in
+// the iRODS config when the launcher is using placeholder credentials.
+const placeholderCredential = "PLACEHOLDER"
+
+// storeConfig writes the iRODS configuration for the job to sdir, using the
+// irods settings from cfg. The job is issued a ticket instead of the service
+// account password if a ticket issuer is configured. Neither is looked up if
+// the launcher is using placeholder credentials. The file is only readable by
+// the launcher's user since it contains credentials.
+func (cl *CondorLauncher) storeConfig(cfg *viper.Viper, s *model.Job, sdir string) error {
 	cfgData := &IRODSConfig{
-		IRODSHost: cl.cfg.GetString("irods.host"),
-		IRODSPort: cl.cfg.GetString("irods.port"),
-		IRODSUser: cl.cfg.GetString("irods.user"),
-		IRODSPass: cl.cfg.GetString("irods.pass"),
-		IRODSBase: cl.cfg.GetString("irods.base"),
-		IRODSResc: cl.cfg.GetString("irods.resc"),
-		IRODSZone: cl.cfg.GetString("irods.zone"),
+		IRODSHost: cfg.GetString("irods.host"),
+		IRODSPort: cfg.GetString("irods.port"),
+		IRODSUser: cfg.GetString("irods.user"),
+		IRODSBase: cfg.GetString("irods.base"),
+		IRODSResc: cfg.GetString("irods.resc"),
+		IRODSZone: cfg.GetString("irods.zone"),
 	}
+
+	issuer := NewTicketIssuer(cfg)
+	switch {
+	case cl.placeholderCredentials && issuer != nil:
+		cfgData.IRODSTicket = placeholderCredential
+	case cl.placeholderCredentials:
+		cfgData.IRODSPass = placeholderCredential
+	case issuer != nil:
+		ticket, err := issuer.IssueTicket(s)
+		if err != nil {
+			return transientError("credentials", err)
+		}
+		cfgData.IRODSTicket = ticket
+	default:
+		passwords, err := NewIRODSPasswordProvider(cfg)
+		if err != nil {
+			return permanentError("credentials", err)
+		}
+		if cfgData.IRODSPass, err = passwords.Secret(); err != nil {
+			return transientError("credentials", errors.Wrap(err, "failed to look up the iRODS password"))
+		}
+	}
+
 	fileContent, err := GenerateFile(IRODSConfigTemplate, cfgData)
 	if err != nil {
-		return err
+		return permanentError("render", err)
 	}
 	log.Infof("generated the irods config for job %s", s.InvocationID)
 
-	sdir := s.CondorLogDirectory()
-	if path.Base(sdir) != "logs" {
-		sdir = path.Join(sdir, "logs")
-	}
+	// WriteFile doesn't change the mode of an existing file, which might have
+	// been written by an older version with looser permissions, so any
+	// existing file is removed first.
 	fname := path.Join(sdir, "irods-config")
-	err = os.WriteFile(fname, fileContent.Bytes(), 0644)
+	if _, err = cl.fs.Stat(fname); err == nil {
+		if err = cl.fs.Remove(fname); err != nil {
+			return transientError("stage", errors.Wrapf(err, "failed to remove the existing file %s", fname))
+		}
+	}
+	err = cl.fs.WriteFile(fname, fileContent.Bytes(), 0600)
 	if err != nil {
-		return errors.Wrapf(err, "failed to write to file %s", fname)
+		return transientError("stage", errors.Wrapf(err, "failed to write to file %s", fname))
 	}
 
 	return nil
 }
 
-func (cl *CondorLauncher) launch(s *model.Job, condorPath, condorConfig string) (string, error) {
+// stagingDir returns the directory that the submission files for sdir are
+// written to before they're moved into place.
+func stagingDir(sdir string) string {
+	return path.Join(path.Dir(sdir), fmt.Sprintf(".%s.staging", path.Base(sdir)))
+}
 
-	// Ensure that the logs directory exists for the job.
-	sdir := s.CondorLogDirectory()
-	if path.Base(sdir) != "logs" {
-		sdir = path.Join(sdir, "logs")
+// prepare writes the submission files for launching the job on the pool to
+// sdir and returns the path to the submission file. The files are written to
+// a staging directory first and renamed to sdir once they're all in place, so
+// sdir never contains a partial set of files. The staging directory is removed
+// if anything fails.
+func (cl *CondorLauncher) prepare(s *model.Job, pool *Pool, sdir string) (string, error) {
+	staging := stagingDir(sdir)
+
+	// Clear out anything left behind by a launcher that exited partway through.
+	if err := cl.fs.RemoveAll(staging); err != nil {
+		return "", transientError("stage", errors.Wrapf(err, "failed to remove the stale staging directory %s", staging))
 	}
-	err := os.MkdirAll(sdir, 0755)
-	if err != nil {
-		return "", errors.Wrapf(err, "failed to create the directory %s", sdir)
+	if err := cl.fs.MkdirAll(staging, 0755); err != nil {
+		return "", transientError("stage", errors.Wrapf(err, "failed to create the directory %s", staging))
 	}
 
-	if s.ExecutionTarget != "osg" {
-		// Write the irods configuration file to relevant locations
-		err = cl.storeConfig(s)
-		if err != nil {
-			return "", err
+	name, err := cl.writeSubmissionFiles(s, pool, staging)
+	if err == nil {
+		err = cl.replaceDir(staging, sdir)
+	}
+	if err != nil {
+		if rmErr := cl.fs.RemoveAll(staging); rmErr != nil {
+			log.Errorf("%+v\n", errors.Wrapf(rmErr, "failed to clean up %s", staging))
 		}
+		return "", err
+	}
+	return path.Join(sdir, name), nil
+}
+
+// writeSubmissionFiles writes the submission files for launching the job on
+// the pool to dir, which must already exist, and returns the name of the
+// submission file.
+//
+// The job submission builder is deliberately run in a scratch directory on the
+// local filesystem, since job-templates only exports the contents of the
+// excludes file and the input path list and writes everything else itself. Its
+// output is then copied into dir through cl.fs.
+func (cl *CondorLauncher) writeSubmissionFiles(s *model.Job, pool *Pool, dir string) (string, error) {
+
+	// Write the extra files needed by the execution target.
+	if err := cl.generateArtifacts(pool.cfg, s, dir); err != nil {
+		return "", err
 	}
 
 	// Create a copy of the configuration to use for job submission
-	cfgCopy := CopyConfig(cl.cfg)
+	cfgCopy := CopyConfig(pool.cfg)
 
 	// Generate the submission files, always using the condor job submission format for now.
 	jobSubmissionBuilder, err := jobs.NewJobSubmissionBuilder(s.ExecutionTarget, cfgCopy)
 	if err != nil {
-		return "", err
+		return "", permanentError("render", err)
 	}
-	submissionPath, err := jobSubmissionBuilder.Build(s, sdir)
+
+	scratch, err := os.MkdirTemp("", "condor-launcher-build-")
+	if err != nil {
+		return "", transientError("stage", errors.Wrap(err, "failed to create a scratch directory for the submission files"))
+	}
+	defer os.RemoveAll(scratch)
+
+	submissionPath, err := jobSubmissionBuilder.Build(s, scratch)
+	if err != nil {
+		return "", permanentError("render", err)
+	}
+	if err = importDir(cl.fs, scratch, dir); err != nil {
+		return "", transientError("stage", errors.Wrapf(err, "failed to copy the submission files to %s", dir))
+	}
+	return path.Base(submissionPath), nil
+}
+
+// replaceDir moves the staging directory to sdir, replacing anything left in
+// sdir by an earlier attempt to launch the job.
+func (cl *CondorLauncher) replaceDir(staging, sdir string) error {
+	if _, err := cl.fs.Stat(sdir); err == nil {
+		if err = cl.fs.RemoveAll(sdir); err != nil {
+			return transientError("stage", errors.Wrapf(err, "failed to remove the existing directory %s", sdir))
+		}
+	}
+	if err := cl.fs.Rename(staging, sdir); err != nil {
+		return transientError("stage", errors.Wrapf(err, "failed to move %s to %s", staging, sdir))
+	}
+	return nil
+}
+
+func (cl *CondorLauncher) launch(s *model.Job) (string, error) {
+	pool := cl.pools.Route(s)
+	sdir := submissionDir(s)
+	submissionPath, err := cl.prepare(s, pool, sdir)
 	if err != nil {
 		return "", err
 	}
 
-	// Submit the job to Condor.
-	cmd := exec.Command(cl.condorSubmit, submissionPath)
-	cmd.Dir = path.Dir(submissionPath)
-	cmd.Env = []string{
-		fmt.Sprintf("PATH=%s", condorPath),
-		fmt.Sprintf("CONDOR_CONFIG=%s", condorConfig),
+	// Submit the job to Condor once the pool's submit limits allow it.
+	release, err := pool.limiter.acquire(pool.Name, cl.stopping)
+	if err != nil {
+		return "", err
 	}
-	output, err := cmd.CombinedOutput()
-	log.Infof("Output of condor_submit:\n%s\n", output)
+	id, output, err := pool.Scheduler.Submit(submissionPath)
+	release()
 	if err != nil {
-		return "", errors.Wrapf(err, "failed to execute %s", cl.condorSubmit)
+		return "", submitError(err)
 	}
 
 	// Log the Condor job ID.
-	id := string(model.ExtractJobID(output))
-	log.Infof("Condor job id is %s\n", id)
+	log.Infof("Condor job id is %s in pool %s\n", id, pool.Name)
+
+	// Record the launch so that the job can be found again later.
+	err = cl.ledger.Record(&LaunchRecord{
+		InvocationID:    s.InvocationID,
+		ClusterID:       id,
+		Pool:            pool.Name,
+		SubmittedAt:     time.Now(),
+		Submitter:       s.Submitter,
+		ExecutionTarget: s.ExecutionTarget,
+		SubmissionDir:   sdir,
+		SubmitOutput:    string(output),
+	})
+	if err != nil {
+		log.Errorf("%+v\n", err)
+	}
 
-	return id, err
+	return id, nil
 }
 
-// handleLaunchRequests triggers Condor jobs in response to launch request messages.
-func (cl *CondorLauncher) handleLaunchRequests(condorPath, condorConfig string) func(d amqp.Delivery) {
-	return func(delivery amqp.Delivery) {
-		body := delivery.Body
-		requeueOnErr := !delivery.Redelivered
+// launchOnce launches the job unless it was already launched or would exceed
+// a quota. The queue is checked for an earlier submission if checkQueue is
+// true. Failed launches aren't retried here: the delay queue is the only retry
+// layer, so that a transient failure doesn't tie up the delivery while it
+// waits and each retry is counted against amqp.delayed_retries.
+func (cl *CondorLauncher) launchOnce(s *model.Job, checkQueue bool) (string, error) {
+	// The job can't be submitted safely if there's no telling whether it was
+	// submitted before, so the launch is tried again later.
+	jobID, err := cl.existingLaunch(s, checkQueue)
+	if err != nil {
+		return "", transientError("submit", err)
+	}
+	if jobID != "" {
+		log.Infof("Job %s was already launched as Condor ID %s", s.InvocationID, jobID)
+		return jobID, nil
+	}
+
+	release, err := cl.reserveQuota(s)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	return cl.launch(s)
+}
+
+// existingLaunch returns the Condor ID of an earlier submission of the job, or
+// an empty string if the job hasn't been submitted yet. The ledger is always
+// consulted. The queue is only consulted when checkQueue is true, because a
+// submission can only be missing from the ledger if the launcher went away
+// between submitting the job and recording it.
+func (cl *CondorLauncher) existingLaunch(s *model.Job, checkQueue bool) (string, error) {
+	record, err := cl.ledger.Lookup(s.InvocationID)
+	if err != nil {
+		return "", err
+	}
+	if record != nil {
+		return record.ClusterID, nil
+	}
+
+	if !checkQueue {
+		return "", nil
+	}
+
+	pool := cl.pools.Route(s)
+	ads, err := pool.Scheduler.Query(fmt.Sprintf(`IpcUuid =?= "%s"`, s.InvocationID), "ClusterId")
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to look for existing submissions of %s", s.InvocationID)
+	}
+	if len(ads) == 0 {
+		return "", nil
+	}
+	id := ads[0].Cluster()
+
+	// Record the submission so that the queue doesn't need to be checked again.
+	err = cl.ledger.Record(&LaunchRecord{
+		InvocationID:    s.InvocationID,
+		ClusterID:       id,
+		Pool:            pool.Name,
+		SubmittedAt:     time.Now(),
+		Submitter:       s.Submitter,
+		ExecutionTarget: s.ExecutionTarget,
+		SubmissionDir:   submissionDir(s),
+	})
+	if err != nil {
+		log.Errorf("%+v\n", err)
+	}
+
+	return id, nil
+}
+
+// processLaunchRequest handles the body of a launch request message the same
+// way whether it came from AMQP or from the command line. It returns the
+// Condor ID of the job, or an error if the launch failed. The queue is checked
+// for an earlier submission of the job if checkQueue is true. A failure update
+// is only published for permanent errors or when final is true, since the
+// request will be retried otherwise.
+func (cl *CondorLauncher) processLaunchRequest(body []byte, checkQueue, final bool) (string, error) {
+	req := messaging.JobRequest{}
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		log.Errorf("%+v\n", errors.Wrap(err, "failed to unmarshal launch request json"))
+		log.Error(string(body[:]))
+		return "", permanentError("parse", err)
+	}
 
-		req := messaging.JobRequest{}
-		err := json.Unmarshal(body, &req)
+	switch req.Command {
+	case messaging.Launch:
+		if req.Job == nil {
+			log.Errorf("launch request has no job: %s", body)
+			return "", permanentError("parse", errors.New("the launch request has no job"))
+		}
+
+		jobID, err := cl.launchOnce(req.Job, checkQueue)
+		launchesTotal.WithLabelValues(req.Job.ExecutionTarget, cl.launchResult(err)).Inc()
 		if err != nil {
-			log.Errorf("%+v\n", errors.Wrap(err, "failed to unmarshal launch request json"))
-			log.Error(string(body[:]))
+			log.Errorf("%+v\n", err)
 
-			rejectDelivery(delivery, requeueOnErr, "failed to Reject amqp Launch request delivery")
+			// Permanent failures won't be retried, so the user is told right
+			// away instead of after the last retry. Launches deferred by the
+			// quota policy or interrupted by shutdown haven't failed.
+			if (final || ErrorClassOf(err) == Permanent) && !cl.quotaDeferred(err) && !interrupted(err) {
+				cl.publishLaunchFailure(req.Job, err)
+			}
 
-			return
+			return "", err
 		}
 
-		switch req.Command {
-		case messaging.Launch:
-			jobID, err := cl.launch(req.Job, condorPath, condorConfig)
-			if err != nil {
-				log.Errorf("%+v\n", err)
+		log.Infof("Launched Condor ID %s", jobID)
+		err = cl.client.PublishJobUpdate(&messaging.UpdateMessage{
+			Job:     req.Job,
+			State:   messaging.SubmittedState,
+			Message: fmt.Sprintf("Launched Condor ID %s", jobID),
+		})
+		if err != nil {
+			log.Errorf("%+v\n", errors.Wrap(err, "failed to publish successful launch job update"))
+		}
+		return jobID, nil
+	default:
+		log.Errorf("condor_launches message handler got unrecognized command: %+v\n", req.Command)
+		return "", permanentError("command", fmt.Errorf("unrecognized command %v", req.Command))
+	}
+}
 
-				if !requeueOnErr {
-					err = cl.client.PublishJobUpdate(&messaging.UpdateMessage{
-						Job:     req.Job,
-						State:   messaging.FailedState,
-						Message: fmt.Sprintf("condor-launcher failed to launch job:\n %s", err),
-					})
-					if err != nil {
-						log.Errorf("%+v\n", errors.Wrap(err, "failed to publish launch failure job update"))
-					}
-				}
+// publishLaunchFailure tells the user that their job couldn't be launched.
+func (cl *CondorLauncher) publishLaunchFailure(job *model.Job, err error) {
+	perr := cl.client.PublishJobUpdate(&messaging.UpdateMessage{
+		Job:     job,
+		State:   messaging.FailedState,
+		Message: launchFailureMessage(err),
+	})
+	if perr != nil {
+		log.Errorf("%+v\n", errors.Wrap(perr, "failed to publish launch failure job update"))
+	}
+}
 
-				rejectDelivery(delivery, requeueOnErr, "failed to Reject amqp Launch request delivery")
-			} else {
-				log.Infof("Launched Condor ID %s", jobID)
-				err = cl.client.PublishJobUpdate(&messaging.UpdateMessage{
-					Job:     req.Job,
-					State:   messaging.SubmittedState,
-					Message: fmt.Sprintf("Launched Condor ID %s", jobID),
-				})
-				if err != nil {
-					log.Errorf("%+v\n", errors.Wrap(err, "failed to publish successful launch job update"))
-				}
+// launchRequestJob returns the job in the launch request in body, or nil if
+// the request can't be parsed.
+func launchRequestJob(body []byte) *model.Job {
+	req := messaging.JobRequest{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil
+	}
+	return req.Job
+}
+
+// failLaunchRequest tells the user that the launch request in body failed,
+// for requests that are dropped after processLaunchRequest expected them to
+// be retried.
+func (cl *CondorLauncher) failLaunchRequest(body []byte, err error) {
+	if job := launchRequestJob(body); job != nil {
+		cl.publishLaunchFailure(job, err)
+	}
+}
+
+// handleLaunchRequests triggers Condor jobs in response to launch request
+// messages. Requests that fail with transient errors are published to a delay
+// queue to be retried later, until the delayed retry policy's limit is
+// reached. If delayed retries are turned off, or the delayed message can't be
+// published, the request is requeued unless it has already been redelivered,
+// in which case the launch fails.
+// Requests that would exceed a quota are deferred if the quota policy says so,
+// and fail once they've been deferred too many times.
+// Requests that can't be parsed or have an unrecognized command are
+// dead-lettered.
+func (cl *CondorLauncher) handleLaunchRequests() func(d amqp.Delivery) {
+	return func(delivery amqp.Delivery) {
+		// Leave the delivery unacknowledged during shutdown. The broker will
+		// redeliver it once the connection is closed.
+		if !cl.begin() {
+			log.Infoln("shutting down, leaving the launch request for redelivery")
+			return
+		}
+		defer cl.finish()
+		cl.handleLaunchDelivery(delivery)
+	}
+}
 
-				ackDelivery(delivery, "failed to ACK amqp Launch request delivery")
+// handleLaunchDelivery handles a single launch request delivery for
+// handleLaunchRequests, acknowledging or rejecting it. It returns the Condor
+// ID of the job, or the error the launch failed with.
+func (cl *CondorLauncher) handleLaunchDelivery(delivery amqp.Delivery) (string, error) {
+	retries := deliveryRetries(delivery.Headers)
+	maxRetries := cl.delayedRetries.MaxRetries
+	canDelay := retries < maxRetries
+	final := !canDelay && (maxRetries > 0 || delivery.Redelivered)
+	checkQueue := delivery.Redelivered || retries > 0
+
+	jobID, err := cl.processLaunchRequest(delivery.Body, checkQueue, final)
+	if reason := deadLetterReason(err); reason != "" {
+		cl.deadLetter(delivery, launchesQueue, reason, err)
+		return jobID, err
+	}
+	if interrupted(err) {
+		// Another launcher, or this one once it restarts, picks the request up
+		// again without it counting as a retry.
+		rejectDelivery(delivery, true, "failed to Reject amqp Launch request delivery")
+		return jobID, err
+	}
+	if cl.quotaDeferred(err) {
+		deferrals := deliveryDeferrals(delivery.Headers)
+		if deferrals >= cl.quotas.MaxDeferrals {
+			log.Errorf("Giving up on the launch request after %d deferrals", deferrals)
+			cl.failLaunchRequest(delivery.Body, err)
+			rejectDelivery(delivery, false, "failed to Reject amqp Launch request delivery")
+			return jobID, err
+		}
+		if derr := cl.deferLaunch(delivery.Body, retries, deferrals+1, err); derr != nil {
+			log.Errorf("%+v\n", derr)
+			rejectDelivery(delivery, true, "failed to Reject amqp Launch request delivery")
+			return jobID, err
+		}
+		ackDelivery(delivery, "failed to ACK amqp Launch request delivery")
+		return jobID, err
+	}
+	switch {
+	case err == nil:
+		ackDelivery(delivery, "failed to ACK amqp Launch request delivery")
+	case final || ErrorClassOf(err) == Permanent:
+		rejectDelivery(delivery, false, "failed to Reject amqp Launch request delivery")
+	case canDelay:
+		if derr := cl.delayLaunch(delivery.Body, retries+1); derr != nil {
+			log.Errorf("%+v\n", derr)
+			if delivery.Redelivered {
+				cl.failLaunchRequest(delivery.Body, err)
 			}
-		default:
-			log.Errorf("condor_launches message handler got unrecognized command: %+v\n", req.Command)
-			ackDelivery(delivery, "failed to ACK amqp Launch request delivery")
+			rejectDelivery(delivery, !delivery.Redelivered, "failed to Reject amqp Launch request delivery")
+			return jobID, err
 		}
+		ackDelivery(delivery, "failed to ACK amqp Launch request delivery")
+	default:
+		rejectDelivery(delivery, true, "failed to Reject amqp Launch request delivery")
 	}
+	return jobID, err
 }
 
-func (cl *CondorLauncher) stopJob(invocationID, condorPath, condorConfig string) error {
+// delayLaunch publishes the launch request to the delay queue for the given
+// retry, counting from 1.
+func (cl *CondorLauncher) delayLaunch(body []byte, retry int) error {
+	delay := cl.delayedRetries.Delay(retry)
+	log.Infof("Retrying the launch request in %s (retry %d of %d)", delay, retry, cl.delayedRetries.MaxRetries)
+	if err := cl.client.PublishDelayed(launchesQueue, body, delayHeaders(retry, 0), delay); err != nil {
+		return errors.Wrap(err, "failed to schedule a retry of the launch request")
+	}
+	delayedLaunchRetriesTotal.Inc()
+	return nil
+}
+
+// stopJob removes the job for a user's stop request.
+func (cl *CondorLauncher) stopJob(invocationID string) error {
+	return cl.killJob(invocationID, "Job was killed")
+}
+
+// removeJob removes the job from the queue of the pool it was launched on. If
+// the pool isn't known, the job is removed from every pool that has it.
+func (cl *CondorLauncher) removeJob(invocationID string) ([]byte, error) {
+	record, err := cl.ledger.Lookup(invocationID)
+	if err != nil {
+		log.Errorf("%+v\n", err)
+	}
+
+	if record != nil && record.ClusterID != "" {
+		if pool := cl.pools.Get(record.Pool); pool != nil {
+			log.Infof("Running condor_rm for %s (cluster %s in pool %s)", invocationID, record.ClusterID, pool.Name)
+			output, err := pool.Scheduler.RemoveCluster(record.ClusterID)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to run 'condor_rm %s' in pool %s", record.ClusterID, pool.Name)
+			}
+			return output, nil
+		}
+		log.Warnf("Pool %s for invocation id %s is no longer configured", record.Pool, invocationID)
+	}
+
 	var (
 		condorRMOutput []byte
-		err            error
+		removed        bool
 	)
+	for _, pool := range cl.pools.All() {
+		log.Infof("Running condor_rm for %s in pool %s", invocationID, pool.Name)
+		output, rmErr := pool.Scheduler.Remove(invocationID)
+		if rmErr != nil {
+			err = errors.Wrapf(rmErr, "failed to run 'condor_rm %s' in pool %s", invocationID, pool.Name)
+			log.Infof("%s", err)
+			continue
+		}
+		condorRMOutput = append(condorRMOutput, output...)
+		removed = true
+	}
+	if !removed {
+		return nil, err
+	}
+	return condorRMOutput, nil
+}
 
-	log.Infof("Running condor_rm for %s", invocationID)
-	if condorRMOutput, err = ExecCondorRm(invocationID, condorPath, condorConfig); err != nil {
-		log.Errorf("%+v\n", errors.Wrapf(err, "failed to run 'condor_rm %s'", invocationID))
+// killJob removes the job from the queue and tells the user that it failed
+// with the given message.
+func (cl *CondorLauncher) killJob(invocationID, message string) error {
+	condorRMOutput, err := cl.removeJob(invocationID)
+	if err != nil {
+		log.Errorf("%+v\n", err)
 		return err
 	}
+	cl.markJobRemoved(invocationID, time.Now())
 
 	fauxJob := model.New(cl.cfg)
 	fauxJob.InvocationID = invocationID
 	update := &messaging.UpdateMessage{
 		Job:     fauxJob,
 		State:   messaging.FailedState,
-		Message: "Job was killed",
+		Message: message,
 	}
 	if err = cl.client.PublishJobUpdate(update); err != nil {
 		log.Errorf("%+v\n", errors.Wrap(err, "failed to publish job update for a stopped job"))
@@ -262,8 +655,16 @@ func (cl *CondorLauncher) stopJob(invocationID, condorPath, condorConfig string)
 	return nil
 }
 
-func (cl *CondorLauncher) stopHandler(condorPath, condorConfig string) func(d amqp.Delivery) {
+func (cl *CondorLauncher) stopHandler() func(d amqp.Delivery) {
 	return func(d amqp.Delivery) {
+		// Leave the delivery unacknowledged during shutdown. The broker will
+		// redeliver it once the connection is closed.
+		if !cl.begin() {
+			log.Infoln("shutting down, leaving the stop request for redelivery")
+			return
+		}
+		defer cl.finish()
+
 		var (
 			requeueOnErr bool
 			invID        string
@@ -275,13 +676,15 @@ func (cl *CondorLauncher) stopHandler(condorPath, condorConfig string) func(d am
 		stopRequest := &messaging.StopRequest{}
 		if err = json.Unmarshal(d.Body, stopRequest); err != nil {
 			log.Errorf("%+v\n", errors.Wrap(err, "failed to unmarshal the stop request body"))
-			rejectDelivery(d, requeueOnErr, "failed to Reject StopRequest")
+			cl.deadLetter(d, stopsQueue, DeadLetterUnparseable, err)
 			return
 		}
 
 		invID = stopRequest.InvocationID
 
-		if err = cl.stopJob(invID, condorPath, condorConfig); err != nil {
+		err = cl.stopJob(invID)
+		stopsTotal.WithLabelValues(resultLabel(err)).Inc()
+		if err != nil {
 			rejectDelivery(d, requeueOnErr, fmt.Sprintf("failed to Reject StopRequest for %s", invID))
 		} else {
 			ackDelivery(d, fmt.Sprintf("failed to ACK StopRequest for %s", invID))
@@ -289,47 +692,91 @@ func (cl *CondorLauncher) stopHandler(condorPath, condorConfig string) func(d am
 	}
 }
 
-func killHeldJobs(launcher *CondorLauncher, condorPath, condorConfig string) {
-	var (
-		err         error
-		cmdOutput   []byte
-		heldEntries []string
-	)
-	log.Infoln("Looking for jobs in the held state...")
-	if cmdOutput, err = ExecCondorQHeldIDs(condorPath, condorConfig); err != nil {
-		log.Errorf("%+v\n", errors.Wrap(err, "error running condor_q"))
-		return
-	}
-	heldEntries = heldQueueInvocationIDs(cmdOutput)
-	log.Infof("There are %d jobs in the held state", len(heldEntries))
-	for _, invocationID := range heldEntries {
-		if invocationID != "" {
-			log.Infof("Sending stop request for invocation id %s", invocationID)
-			if err = launcher.stopJob(invocationID, condorPath, condorConfig); err != nil {
-				log.Errorf("%+v\n", errors.Wrap(err, "error sending stop request"))
+// startTicker starts up the code that calls fn every d. Each call is tracked
+// as in-flight work so that a drain waits for it, and the ticker stops once the
+// launcher starts draining or the done channel is closed.
+func (cl *CondorLauncher) startTicker(d time.Duration, done <-chan struct{}, fn func()) *time.Ticker {
+	t := time.NewTicker(d)
+	go func() {
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				if !cl.begin() {
+					return
+				}
+				fn()
+				cl.finish()
 			}
 		}
+	}()
+	return t
+}
+
+// startHeldTicker starts up the code that periodically fires and applies the
+// held job policy. The ticker stops when the done channel is closed.
+func startHeldTicker(launcher *CondorLauncher, done <-chan struct{}) (*time.Ticker, error) {
+	d := launcher.heldPolicy.Interval
+	if d <= 0 {
+		return nil, fmt.Errorf("invalid held job sweep interval %s", d)
 	}
+	return launcher.startTicker(d, done, func() { sweepHeldJobs(launcher) }), nil
 }
 
-// startHeldTicker starts up the code that periodically fires and clean up held
-// jobs
-func startHeldTicker(launcher *CondorLauncher, condorPath, condorConfig string) (*time.Ticker, error) {
-	d, err := time.ParseDuration("30s")
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to parse duration '30s'")
+// configure sets up the launcher's policies from the configuration. It's used
+// by both the service and the launch subcommand, so that a replayed launch is
+// handled the same way as one from AMQP.
+func (cl *CondorLauncher) configure(cfg *viper.Viper) error {
+	var err error
+	if cl.delayedRetries, err = NewDelayedRetryPolicy(cfg); err != nil {
+		return err
 	}
-	t := time.NewTicker(d)
-	go func(t *time.Ticker, launcher *CondorLauncher) {
-		for {
-			<-t.C
-			killHeldJobs(launcher, condorPath, condorConfig)
-		}
-	}(t, launcher)
-	return t, nil
+	if cl.heldPolicy, err = NewHeldPolicy(cfg); err != nil {
+		return err
+	}
+	if cl.janitor, err = NewJanitor(cfg); err != nil {
+		return err
+	}
+	if cfg.IsSet("condor.launch_retries") {
+		log.Warnln("condor.launch_retries is no longer used, launches are only retried through amqp.delayed_retries")
+	}
+	cl.statusPoller = NewStatusPoller(cfg)
+	cl.eventLog = NewEventLog(cfg)
+	if cl.quotas, err = NewQuotaPolicy(cfg); err != nil {
+		return err
+	}
+	cl.ledgerRetention = ledgerRetention(cfg)
+	if err = cl.checkLedgerRetention(); err != nil {
+		return err
+	}
+	if err = cl.checkCredentials(); err != nil {
+		return err
+	}
+	return cl.checkQuotaPolicy()
 }
 
 func main() {
+	// Handle the subcommands used for debugging.
+	if len(os.Args) > 1 {
+		var command func([]string, io.Reader, io.Writer) error
+		switch os.Args[1] {
+		case "render":
+			command = renderCommand
+		case "launch":
+			command = launchCommand
+		case "dead-letters":
+			command = deadLettersCommand
+		}
+		if command != nil {
+			if err := command(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+				log.Fatalf("%+v\n", err)
+			}
+			os.Exit(0)
+		}
+	}
+
 	var (
 		cfgPath     = flag.String("config", "", "Path to the config file. Required.")
 		showVersion = flag.Bool("version", false, "Print the version information")
@@ -348,9 +795,6 @@ func main() {
 		os.Exit(-1)
 	}
 
-	csPath := findExecPath("condor_submit")
-	crPath := findExecPath("condor_rm")
-
 	cfg, err := configurate.InitDefaults(*cfgPath, configurate.JobServicesDefaults)
 	if err != nil {
 		log.Fatalf("%+v\n", errors.Wrap(err, "failed to initialize configuration defaults"))
@@ -365,34 +809,87 @@ func main() {
 	if err != nil {
 		log.Fatalf("%+v\n", errors.Wrap(err, "failed to create new AMQP client"))
 	}
-	defer client.Close()
 
-	launcher := New(cfg, client, &osys{}, csPath, crPath)
+	delayedRetries, err := NewDelayedRetryPolicy(cfg)
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+
+	fs := &osys{}
+	pools, err := NewPools(cfg, func(cfg *viper.Viper) (Scheduler, error) { return NewScheduler(cfg, fs) })
+	if err != nil {
+		log.Fatalf("%+v\n", errors.Wrap(err, "failed to set up the HTCondor pools"))
+	}
+
+	ledgerPath := cfg.GetString("condor.ledger_path")
+	if ledgerPath == "" {
+		ledgerPath = defaultLedgerPath
+	}
+	ledger, err := NewBoltLedger(ledgerPath)
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	defer ledger.Close()
+
+	launcher := New(cfg, newAMQPClient(client, uri, delayedRetries.Exchange, NewDeadLetterConfig(cfg)), fs, pools, ledger)
+	if err = launcher.configure(cfg); err != nil {
+		log.Fatalf("%+v\n", err)
+	}
 	err = launcher.client.SetupPublishing(exchangeName)
 	if err != nil {
 		log.Fatalf("%+v\n", errors.Wrap(err, "failed to setup publishing"))
 	}
 	go launcher.client.Listen()
 
-	condorPath := cfg.GetString("condor.path_env_var")
-	condorConfig := cfg.GetString("condor.condor_config")
+	stopTicker := make(chan struct{})
+	if launcher.eventLog.Enabled {
+		// The event logs take the place of the held job sweep and the status
+		// poller, neither of which is started.
+		launcher.startTicker(launcher.eventLog.Interval, stopTicker, func() {
+			if err := tailEventLogs(launcher, time.Now()); err != nil {
+				log.Errorf("%+v\n", err)
+			}
+		})
+		log.Infof("Started up the event log tailer, running every %s", launcher.eventLog.Interval)
+	} else {
+		ticker, err := startHeldTicker(launcher, stopTicker)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		log.Infof("Started up the held state ticker: %#v", ticker)
 
-	ticker, err := startHeldTicker(
-		launcher,
-		condorPath,
-		condorConfig,
-	)
-	if err != nil {
-		log.Fatalf("%+v\n", err)
+		if launcher.statusPoller.Enabled {
+			launcher.startTicker(launcher.statusPoller.Interval, stopTicker, func() {
+				if err := pollJobStatuses(launcher, time.Now()); err != nil {
+					log.Errorf("%+v\n", err)
+				}
+			})
+			log.Infof("Started up the status poller, running every %s", launcher.statusPoller.Interval)
+		}
+	}
+
+	if launcher.janitor.Enabled {
+		launcher.startTicker(launcher.janitor.Interval, stopTicker, func() {
+			if _, err := cleanSubmissionDirs(launcher, launcher.janitor.DryRun, time.Now()); err != nil {
+				log.Errorf("%+v\n", err)
+			}
+		})
+		log.Infof("Started up the janitor, running every %s", launcher.janitor.Interval)
 	}
-	log.Infof("Started up the held state ticker: %#v", ticker)
+
+	launcher.startTicker(ledgerPruneInterval, stopTicker, func() {
+		if err := pruneLedger(launcher, time.Now()); err != nil {
+			log.Errorf("%+v\n", err)
+		}
+	})
+	log.Infof("Started up the ledger pruner, keeping launch records for %s", launcher.ledgerRetention)
 
 	launcher.client.AddConsumer(
 		exchangeName,
 		exchangeType,
-		"condor-launcher-stops",
+		stopsQueue,
 		messaging.StopRequestKey("*"),
-		launcher.stopHandler(condorPath, condorConfig),
+		launcher.stopHandler(),
 		cfg.GetInt("amqp.prefetch.stops"),
 	)
 
@@ -400,12 +897,67 @@ func main() {
 	launcher.client.AddConsumer(
 		exchangeName,
 		exchangeType,
-		"condor_launches",
+		launchesQueue,
 		messaging.LaunchesKey,
-		launcher.handleLaunchRequests(condorPath, condorConfig),
+		launcher.handleLaunchRequests(),
 		cfg.GetInt("amqp.prefetch.launches"),
 	)
 
-	spin := make(chan int)
-	<-spin
+	// Serve the admin API.
+	adminServer := &http.Server{
+		Addr:    adminListenAddr(launcher),
+		Handler: newAdminServer(launcher),
+	}
+	go func() {
+		log.Infof("Serving the admin API on %s", adminServer.Addr)
+		if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Errorf("%+v\n", errors.Wrap(err, "admin API server failed"))
+		}
+	}()
+
+	// Serve the metrics on their own address if one is configured.
+	metricsServer := newMetricsServer(cfg)
+	if metricsServer != nil {
+		go func() {
+			log.Infof("Serving the metrics on %s", metricsServer.Addr)
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Errorf("%+v\n", errors.Wrap(err, "metrics server failed"))
+			}
+		}()
+	}
+
+	// Wait for a signal to shut down.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	log.Infof("Received %s, shutting down", sig)
+
+	// Stop accepting new work before anything else, so that no launch starts
+	// after the signal. The messaging client can't cancel its consumers, so
+	// deliveries keep arriving until the connection is closed, but they're
+	// left unacknowledged. Then give the work in flight a chance to finish
+	// before closing the connection to the broker, which redelivers anything
+	// that hasn't been acknowledged. The HTTP servers and the work in flight
+	// share a single deadline, so shutting down never takes longer than the
+	// shutdown timeout.
+	close(stopTicker)
+	launcher.stop()
+	timeout := launcher.shutdownTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err = adminServer.Shutdown(ctx); err != nil {
+		log.Errorf("%+v\n", errors.Wrap(err, "failed to shut down the admin API server"))
+	}
+	if metricsServer != nil {
+		if err = metricsServer.Shutdown(ctx); err != nil {
+			log.Errorf("%+v\n", errors.Wrap(err, "failed to shut down the metrics server"))
+		}
+	}
+	if launcher.drain(ctx) {
+		log.Infoln("All in-flight requests finished")
+	} else {
+		log.Warnf("Timed out after %s waiting for in-flight requests to finish", timeout)
+	}
+	launcher.client.Close()
+	log.Infoln("Shutdown complete")
 }
@@ -2,100 +2,272 @@
 package main
 
 import (
-	"io/ioutil"
+	"encoding/json"
+	"errors"
 	"os"
-	"os/exec"
 	"path"
-	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
-	"github.com/pkg/errors"
-
+	"github.com/streadway/amqp"
+	"gopkg.in/cyverse-de/messaging.v6"
 	"gopkg.in/cyverse-de/model.v4"
 
 	"github.com/cyverse-de/condor-launcher/test"
 )
 
-type filerecord struct {
-	path     string
-	contents []byte
-	mode     os.FileMode
+type delayedMessage struct {
+	queue     string
+	body      []byte
+	retries   int
+	deferrals int
+	delay     time.Duration
 }
 
-type tsys struct {
-	dirsCreated  map[string]os.FileMode
-	filesWritten []filerecord
+type tmessenger struct {
+	updates       []*messaging.UpdateMessage
+	deletedQueues []string
+	delayed       []delayedMessage
+	delayErr      error
+	deadLetters   []deadLetter
+	deadLetterErr error
 }
 
-// newTSys creates a new instance of tsys.
-func newtsys() *tsys {
-	return &tsys{
-		dirsCreated:  make(map[string]os.FileMode, 0),
-		filesWritten: make([]filerecord, 0),
-	}
+type deadLetter struct {
+	body    []byte
+	headers amqp.Table
 }
 
-func (t *tsys) MkdirAll(path string, mode os.FileMode) error {
-	t.dirsCreated[path] = mode
+func (m *tmessenger) AddConsumer(string, string, string, string, messaging.MessageHandler, int) {}
+func (m *tmessenger) Close()                                                                    {}
+func (m *tmessenger) Listen()                                                                   {}
+func (m *tmessenger) Publish(string, []byte) error                                              { return nil }
+func (m *tmessenger) SetupPublishing(string) error                                              { return nil }
+
+func (m *tmessenger) PublishJobUpdate(u *messaging.UpdateMessage) error {
+	m.updates = append(m.updates, u)
 	return nil
 }
 
-func (t *tsys) WriteFile(path string, contents []byte, mode os.FileMode) error {
-	t.filesWritten = append(t.filesWritten, filerecord{
-		path:     path,
-		contents: contents,
-		mode:     mode,
+func (m *tmessenger) PublishDelayed(queue string, body []byte, headers amqp.Table, delay time.Duration) error {
+	if m.delayErr != nil {
+		return m.delayErr
+	}
+	m.delayed = append(m.delayed, delayedMessage{
+		queue:     queue,
+		body:      body,
+		retries:   deliveryRetries(headers),
+		deferrals: deliveryDeferrals(headers),
+		delay:     delay,
 	})
 	return nil
 }
 
+func (m *tmessenger) PublishDeadLetter(body []byte, headers amqp.Table) error {
+	if m.deadLetterErr != nil {
+		return m.deadLetterErr
+	}
+	m.deadLetters = append(m.deadLetters, deadLetter{body: body, headers: headers})
+	return nil
+}
+
+func (m *tmessenger) DeleteQueue(name string) error {
+	m.deletedQueues = append(m.deletedQueues, name)
+	return nil
+}
+
 func TestLaunch(t *testing.T) {
-	cfg := test.InitConfig(t)
-	test.InitPath(t)
-	csPath, err := exec.LookPath("condor_submit")
+	cl, scheduler, _ := newTestLauncher(t)
+	j := testJob(t, cl)
+	actual, err := cl.launch(j)
 	if err != nil {
-		t.Error(errors.Wrapf(err, "failed to find condor_submit in $PATH"))
+		t.Error(err)
+	}
+	expected := "10000"
+	if actual != expected {
+		t.Errorf("launch returned:\n%s\ninstead of:\n%s\n", actual, expected)
+	}
+
+	sdir := submissionDir(j)
+	submissionPath := path.Join(sdir, "iplant.cmd")
+	if len(scheduler.submitted) != 1 || scheduler.submitted[0] != submissionPath {
+		t.Errorf("submitted %v instead of %s", scheduler.submitted, submissionPath)
 	}
-	if !path.IsAbs(csPath) {
-		csPath, err = filepath.Abs(csPath)
-		if err != nil {
-			t.Error(errors.Wrapf(err, "failed to get the absolute path to %s", csPath))
+	for _, name := range []string{"iplant.cmd", "config", "job", "irods-config"} {
+		if _, err = cl.fs.Stat(path.Join(sdir, name)); err != nil {
+			t.Errorf("%s was not written: %s", name, err)
 		}
 	}
-	crPath, err := exec.LookPath("condor_rm")
+	if _, err = os.Stat(path.Join(j.CondorLogPath, "test_this_is_a_test")); !os.IsNotExist(err) {
+		t.Errorf("launch wrote to the local filesystem: %v", err)
+	}
+}
+
+// testJob returns the job in test/test_submission.json.
+func testJob(t *testing.T, cl *CondorLauncher) *model.Job {
+	data, err := os.ReadFile("test/test_submission.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := model.NewFromData(cl.cfg, data)
 	if err != nil {
-		t.Error(errors.Wrap(err, "failed to find condor_rm on the $PATH"))
+		t.Fatal(err)
 	}
-	if !path.IsAbs(crPath) {
-		crPath, err = filepath.Abs(crPath)
-		if err != nil {
-			t.Error(errors.Wrapf(err, "failed to get the absolute path for %s", crPath))
+	return j
+}
+
+func TestLaunchRollsBackOnFailure(t *testing.T) {
+	cl, scheduler, _ := newTestLauncher(t)
+	cl.cfg.Set("irods.password_source", "bogus")
+	j := testJob(t, cl)
+
+	if _, err := cl.launch(j); err == nil {
+		t.Fatal("launch did not return an error")
+	}
+	if len(scheduler.submitted) != 0 {
+		t.Errorf("submitted %v after a failure", scheduler.submitted)
+	}
+	sdir := submissionDir(j)
+	for _, dir := range []string{sdir, stagingDir(sdir)} {
+		if _, err := cl.fs.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("%s was left behind: %v", dir, err)
 		}
 	}
-	filesystem := newtsys()
-	cl := New(cfg, nil, filesystem, csPath, crPath)
+}
+
+func TestLaunchReplacesSubmissionDir(t *testing.T) {
+	cl, _, _ := newTestLauncher(t)
+	j := testJob(t, cl)
+	sdir := submissionDir(j)
+	staging := stagingDir(sdir)
+	for _, dir := range []string{sdir, staging} {
+		if err := cl.fs.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := cl.fs.WriteFile(path.Join(dir, "stale"), []byte("stale"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := cl.launch(j); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.fs.Stat(path.Join(sdir, "stale")); !os.IsNotExist(err) {
+		t.Errorf("the stale file from the earlier attempt was kept: %v", err)
+	}
+	if _, err := cl.fs.Stat(path.Join(sdir, "iplant.cmd")); err != nil {
+		t.Errorf("the submission file was not moved into place: %s", err)
+	}
+	if _, err := cl.fs.Stat(staging); !os.IsNotExist(err) {
+		t.Errorf("the staging directory was left behind: %v", err)
+	}
+}
+
+func TestExecCondorSubmit(t *testing.T) {
+	test.InitPath(t)
+	scheduler, err := NewCondorCLI("", "")
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	submissionPath := path.Join(t.TempDir(), "iplant.cmd")
+	if err = os.WriteFile(submissionPath, []byte("universe = vanilla\n"), 0644); err != nil {
+		t.Fatal(err)
 	}
-	data, err := ioutil.ReadFile("test/test_submission.json")
+	id, _, err := scheduler.Submit(submissionPath)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	j, err := model.NewFromData(cl.cfg, data)
+	if id != "10000" {
+		t.Errorf("Submit returned %s instead of 10000", id)
+	}
+}
+
+func launchDelivery(t *testing.T, cl *CondorLauncher, redelivered bool) amqp.Delivery {
+	job := testJob(t, cl)
+	body, err := json.Marshal(messaging.NewLaunchRequest(job))
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	actual, err := cl.launch(j, "", "")
+	return amqp.Delivery{Body: body, Redelivered: redelivered}
+}
+
+func TestHandleLaunchRequestsSkipsRecordedLaunch(t *testing.T) {
+	cl, scheduler, client := newTestLauncher(t)
+	err := cl.ledger.Record(&LaunchRecord{
+		InvocationID: "07b04ce2-7757-4b21-9e15-0b4c2f44be26",
+		ClusterID:    "12345",
+	})
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	expected := "10000"
-	if actual != expected {
-		t.Errorf("launch returned:\n%s\ninstead of:\n%s\n", actual, expected)
+
+	cl.handleLaunchRequests()(launchDelivery(t, cl, true))
+	if len(scheduler.submitted) != 0 {
+		t.Errorf("the job was submitted again: %v", scheduler.submitted)
+	}
+	if len(client.updates) != 1 {
+		t.Fatalf("published %d updates instead of 1", len(client.updates))
+	}
+	if client.updates[0].State != messaging.SubmittedState {
+		t.Errorf("published state %s instead of %s", client.updates[0].State, messaging.SubmittedState)
 	}
-	parent := path.Join(j.CondorLogPath, "test_this_is_a_test")
-	err = os.RemoveAll(parent)
+	if !strings.Contains(client.updates[0].Message, "12345") {
+		t.Errorf("update message %q does not contain the Condor ID", client.updates[0].Message)
+	}
+}
+
+func TestHandleLaunchRequestsChecksQueueOnRedelivery(t *testing.T) {
+	cl, scheduler, client := newTestLauncher(t)
+	scheduler.queryAds = []JobAd{{ClusterID: 23456}}
+
+	cl.handleLaunchRequests()(launchDelivery(t, cl, true))
+	if len(scheduler.submitted) != 0 {
+		t.Errorf("the job was submitted again: %v", scheduler.submitted)
+	}
+	if len(client.updates) != 1 || !strings.Contains(client.updates[0].Message, "23456") {
+		t.Errorf("did not re-publish the submitted update for the queued job: %#v", client.updates)
+	}
+
+	record, err := cl.ledger.Lookup("07b04ce2-7757-4b21-9e15-0b4c2f44be26")
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	if record == nil || record.ClusterID != "23456" {
+		t.Errorf("the queued job was not recorded in the ledger: %#v", record)
+	}
+}
+
+func TestHandleLaunchRequestsWaitsForQueueCheck(t *testing.T) {
+	cl, scheduler, client := newTestLauncher(t)
+	scheduler.queryErr = errors.New("schedd unavailable")
+
+	cl.handleLaunchRequests()(launchDelivery(t, cl, true))
+	if len(scheduler.queries) != 1 {
+		t.Errorf("the queue was checked %d times instead of once", len(scheduler.queries))
+	}
+	if len(scheduler.submitted) != 0 {
+		t.Errorf("the job was submitted without checking for an earlier submission: %v", scheduler.submitted)
+	}
+	for _, u := range client.updates {
+		if u.State == messaging.FailedState {
+			t.Errorf("published a failure for a launch that will be retried: %#v", u)
+		}
+	}
+}
+
+func TestHandleLaunchRequestsSkipsQueueOnFirstDelivery(t *testing.T) {
+	cl, scheduler, client := newTestLauncher(t)
+	scheduler.queryAds = []JobAd{{ClusterID: 23456}}
+
+	cl.handleLaunchRequests()(launchDelivery(t, cl, false))
+	if len(scheduler.queries) != 0 {
+		t.Errorf("the queue was checked for a first delivery: %v", scheduler.queries)
+	}
+	if len(scheduler.submitted) != 1 {
+		t.Errorf("submitted %d jobs instead of 1", len(scheduler.submitted))
+	}
+	if len(client.updates) != 1 || client.updates[0].State != messaging.SubmittedState {
+		t.Errorf("did not publish a submitted update: %#v", client.updates)
 	}
 }
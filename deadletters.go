@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/cyverse-de/configurate"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+)
+
+// The headers added to dead-lettered messages.
+const (
+	deadLetterReasonHeader   = "x-dead-letter-reason"
+	deadLetterErrorHeader    = "x-dead-letter-error"
+	deadLetteredAtHeader     = "x-dead-lettered-at"
+	originalExchangeHeader   = "x-original-exchange"
+	originalRoutingKeyHeader = "x-original-routing-key"
+	originalQueueHeader      = "x-original-queue"
+)
+
+// The reasons a message can be dead-lettered.
+const (
+	// DeadLetterUnparseable is the reason for messages that couldn't be
+	// parsed, or that were missing required fields.
+	DeadLetterUnparseable = "unparseable"
+
+	// DeadLetterUnrecognized is the reason for messages with a command that
+	// the launcher doesn't know how to handle.
+	DeadLetterUnrecognized = "unrecognized-command"
+)
+
+// defaultDeadLetters is the name of the dead-letter exchange and queue when
+// amqp.dead_letters.exchange and amqp.dead_letters.queue aren't set.
+const defaultDeadLetters = "condor-launcher-dead-letters"
+
+// DeadLetterConfig names the exchange and queue that messages the launcher
+// can't handle are published to, instead of being dropped. It's configured
+// with the amqp.dead_letters settings, for example:
+//
+//	amqp:
+//	  dead_letters:
+//	    exchange: condor-launcher-dead-letters
+//	    queue: condor-launcher-dead-letters
+//
+// The exchange is a fanout exchange, and the queue is bound to it. Each dead
+// letter has headers describing why it was dead-lettered and where it came
+// from, so that it can be reinjected with the dead-letters subcommand.
+type DeadLetterConfig struct {
+	Exchange string
+	Queue    string
+}
+
+// NewDeadLetterConfig returns a *DeadLetterConfig based on the
+// amqp.dead_letters settings.
+func NewDeadLetterConfig(cfg *viper.Viper) *DeadLetterConfig {
+	dl := &DeadLetterConfig{
+		Exchange: cfg.GetString("amqp.dead_letters.exchange"),
+		Queue:    cfg.GetString("amqp.dead_letters.queue"),
+	}
+	if dl.Exchange == "" {
+		dl.Exchange = defaultDeadLetters
+	}
+	if dl.Queue == "" {
+		dl.Queue = defaultDeadLetters
+	}
+	return dl
+}
+
+// declareDeadLetters declares the dead-letter exchange and queue.
+func declareDeadLetters(ch *amqp.Channel, dl *DeadLetterConfig) error {
+	if err := ch.ExchangeDeclare(dl.Exchange, amqp.ExchangeFanout, true, false, false, false, nil); err != nil {
+		return errors.Wrapf(err, "failed to declare the dead-letter exchange %s", dl.Exchange)
+	}
+	if _, err := ch.QueueDeclare(dl.Queue, true, false, false, false, nil); err != nil {
+		return errors.Wrapf(err, "failed to declare the dead-letter queue %s", dl.Queue)
+	}
+	if err := ch.QueueBind(dl.Queue, "", dl.Exchange, false, nil); err != nil {
+		return errors.Wrapf(err, "failed to bind the dead-letter queue %s", dl.Queue)
+	}
+	return nil
+}
+
+// deadLetterReason returns the reason a message that failed with err should
+// be dead-lettered, or an empty string if it shouldn't be.
+func deadLetterReason(err error) string {
+	le := findLaunchError(err)
+	if le == nil {
+		return ""
+	}
+	switch le.Step {
+	case "parse":
+		return DeadLetterUnparseable
+	case "command":
+		return DeadLetterUnrecognized
+	}
+	return ""
+}
+
+// deadLetterHeaders returns the headers for dead-lettering the delivery,
+// which was consumed from the named queue.
+func deadLetterHeaders(d amqp.Delivery, queue, reason string, cause error, now time.Time) amqp.Table {
+	return amqp.Table{
+		deadLetterReasonHeader:   reason,
+		deadLetterErrorHeader:    cause.Error(),
+		deadLetteredAtHeader:     now.UTC(),
+		originalExchangeHeader:   d.Exchange,
+		originalRoutingKeyHeader: d.RoutingKey,
+		originalQueueHeader:      queue,
+	}
+}
+
+// deadLetter publishes the delivery, which was consumed from the named queue,
+// to the dead-letter exchange and acknowledges it. The delivery is rejected
+// instead if it can't be dead-lettered.
+func (cl *CondorLauncher) deadLetter(d amqp.Delivery, queue, reason string, cause error) {
+	log.Warnf("Dead-lettering a message from %s (%s): %s", queue, reason, cause)
+	if err := cl.client.PublishDeadLetter(d.Body, deadLetterHeaders(d, queue, reason, cause, time.Now())); err != nil {
+		log.Errorf("%+v\n", errors.Wrap(err, "failed to dead-letter the message"))
+		rejectDelivery(d, false, "failed to Reject the message that couldn't be dead-lettered")
+		return
+	}
+	deadLettersTotal.WithLabelValues(reason).Inc()
+	ackDelivery(d, "failed to ACK the dead-lettered message")
+}
+
+// DeadLetter is a dead-lettered message, as listed by the dead-letters
+// subcommand.
+type DeadLetter struct {
+	Reason         string    `json:"reason"`
+	Error          string    `json:"error"`
+	DeadLetteredAt time.Time `json:"dead_lettered_at"`
+	Exchange       string    `json:"exchange"`
+	RoutingKey     string    `json:"routing_key"`
+	Queue          string    `json:"queue"`
+	Body           string    `json:"body"`
+}
+
+// parseDeadLetter returns the *DeadLetter for a delivery from the dead-letter
+// queue.
+func parseDeadLetter(d amqp.Delivery) *DeadLetter {
+	header := func(name string) string {
+		value, _ := d.Headers[name].(string)
+		return value
+	}
+	at, _ := d.Headers[deadLetteredAtHeader].(time.Time)
+	return &DeadLetter{
+		Reason:         header(deadLetterReasonHeader),
+		Error:          header(deadLetterErrorHeader),
+		DeadLetteredAt: at,
+		Exchange:       header(originalExchangeHeader),
+		RoutingKey:     header(originalRoutingKeyHeader),
+		Queue:          header(originalQueueHeader),
+		Body:           string(d.Body),
+	}
+}
+
+// deadLetterSource defines an interface for reading from the dead-letter
+// queue and republishing its messages. Messages that aren't acknowledged go
+// back on the queue when the source is closed.
+type deadLetterSource interface {
+	Get() (amqp.Delivery, bool, error)
+	Publish(exchange, key string, msg amqp.Publishing) error
+	Close() error
+}
+
+// amqpDeadLetterSource is a deadLetterSource for a dead-letter queue on an
+// AMQP broker.
+type amqpDeadLetterSource struct {
+	conn     *amqp.Connection
+	ch       *amqp.Channel
+	confirms chan amqp.Confirmation
+	queue    string
+}
+
+// dialDeadLetters connects to the dead-letter queue on the broker at uri.
+func dialDeadLetters(uri string, dl *DeadLetterConfig) (*amqpDeadLetterSource, error) {
+	conn, err := amqp.Dial(uri)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to the broker")
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to open a channel")
+	}
+	if err = declareDeadLetters(ch, dl); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err = ch.Confirm(false); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to put the channel in confirm mode")
+	}
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	return &amqpDeadLetterSource{conn: conn, ch: ch, confirms: confirms, queue: dl.Queue}, nil
+}
+
+func (s *amqpDeadLetterSource) Get() (amqp.Delivery, bool, error) {
+	d, ok, err := s.ch.Get(s.queue, false)
+	return d, ok, errors.Wrapf(err, "failed to get a message from %s", s.queue)
+}
+
+// Publish publishes the message and waits for the broker to confirm it, so
+// that the dead letter is only acknowledged once it's been reinjected.
+func (s *amqpDeadLetterSource) Publish(exchange, key string, msg amqp.Publishing) error {
+	err := s.ch.Publish(exchange, key, false, false, msg)
+	if err == nil {
+		err = waitForConfirm(s.confirms, publishConfirmTimeout)
+	}
+	return errors.Wrapf(err, "failed to publish to %s", exchange)
+}
+
+func (s *amqpDeadLetterSource) Close() error {
+	return s.conn.Close()
+}
+
+// listDeadLetters prints up to limit dead letters with the given reason, or
+// every reason if it's empty. A limit of zero or less lists every dead letter.
+// The messages are left on the queue.
+func listDeadLetters(src deadLetterSource, limit int, reason string, stdout io.Writer) error {
+	n := 0
+	for limit <= 0 || n < limit {
+		d, ok, err := src.Get()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		dl := parseDeadLetter(d)
+		if reason != "" && dl.Reason != reason {
+			continue
+		}
+		n++
+		msgJSON, err := json.MarshalIndent(dl, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal the dead letter")
+		}
+		fmt.Fprintf(stdout, "%s\n", msgJSON)
+	}
+	fmt.Fprintf(stdout, "Listed %d dead letters\n", n)
+	return nil
+}
+
+// reinjectDeadLetters republishes up to limit dead letters with the given
+// reason, or every reason if it's empty, to the exchange and routing key they
+// were originally published with. A limit of zero or less reinjects every
+// dead letter. Dead letters that are reinjected are removed from the queue.
+func reinjectDeadLetters(src deadLetterSource, limit int, reason string, stdout io.Writer) error {
+	n := 0
+	for limit <= 0 || n < limit {
+		d, ok, err := src.Get()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		dl := parseDeadLetter(d)
+		if reason != "" && dl.Reason != reason {
+			continue
+		}
+		if dl.RoutingKey == "" {
+			fmt.Fprintf(stdout, "Skipped a dead letter without an original routing key: %s\n", dl.Body)
+			continue
+		}
+
+		err = src.Publish(dl.Exchange, dl.RoutingKey, amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			Timestamp:    time.Now(),
+			Body:         d.Body,
+		})
+		if err != nil {
+			return err
+		}
+		if err = d.Ack(false); err != nil {
+			return errors.Wrap(err, "failed to remove the reinjected message from the dead-letter queue")
+		}
+		n++
+		fmt.Fprintf(stdout, "Reinjected a %s message to exchange %s with routing key %s\n", dl.Reason, dl.Exchange, dl.RoutingKey)
+	}
+	fmt.Fprintf(stdout, "Reinjected %d dead letters\n", n)
+	return nil
+}
+
+// deadLettersCommand implements the dead-letters subcommand, which lists the
+// messages in the dead-letter queue or reinjects them once the bug that kept
+// them from being handled is fixed.
+//
+//	condor-launcher dead-letters list --config <file> [--limit <n>] [--reason <reason>]
+//	condor-launcher dead-letters reinject --config <file> [--limit <n>] [--reason <reason>]
+func deadLettersCommand(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 0 || (args[0] != "list" && args[0] != "reinject") {
+		return errors.New("usage: dead-letters list|reinject --config <file> [--limit <n>] [--reason <reason>]")
+	}
+	action := args[0]
+
+	flags := flag.NewFlagSet("dead-letters "+action, flag.ContinueOnError)
+	var (
+		cfgPath = flags.String("config", "", "Path to the config file. Required.")
+		limit   = flags.Int("limit", 0, "The maximum number of dead letters to handle. All of them are handled by default.")
+		reason  = flags.String("reason", "", "Only handle dead letters with this reason: unparseable or unrecognized-command.")
+	)
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *cfgPath == "" {
+		flags.PrintDefaults()
+		return errors.New("--config must be set")
+	}
+
+	cfg, err := configurate.InitDefaults(*cfgPath, configurate.JobServicesDefaults)
+	if err != nil {
+		return errors.Wrap(err, "failed to initialize configuration defaults")
+	}
+
+	src, err := dialDeadLetters(cfg.GetString("amqp.uri"), NewDeadLetterConfig(cfg))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if action == "list" {
+		return listDeadLetters(src, *limit, *reason, stdout)
+	}
+	return reinjectDeadLetters(src, *limit, *reason, stdout)
+}
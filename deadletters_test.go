@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/condor-launcher/test"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/streadway/amqp"
+	"gopkg.in/cyverse-de/messaging.v6"
+)
+
+func TestNewDeadLetterConfig(t *testing.T) {
+	cfg := test.InitConfig(t)
+	dl := NewDeadLetterConfig(cfg)
+	if dl.Exchange != defaultDeadLetters || dl.Queue != defaultDeadLetters {
+		t.Errorf("unexpected default dead-letter config %#v", dl)
+	}
+
+	cfg.Set("amqp.dead_letters.exchange", "dlx")
+	cfg.Set("amqp.dead_letters.queue", "dlq")
+	if dl = NewDeadLetterConfig(cfg); dl.Exchange != "dlx" || dl.Queue != "dlq" {
+		t.Errorf("unexpected dead-letter config %#v", dl)
+	}
+}
+
+func TestHandleLaunchRequestsDeadLettersUnrecognizedCommands(t *testing.T) {
+	cl, scheduler, client := newTestLauncher(t)
+	body := []byte(`{"command": 7}`)
+
+	before := testutil.ToFloat64(deadLettersTotal.WithLabelValues(DeadLetterUnrecognized))
+	cl.handleLaunchRequests()(amqp.Delivery{Body: body, Exchange: "de", RoutingKey: messaging.LaunchesKey})
+	if actual := testutil.ToFloat64(deadLettersTotal.WithLabelValues(DeadLetterUnrecognized)); actual != before+1 {
+		t.Errorf("dead letters was %f instead of %f", actual, before+1)
+	}
+	if len(client.deadLetters) != 1 {
+		t.Fatalf("dead-lettered %d messages instead of 1", len(client.deadLetters))
+	}
+	dl := client.deadLetters[0]
+	if !bytes.Equal(dl.body, body) {
+		t.Errorf("dead-lettered %s instead of the original body", dl.body)
+	}
+	expected := map[string]string{
+		deadLetterReasonHeader:   DeadLetterUnrecognized,
+		originalExchangeHeader:   "de",
+		originalRoutingKeyHeader: messaging.LaunchesKey,
+		originalQueueHeader:      launchesQueue,
+	}
+	for name, value := range expected {
+		if dl.headers[name] != value {
+			t.Errorf("header %s was %v instead of %s", name, dl.headers[name], value)
+		}
+	}
+	if msg, _ := dl.headers[deadLetterErrorHeader].(string); !strings.Contains(msg, "unrecognized command") {
+		t.Errorf("unexpected error header %q", msg)
+	}
+	if len(scheduler.submitted) != 0 || len(client.delayed) != 0 || len(client.updates) != 0 {
+		t.Error("an unrecognized command was acted on")
+	}
+}
+
+func TestDeadLetterFailureRejects(t *testing.T) {
+	cl, _, client := newTestLauncher(t)
+	client.deadLetterErr = errors.New("broker unavailable")
+
+	rejects := testutil.ToFloat64(deliveryRejectsTotal.WithLabelValues("false"))
+	cl.handleLaunchRequests()(amqp.Delivery{Body: []byte("{not json")})
+	if actual := testutil.ToFloat64(deliveryRejectsTotal.WithLabelValues("false")); actual != rejects+1 {
+		t.Errorf("rejects without requeue was %f instead of %f", actual, rejects+1)
+	}
+}
+
+func TestStopHandlerDeadLettersUnparseableRequests(t *testing.T) {
+	cl, _, client := newTestLauncher(t)
+	cl.stopHandler()(amqp.Delivery{Body: []byte("{not json"), RoutingKey: messaging.StopRequestKey("1")})
+	if len(client.deadLetters) != 1 {
+		t.Fatalf("dead-lettered %d messages instead of 1", len(client.deadLetters))
+	}
+	headers := client.deadLetters[0].headers
+	if headers[deadLetterReasonHeader] != DeadLetterUnparseable || headers[originalQueueHeader] != stopsQueue {
+		t.Errorf("unexpected dead letter headers %v", headers)
+	}
+}
+
+// tdeadletters is a deadLetterSource that serves deliveries from memory.
+type tdeadletters struct {
+	deliveries []amqp.Delivery
+	next       int
+	acked      []uint64
+	published  []amqp.Publishing
+	keys       []string
+}
+
+func (s *tdeadletters) Get() (amqp.Delivery, bool, error) {
+	if s.next >= len(s.deliveries) {
+		return amqp.Delivery{}, false, nil
+	}
+	d := s.deliveries[s.next]
+	s.next++
+	return d, true, nil
+}
+
+func (s *tdeadletters) Publish(exchange, key string, msg amqp.Publishing) error {
+	s.keys = append(s.keys, exchange+"/"+key)
+	s.published = append(s.published, msg)
+	return nil
+}
+
+func (s *tdeadletters) Close() error { return nil }
+func (s *tdeadletters) Ack(tag uint64, multiple bool) error {
+	s.acked = append(s.acked, tag)
+	return nil
+}
+func (s *tdeadletters) Nack(tag uint64, multiple, requeue bool) error { return nil }
+func (s *tdeadletters) Reject(tag uint64, requeue bool) error         { return nil }
+
+func newTestDeadLetters() *tdeadletters {
+	s := &tdeadletters{}
+	now := time.Now()
+	for i, reason := range []string{DeadLetterUnparseable, DeadLetterUnrecognized, DeadLetterUnparseable} {
+		d := amqp.Delivery{
+			Acknowledger: s,
+			DeliveryTag:  uint64(i + 1),
+			Body:         []byte(reason),
+		}
+		d.Headers = deadLetterHeaders(amqp.Delivery{Exchange: "de", RoutingKey: messaging.LaunchesKey}, launchesQueue, reason, errors.New(reason), now)
+		s.deliveries = append(s.deliveries, d)
+	}
+	return s
+}
+
+func TestListDeadLetters(t *testing.T) {
+	src := newTestDeadLetters()
+	var out bytes.Buffer
+	if err := listDeadLetters(src, 0, DeadLetterUnparseable, &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(src.acked) != 0 {
+		t.Errorf("listing acknowledged %v", src.acked)
+	}
+	if !strings.Contains(out.String(), "Listed 2 dead letters") {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+	dec := json.NewDecoder(&out)
+	dl := &DeadLetter{}
+	if err := dec.Decode(dl); err != nil {
+		t.Fatal(err)
+	}
+	if dl.Reason != DeadLetterUnparseable || dl.RoutingKey != messaging.LaunchesKey || dl.Queue != launchesQueue || dl.Body != DeadLetterUnparseable {
+		t.Errorf("unexpected dead letter %#v", dl)
+	}
+}
+
+func TestReinjectDeadLetters(t *testing.T) {
+	src := newTestDeadLetters()
+	var out bytes.Buffer
+	if err := reinjectDeadLetters(src, 1, "", &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(src.acked) != 1 || src.acked[0] != 1 {
+		t.Errorf("acknowledged %v instead of the first dead letter", src.acked)
+	}
+	if len(src.published) != 1 || src.keys[0] != "de/"+messaging.LaunchesKey || string(src.published[0].Body) != DeadLetterUnparseable {
+		t.Errorf("unexpected reinjected messages %v %v", src.keys, src.published)
+	}
+	if src.published[0].Headers != nil {
+		t.Errorf("the dead letter headers were reinjected: %v", src.published[0].Headers)
+	}
+
+	src = newTestDeadLetters()
+	if err := reinjectDeadLetters(src, 0, DeadLetterUnrecognized, &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(src.acked) != 1 || src.acked[0] != 2 {
+		t.Errorf("acknowledged %v instead of the unrecognized command", src.acked)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+)
+
+// launchesQueue is the name of the queue that launch requests are consumed
+// from.
+const launchesQueue = "condor_launches"
+
+// stopsQueue is the name of the queue that stop requests are consumed from.
+const stopsQueue = "condor-launcher-stops"
+
+// retryCountHeader is the message header containing the number of delayed
+// retries that have already been made for a launch request.
+const retryCountHeader = "x-retry-count"
+
+// deferralCountHeader is the message header containing the number of times a
+// launch request has been deferred by the quota policy.
+const deferralCountHeader = "x-deferral-count"
+
+const (
+	// defaultDelayedRetries is how many delayed retries are made when
+	// amqp.delayed_retries.max_retries isn't set.
+	defaultDelayedRetries = 5
+
+	// defaultInitialDelay is the delay before the first retry when
+	// amqp.delayed_retries.initial_delay isn't set.
+	defaultInitialDelay = 30 * time.Second
+
+	// defaultMaxDelay is the longest delay between retries when
+	// amqp.delayed_retries.max_delay isn't set.
+	defaultMaxDelay = 10 * time.Minute
+
+	// defaultDelayExchange is the exchange that delayed messages are
+	// published to when amqp.delayed_retries.exchange isn't set.
+	defaultDelayExchange = "condor-launcher-delay"
+
+	// delayQueueExpiry is how long a delay queue is kept after it was last
+	// used, on top of its delay.
+	delayQueueExpiry = time.Hour
+)
+
+// exponentialBackoff returns the wait after the given attempt, counting from
+// 1, when the wait starts at initial and doubles after every attempt up to
+// max.
+func exponentialBackoff(initial, max time.Duration, attempt int) time.Duration {
+	d := initial
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// DelayedRetryPolicy controls how launch requests that fail with transient
+// errors are retried later through AMQP. It's the only retry layer: launches
+// aren't retried in-process, so a delivery never sits on a prefetch slot
+// waiting for a retry, and a request is attempted at most max_retries + 1
+// times. It's configured with the amqp.delayed_retries settings, for example:
+//
+//	amqp:
+//	  delayed_retries:
+//	    max_retries: 5
+//	    initial_delay: 30s
+//	    max_delay: 10m
+//	    exchange: condor-launcher-delay
+//
+// The delay doubles after every retry, up to max_delay. Setting max_retries
+// to 0 turns delayed retries off, in which case a failed request is requeued
+// once and fails the second time it's delivered.
+type DelayedRetryPolicy struct {
+	MaxRetries   int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Exchange     string
+}
+
+// DefaultDelayedRetryPolicy returns a *DelayedRetryPolicy that retries a
+// launch five times, 30 seconds to 8 minutes apart.
+func DefaultDelayedRetryPolicy() *DelayedRetryPolicy {
+	return &DelayedRetryPolicy{
+		MaxRetries:   defaultDelayedRetries,
+		InitialDelay: defaultInitialDelay,
+		MaxDelay:     defaultMaxDelay,
+		Exchange:     defaultDelayExchange,
+	}
+}
+
+// NewDelayedRetryPolicy returns a *DelayedRetryPolicy based on the
+// amqp.delayed_retries settings.
+func NewDelayedRetryPolicy(cfg *viper.Viper) (*DelayedRetryPolicy, error) {
+	p := DefaultDelayedRetryPolicy()
+	if cfg.IsSet("amqp.delayed_retries.max_retries") {
+		p.MaxRetries = cfg.GetInt("amqp.delayed_retries.max_retries")
+		if p.MaxRetries < 0 {
+			return nil, fmt.Errorf("invalid amqp.delayed_retries.max_retries %d", p.MaxRetries)
+		}
+	}
+	if d := cfg.GetDuration("amqp.delayed_retries.initial_delay"); d > 0 {
+		p.InitialDelay = d
+	}
+	if d := cfg.GetDuration("amqp.delayed_retries.max_delay"); d > 0 {
+		p.MaxDelay = d
+	}
+	if p.MaxDelay < p.InitialDelay {
+		return nil, fmt.Errorf("amqp.delayed_retries.max_delay %s is less than initial_delay %s", p.MaxDelay, p.InitialDelay)
+	}
+	if exchange := cfg.GetString("amqp.delayed_retries.exchange"); exchange != "" {
+		p.Exchange = exchange
+	}
+	return p, nil
+}
+
+// Delay returns how long to wait before the given retry, counting from 1.
+func (p *DelayedRetryPolicy) Delay(retry int) time.Duration {
+	return exponentialBackoff(p.InitialDelay, p.MaxDelay, retry)
+}
+
+// deliveryRetries returns the number of delayed retries already made for the
+// delivery, based on its retry count header.
+func deliveryRetries(headers amqp.Table) int {
+	return countHeader(headers, retryCountHeader)
+}
+
+// deliveryDeferrals returns the number of times the delivery has been deferred
+// by the quota policy, based on its deferral count header.
+func deliveryDeferrals(headers amqp.Table) int {
+	return countHeader(headers, deferralCountHeader)
+}
+
+// delayHeaders returns the headers for a delayed launch request with the
+// given retry and deferral counts.
+func delayHeaders(retries, deferrals int) amqp.Table {
+	headers := amqp.Table{retryCountHeader: int32(retries)}
+	if deferrals > 0 {
+		headers[deferralCountHeader] = int32(deferrals)
+	}
+	return headers
+}
+
+// countHeader returns the value of a count header, or 0 if it isn't set.
+func countHeader(headers amqp.Table, name string) int {
+	switch v := headers[name].(type) {
+	case int8:
+		return int(v)
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	case uint8:
+		return int(v)
+	case uint16:
+		return int(v)
+	case uint32:
+		return int(v)
+	}
+	return 0
+}
+
+// delayQueueName returns the name of the queue that holds messages for the
+// destination queue until the delay has passed.
+func delayQueueName(exchange, queue string, delay time.Duration) string {
+	return fmt.Sprintf("%s.%s.%d", exchange, queue, delay.Milliseconds())
+}
+
+// delayQueueArgs returns the arguments for a delay queue. Messages expire
+// after the delay and are dead-lettered straight to the destination queue
+// through the default exchange. The delay queue itself is deleted once it
+// hasn't been used for a while.
+func delayQueueArgs(queue string, delay time.Duration) amqp.Table {
+	return amqp.Table{
+		"x-message-ttl":             delay.Milliseconds(),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": queue,
+		"x-expires":                 (delay + delayQueueExpiry).Milliseconds(),
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/condor-launcher/test"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/streadway/amqp"
+	"gopkg.in/cyverse-de/messaging.v6"
+)
+
+func TestNewDelayedRetryPolicy(t *testing.T) {
+	cfg := test.InitConfig(t)
+	p, err := NewDelayedRetryPolicy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.MaxRetries != defaultDelayedRetries || p.InitialDelay != defaultInitialDelay || p.MaxDelay != defaultMaxDelay || p.Exchange != defaultDelayExchange {
+		t.Errorf("unexpected default delayed retry policy %#v", p)
+	}
+	var delays []time.Duration
+	for retry := 1; retry <= p.MaxRetries; retry++ {
+		delays = append(delays, p.Delay(retry))
+	}
+	expected := []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute}
+	for i := range expected {
+		if delays[i] != expected[i] {
+			t.Fatalf("delays were %v instead of %v", delays, expected)
+		}
+	}
+
+	cfg.Set("amqp.delayed_retries.max_retries", 0)
+	cfg.Set("amqp.delayed_retries.initial_delay", "1m")
+	cfg.Set("amqp.delayed_retries.max_delay", "1h")
+	cfg.Set("amqp.delayed_retries.exchange", "retries")
+	if p, err = NewDelayedRetryPolicy(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if p.MaxRetries != 0 || p.InitialDelay != time.Minute || p.MaxDelay != time.Hour || p.Exchange != "retries" {
+		t.Errorf("unexpected delayed retry policy %#v", p)
+	}
+
+	cfg.Set("amqp.delayed_retries.max_retries", -1)
+	if _, err = NewDelayedRetryPolicy(cfg); err == nil {
+		t.Error("NewDelayedRetryPolicy did not return an error for a negative retry limit")
+	}
+}
+
+func TestDeliveryRetries(t *testing.T) {
+	tests := []struct {
+		headers  amqp.Table
+		expected int
+	}{
+		{nil, 0},
+		{amqp.Table{}, 0},
+		{amqp.Table{retryCountHeader: int32(3)}, 3},
+		{amqp.Table{retryCountHeader: int64(4)}, 4},
+		{amqp.Table{retryCountHeader: uint8(2)}, 2},
+		{amqp.Table{retryCountHeader: "3"}, 0},
+	}
+	for _, tt := range tests {
+		if actual := deliveryRetries(tt.headers); actual != tt.expected {
+			t.Errorf("deliveryRetries(%v) returned %d instead of %d", tt.headers, actual, tt.expected)
+		}
+	}
+}
+
+func TestDelayQueueArgs(t *testing.T) {
+	if name := delayQueueName("condor-launcher-delay", launchesQueue, 30*time.Second); name != "condor-launcher-delay.condor_launches.30000" {
+		t.Errorf("unexpected delay queue name %s", name)
+	}
+	args := delayQueueArgs(launchesQueue, 30*time.Second)
+	if args["x-message-ttl"] != int64(30000) || args["x-dead-letter-exchange"] != "" || args["x-dead-letter-routing-key"] != launchesQueue {
+		t.Errorf("unexpected delay queue arguments %v", args)
+	}
+	if expires, ok := args["x-expires"].(int64); !ok || expires <= 30000 {
+		t.Errorf("the delay queue expires before its messages: %v", args["x-expires"])
+	}
+}
+
+// retryDelivery returns a launch request delivery that has already been
+// retried the given number of times.
+func retryDelivery(t *testing.T, cl *CondorLauncher, retries int) amqp.Delivery {
+	delivery := launchDelivery(t, cl, false)
+	delivery.Headers = amqp.Table{retryCountHeader: int32(retries)}
+	return delivery
+}
+
+func TestHandleLaunchRequestsDelaysRetries(t *testing.T) {
+	cl, scheduler, client := newTestLauncher(t)
+	scheduler.submitErr = errors.New("schedd unavailable")
+
+	rejects := testutil.ToFloat64(deliveryRejectsTotal.WithLabelValues("true")) + testutil.ToFloat64(deliveryRejectsTotal.WithLabelValues("false"))
+	cl.handleLaunchRequests()(launchDelivery(t, cl, false))
+	cl.handleLaunchRequests()(retryDelivery(t, cl, 2))
+	if actual := testutil.ToFloat64(deliveryRejectsTotal.WithLabelValues("true")) + testutil.ToFloat64(deliveryRejectsTotal.WithLabelValues("false")); actual != rejects {
+		t.Errorf("rejected %f deliveries that were scheduled for a retry", actual-rejects)
+	}
+	if len(client.delayed) != 2 {
+		t.Fatalf("scheduled %d retries instead of 2", len(client.delayed))
+	}
+	first, third := client.delayed[0], client.delayed[1]
+	if first.queue != launchesQueue || first.retries != 1 || first.delay != defaultInitialDelay {
+		t.Errorf("unexpected first retry %+v", first)
+	}
+	if third.retries != 3 || third.delay != 4*defaultInitialDelay {
+		t.Errorf("unexpected third retry %+v", third)
+	}
+	if len(client.updates) != 0 {
+		t.Errorf("published %v before the last retry", client.updates)
+	}
+}
+
+func TestHandleLaunchRequestsFailsAfterLastRetry(t *testing.T) {
+	cl, scheduler, client := newTestLauncher(t)
+	scheduler.submitErr = errors.New("schedd unavailable")
+
+	rejects := testutil.ToFloat64(deliveryRejectsTotal.WithLabelValues("false"))
+	cl.handleLaunchRequests()(retryDelivery(t, cl, defaultDelayedRetries))
+	if actual := testutil.ToFloat64(deliveryRejectsTotal.WithLabelValues("false")); actual != rejects+1 {
+		t.Errorf("rejects without requeue was %f instead of %f", actual, rejects+1)
+	}
+	if len(client.delayed) != 0 {
+		t.Errorf("scheduled %v after the last retry", client.delayed)
+	}
+	if len(client.updates) != 1 || client.updates[0].State != messaging.FailedState {
+		t.Fatalf("published %v instead of a single failed update", client.updates)
+	}
+	if len(scheduler.queries) == 0 {
+		t.Error("the queue was not checked for an earlier submission of a retried request")
+	}
+}
+
+func TestHandleLaunchRequestsRequeuesWhenDelayFails(t *testing.T) {
+	cl, scheduler, client := newTestLauncher(t)
+	scheduler.submitErr = errors.New("schedd unavailable")
+	client.delayErr = errors.New("broker unavailable")
+
+	rejects := testutil.ToFloat64(deliveryRejectsTotal.WithLabelValues("true"))
+	cl.handleLaunchRequests()(launchDelivery(t, cl, false))
+	if actual := testutil.ToFloat64(deliveryRejectsTotal.WithLabelValues("true")); actual != rejects+1 {
+		t.Errorf("requeued rejects was %f instead of %f", actual, rejects+1)
+	}
+	if len(client.updates) != 0 {
+		t.Errorf("published %v for a request that was requeued", client.updates)
+	}
+}
+
+func TestHandleLaunchRequestsFailsRedeliveryWhenDelayFails(t *testing.T) {
+	cl, scheduler, client := newTestLauncher(t)
+	scheduler.submitErr = errors.New("schedd unavailable")
+	client.delayErr = errors.New("broker unavailable")
+
+	rejects := testutil.ToFloat64(deliveryRejectsTotal.WithLabelValues("false"))
+	cl.handleLaunchRequests()(launchDelivery(t, cl, true))
+	if actual := testutil.ToFloat64(deliveryRejectsTotal.WithLabelValues("false")); actual != rejects+1 {
+		t.Errorf("rejects without requeue was %f instead of %f", actual, rejects+1)
+	}
+	if len(client.updates) != 1 || client.updates[0].State != messaging.FailedState {
+		t.Errorf("published %v instead of a single failed update for a dropped request", client.updates)
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// The HTCondor job event codes handled by the event log tailer.
+const (
+	eventSubmit     = 0
+	eventExecute    = 1
+	eventTerminated = 5
+	eventAborted    = 9
+	eventHeld       = 12
+	eventReleased   = 13
+)
+
+const (
+	// defaultEventLogInterval is how often the event logs are read when
+	// condor.event_log.interval isn't set.
+	defaultEventLogInterval = 5 * time.Second
+
+	// jobEventLogName is the name of the job event log that HTCondor writes
+	// to the submission directory, as set by the log command in the
+	// submission file.
+	jobEventLogName = "condor.log"
+
+	// eventSeparator is the line that ends each event.
+	eventSeparator = "..."
+)
+
+var (
+	// eventHeader matches the first line of an event, for example
+	// `012 (10000.000.000) 2024-01-02 10:00:00 Job was held.` or, in older
+	// logs, `012 (10000.000.000) 01/02 10:00:00 Job was held.`
+	eventHeader = regexp.MustCompile(`^(\d{3}) \((\d+)\.\d+\.\d+\) (\S+ \S+)`)
+
+	// holdCode matches the hold reason codes in the body of a hold event.
+	holdCode = regexp.MustCompile(`Code (\d+) Subcode (\d+)`)
+
+	// normalTermination and abnormalTermination match the body of a
+	// terminated event.
+	normalTermination   = regexp.MustCompile(`Normal termination \(return value (-?\d+)\)`)
+	abnormalTermination = regexp.MustCompile(`Abnormal termination \(signal (\d+)\)`)
+)
+
+// EventLog feeds the held job policy and the job status updates from the
+// HTCondor job event logs instead of running condor_q. It's configured with
+// the condor.event_log settings, for example:
+//
+//	condor:
+//	  event_log:
+//	    enabled: true
+//	    interval: 5s
+//	    path: /var/log/condor/EventLog
+//	    pool: default
+//
+// If path is set, the global event log written by the schedd of the named
+// pool (the default pool if it isn't set) is read. Otherwise the condor.log
+// file in the submission directory of each job that hasn't finished and was
+// launched within the status poller's lookback period is read. When the event
+// log is enabled, the held job sweep and the status poller don't run. The
+// number of bytes read from each log is kept in the launch ledger, so the logs
+// are read from where they were left off when the launcher restarts. The list
+// of held jobs is loaded from the schedds instead.
+type EventLog struct {
+	Enabled  bool
+	Interval time.Duration
+	Path     string
+	Pool     string
+
+	mu     sync.Mutex
+	loaded bool                  // true once the held jobs have been loaded from the schedds
+	held   map[string]heldOnPool // invocation ID -> held job
+	holds  map[string]int        // invocation ID -> number of times held
+}
+
+// heldOnPool is a held job along with the pool it's held on.
+type heldOnPool struct {
+	pool *Pool
+	job  HeldJob
+}
+
+// DefaultEventLog returns a disabled *EventLog.
+func DefaultEventLog() *EventLog {
+	return &EventLog{
+		Interval: defaultEventLogInterval,
+		held:     map[string]heldOnPool{},
+		holds:    map[string]int{},
+	}
+}
+
+// NewEventLog returns an *EventLog based on the condor.event_log settings.
+func NewEventLog(cfg *viper.Viper) *EventLog {
+	el := DefaultEventLog()
+	el.Enabled = cfg.GetBool("condor.event_log.enabled")
+	if interval := cfg.GetDuration("condor.event_log.interval"); interval > 0 {
+		el.Interval = interval
+	}
+	el.Path = cfg.GetString("condor.event_log.path")
+	el.Pool = cfg.GetString("condor.event_log.pool")
+	return el
+}
+
+// jobEvent is a single event from a job event log.
+type jobEvent struct {
+	Code      int
+	ClusterID string
+	Time      time.Time
+	Body      []string // the event's lines, including the header
+}
+
+// parseEventTime parses the timestamp in an event header. Older logs leave out
+// the year, in which case the current year is used.
+func parseEventTime(value string, now time.Time) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02 15:04:05", value, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("01/02 15:04:05", value, time.Local)
+	if err != nil {
+		return time.Time{}, err
+	}
+	t = t.AddDate(now.Year(), 0, 0)
+	if t.After(now.Add(24 * time.Hour)) {
+		// The event was logged last year.
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t, nil
+}
+
+// eventName returns the name of the event code used in metrics.
+func eventName(code int) string {
+	switch code {
+	case eventSubmit:
+		return "submit"
+	case eventExecute:
+		return "execute"
+	case eventTerminated:
+		return "terminated"
+	case eventAborted:
+		return "aborted"
+	case eventHeld:
+		return "held"
+	case eventReleased:
+		return "released"
+	}
+	return "other"
+}
+
+// parseEvents parses the complete events in data. It returns the events along
+// with the number of bytes they took up, so that an event that's still being
+// written can be read again once it's complete. Events that can't be parsed
+// are skipped.
+func parseEvents(data []byte, now time.Time) ([]jobEvent, int) {
+	var (
+		events   []jobEvent
+		consumed int
+		lines    []string
+		pos      int
+	)
+	for {
+		i := bytes.IndexByte(data[pos:], '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimRight(string(data[pos:pos+i]), "\r")
+		pos += i + 1
+		if line != eventSeparator {
+			lines = append(lines, line)
+			continue
+		}
+
+		consumed = pos
+		if len(lines) == 0 {
+			continue
+		}
+		m := eventHeader.FindStringSubmatch(lines[0])
+		if m == nil {
+			log.Warnf("skipping an unrecognized job event: %q", lines[0])
+			lines = nil
+			continue
+		}
+		code, _ := strconv.Atoi(m[1])
+		t, err := parseEventTime(m[3], now)
+		if err != nil {
+			log.Warnf("skipping a job event with an unrecognized time: %q", lines[0])
+			lines = nil
+			continue
+		}
+		events = append(events, jobEvent{Code: code, ClusterID: m[2], Time: t, Body: lines})
+		lines = nil
+	}
+	return events, consumed
+}
+
+// match returns the submatches of the first line of the event's body that
+// matches the regular expression.
+func (e *jobEvent) match(re *regexp.Regexp) []string {
+	for _, line := range e.Body {
+		if m := re.FindStringSubmatch(line); m != nil {
+			return m
+		}
+	}
+	return nil
+}
+
+// status returns the status the job changed to with the event, or a status
+// with an empty Status if the event doesn't change it.
+func (e *jobEvent) status(invocationID string) jobStatus {
+	st := jobStatus{InvocationID: invocationID, ClusterID: e.ClusterID}
+	switch e.Code {
+	case eventSubmit, eventReleased:
+		st.Status = JobStatusIdle
+	case eventExecute:
+		st.Status = JobStatusRunning
+	case eventHeld:
+		st.Status = JobStatusHeld
+	case eventAborted:
+		st.Status = JobStatusRemoved
+	case eventTerminated:
+		st.Status = JobStatusCompleted
+		if m := e.match(normalTermination); m != nil {
+			exitCode, _ := strconv.Atoi(m[1])
+			st.ExitCode = &exitCode
+		} else if m := e.match(abnormalTermination); m != nil {
+			st.ExitBySignal = true
+			st.ExitSignal, _ = strconv.Atoi(m[1])
+		}
+	}
+	return st
+}
+
+// heldJob returns the HeldJob for a hold event.
+func (e *jobEvent) heldJob(invocationID string, numHolds int) HeldJob {
+	job := HeldJob{
+		InvocationID: invocationID,
+		ClusterID:    e.ClusterID,
+		NumHolds:     numHolds,
+		HeldSince:    e.Time,
+	}
+	if len(e.Body) > 1 && !holdCode.MatchString(e.Body[1]) {
+		job.HoldReason = strings.TrimSpace(e.Body[1])
+	}
+	if m := e.match(holdCode); m != nil {
+		job.HoldReasonCode, _ = strconv.Atoi(m[1])
+		job.HoldReasonSubCode, _ = strconv.Atoi(m[2])
+	}
+	return job
+}
+
+// read returns the events added to the event log at logPath after the first
+// offset bytes, along with the offset of the end of the last complete event.
+// Only the part of the log after offset is read. The log is read from the
+// start again if it has been rotated.
+func (el *EventLog) read(fs fsys, logPath string, offset int64, now time.Time) ([]jobEvent, int64, error) {
+	info, err := fs.Stat(logPath)
+	if err != nil {
+		return nil, offset, err
+	}
+	if info.Size() == offset {
+		return nil, offset, nil
+	}
+	if info.Size() < offset {
+		log.Infof("%s was rotated, reading it from the start", logPath)
+		offset = 0
+	}
+
+	f, err := fs.Open(logPath)
+	if err != nil {
+		return nil, offset, err
+	}
+	defer f.Close()
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return nil, offset, errors.Wrapf(err, "failed to seek to %d in %s", offset, logPath)
+	}
+	data, err := io.ReadAll(io.LimitReader(f, info.Size()-offset))
+	if err != nil {
+		return nil, offset, errors.Wrapf(err, "failed to read %s", logPath)
+	}
+	events, consumed := parseEvents(data, now)
+	return events, offset + int64(consumed), nil
+}
+
+// tail passes the events added to the event log at logPath since it was last
+// read to handle, then records how much of the log has been read in the
+// launch ledger.
+func (el *EventLog) tail(cl *CondorLauncher, logPath string, now time.Time, handle func(jobEvent)) error {
+	offset, err := cl.ledger.EventLogOffset(logPath)
+	if err != nil {
+		return err
+	}
+	events, next, err := el.read(cl.fs, logPath, offset, now)
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		handle(e)
+	}
+	if next != offset {
+		return cl.ledger.SetEventLogOffset(logPath, next)
+	}
+	return nil
+}
+
+// loadHeld adds the held jobs in the pools to the list of held jobs, since the
+// events that held them might have been read before the launcher restarted.
+// It returns false if the held jobs in some pools couldn't be listed.
+func (el *EventLog) loadHeld(pools []*Pool) bool {
+	complete := true
+	for _, pool := range pools {
+		jobs, err := pool.Scheduler.QueryHeld()
+		if err != nil {
+			log.Errorf("%+v\n", errors.Wrapf(err, "error querying held jobs in pool %s", pool.Name))
+			complete = false
+			continue
+		}
+		for _, job := range jobs {
+			if job.InvocationID == "" {
+				continue
+			}
+			el.held[job.InvocationID] = heldOnPool{pool: pool, job: job}
+			el.holds[job.InvocationID] = job.NumHolds
+		}
+	}
+	el.loaded = complete
+	return complete
+}
+
+// handleEvent updates the list of held jobs and publishes the status update
+// for an event for the launched job.
+func (el *EventLog) handleEvent(cl *CondorLauncher, pool *Pool, record *LaunchRecord, e jobEvent) {
+	id := record.InvocationID
+	switch e.Code {
+	case eventHeld:
+		el.holds[id]++
+		el.held[id] = heldOnPool{pool: pool, job: e.heldJob(id, el.holds[id])}
+	case eventExecute, eventReleased:
+		delete(el.held, id)
+	case eventTerminated, eventAborted:
+		delete(el.held, id)
+		delete(el.holds, id)
+	}
+	jobEventsTotal.WithLabelValues(eventName(e.Code)).Inc()
+
+	// Events from before the last recorded status change were already
+	// handled before the launcher restarted.
+	st := e.status(id)
+	if st.Status == "" || terminalJobStatus(record.Status) || e.Time.Before(record.StatusChangedAt) {
+		return
+	}
+	cl.updateJobStatus(record, st, e.Time)
+}
+
+// heldJobs returns the jobs that are currently held, by pool.
+func (el *EventLog) heldJobs() map[*Pool][]HeldJob {
+	held := map[*Pool][]HeldJob{}
+	for _, h := range el.held {
+		held[h.pool] = append(held[h.pool], h.job)
+	}
+	return held
+}
+
+// tailEventLogs reads the events added to the event logs since the last time
+// they were read, publishes the status updates for them and applies the held
+// job policy to the jobs that are held.
+func tailEventLogs(cl *CondorLauncher, now time.Time) error {
+	el := cl.eventLog
+	el.mu.Lock()
+	defer el.mu.Unlock()
+
+	records, err := cl.ledger.Since(now.Add(-cl.statusPoller.Lookback))
+	if err != nil {
+		return err
+	}
+
+	complete := true
+	if el.Path != "" {
+		pool := cl.pools.Get(el.Pool)
+		if pool == nil {
+			return fmt.Errorf("unknown pool %s for the event log %s", el.Pool, el.Path)
+		}
+		if !el.loaded {
+			complete = el.loadHeld([]*Pool{pool})
+		}
+		byCluster := map[string]*LaunchRecord{}
+		for _, r := range records {
+			if cl.pools.Get(r.Pool) == pool && r.ClusterID != "" {
+				byCluster[r.ClusterID] = r
+			}
+		}
+
+		err := el.tail(cl, el.Path, now, func(e jobEvent) {
+			if r, ok := byCluster[e.ClusterID]; ok {
+				el.handleEvent(cl, pool, r, e)
+			}
+		})
+		if err != nil {
+			log.Errorf("%+v\n", errors.Wrapf(err, "failed to read the event log %s", el.Path))
+			complete = false
+		}
+	} else {
+		if !el.loaded {
+			complete = el.loadHeld(cl.pools.All())
+		}
+		for _, r := range records {
+			if r.SubmissionDir == "" || terminalJobStatus(r.Status) {
+				continue
+			}
+			pool := cl.pools.Get(r.Pool)
+			if pool == nil {
+				continue
+			}
+
+			logPath := path.Join(r.SubmissionDir, jobEventLogName)
+			err := el.tail(cl, logPath, now, func(e jobEvent) {
+				if e.ClusterID == r.ClusterID {
+					el.handleEvent(cl, pool, r, e)
+				}
+			})
+			if os.IsNotExist(errors.Cause(err)) {
+				continue
+			}
+			if err != nil {
+				log.Errorf("%+v\n", errors.Wrapf(err, "failed to read the event log %s", logPath))
+				complete = false
+				continue
+			}
+			if terminalJobStatus(r.Status) {
+				if err = cl.ledger.SetEventLogOffset(logPath, 0); err != nil {
+					log.Errorf("%+v\n", err)
+				}
+			}
+		}
+	}
+
+	for _, job := range applyHeldPolicy(cl, el.heldJobs(), complete) {
+		delete(el.held, job.InvocationID)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/condor-launcher/test"
+	"gopkg.in/cyverse-de/messaging.v6"
+)
+
+const (
+	submitEvent  = "000 (10000.000.000) 2024-01-02 10:00:00 Job submitted from host: <10.0.0.1:9618>\n...\n"
+	executeEvent = "001 (10000.000.000) 2024-01-02 10:00:05 Job executing on host: <10.0.0.2:9618>\n...\n"
+	heldEvent    = "012 (10000.000.000) 2024-01-02 10:01:00 Job was held.\n" +
+		"\tTransfer input files failure\n" +
+		"\tCode 13 Subcode 2\n...\n"
+	abortedEvent    = "009 (10000.000.000) 2024-01-02 10:02:00 Job was aborted.\n\tvia condor_rm (by user condor)\n...\n"
+	terminatedEvent = "005 (10000.000.000) 2024-01-02 10:05:00 Job terminated.\n" +
+		"\t(1) Normal termination (return value 2)\n" +
+		"\t\tUsr 0 00:00:00, Sys 0 00:00:00  -  Run Remote Usage\n...\n"
+)
+
+func TestNewEventLog(t *testing.T) {
+	cfg := test.InitConfig(t)
+	el := NewEventLog(cfg)
+	if el.Enabled || el.Interval != defaultEventLogInterval || el.Path != "" {
+		t.Errorf("unexpected default event log %#v", el)
+	}
+
+	cfg.Set("condor.event_log.enabled", true)
+	cfg.Set("condor.event_log.interval", "1s")
+	cfg.Set("condor.event_log.path", "/var/log/condor/EventLog")
+	el = NewEventLog(cfg)
+	if !el.Enabled || el.Interval != time.Second || el.Path != "/var/log/condor/EventLog" {
+		t.Errorf("unexpected event log %#v", el)
+	}
+}
+
+func TestParseEvents(t *testing.T) {
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local)
+	complete := heldEvent + "001 (10001.000.000) 01/02 10:00:05 Job executing on host: <10.0.0.2:9618>\n...\n"
+	data := []byte(complete + "005 (10000.000.000) 2024-01-02 10:05:00 Job terminated.\n")
+
+	events, consumed := parseEvents(data, now)
+	if consumed != len(complete) {
+		t.Errorf("consumed %d bytes instead of %d", consumed, len(complete))
+	}
+	if len(events) != 2 {
+		t.Fatalf("parsed %d events instead of 2", len(events))
+	}
+	held := events[0].heldJob("a", 1)
+	if held.ClusterID != "10000" || held.HoldReasonCode != 13 || held.HoldReasonSubCode != 2 || held.HoldReason != "Transfer input files failure" {
+		t.Errorf("unexpected held job %+v", held)
+	}
+	if expected := time.Date(2024, 1, 2, 10, 1, 0, 0, time.Local); !held.HeldSince.Equal(expected) {
+		t.Errorf("held since %s instead of %s", held.HeldSince, expected)
+	}
+	if events[1].Code != eventExecute || events[1].ClusterID != "10001" || events[1].Time.Year() != 2024 {
+		t.Errorf("unexpected event %+v", events[1])
+	}
+
+	st := parseEventsStatus(t, terminatedEvent)
+	if st.Status != JobStatusCompleted || st.ExitCode == nil || *st.ExitCode != 2 {
+		t.Errorf("unexpected status %+v", st)
+	}
+}
+
+// parseEventsStatus returns the status for the single event in data.
+func parseEventsStatus(t *testing.T, data string) jobStatus {
+	events, _ := parseEvents([]byte(data), time.Now())
+	if len(events) != 1 {
+		t.Fatalf("parsed %d events instead of 1", len(events))
+	}
+	return events[0].status("a")
+}
+
+// eventLogJobDir is the submission directory of the job in eventLogFixture.
+const eventLogJobDir = "/condor/logs/ipcdev/job/logs"
+
+// eventLogFixture returns a launch record for cluster 10000.
+func eventLogFixture() launcherFixture {
+	return launcherFixture{
+		dirs: []string{eventLogJobDir},
+		records: []*LaunchRecord{
+			{InvocationID: "job", ClusterID: "10000", SubmittedAt: time.Now(), SubmissionDir: eventLogJobDir},
+		},
+	}
+}
+
+// enableEventLog enables the launcher's event log, reading the global log if
+// it's set, and returns the path to the log that the job's events go to.
+func enableEventLog(t *testing.T, cl *CondorLauncher, globalLog string) string {
+	cl.eventLog.Enabled = true
+	cl.eventLog.Path = globalLog
+	if globalLog == "" {
+		return path.Join(eventLogJobDir, jobEventLogName)
+	}
+	if err := cl.fs.MkdirAll(path.Dir(globalLog), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return globalLog
+}
+
+// appendEvents adds the events to the event log and reads it.
+func appendEvents(t *testing.T, cl *CondorLauncher, logPath string, events ...string) {
+	data, _ := cl.fs.ReadFile(logPath)
+	data = append(data, strings.Join(events, "")...)
+	if err := cl.fs.WriteFile(logPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := tailEventLogs(cl, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTailEventLogsAppliesHeldPolicy(t *testing.T) {
+	cl, scheduler, client := newTestLauncherWith(t, eventLogFixture())
+	logPath := enableEventLog(t, cl, "")
+
+	appendEvents(t, cl, logPath, submitEvent, executeEvent)
+	if len(client.updates) != 1 || client.updates[0].State != messaging.RunningState {
+		t.Fatalf("published %v instead of a single running update", client.updates)
+	}
+
+	appendEvents(t, cl, logPath, heldEvent)
+	if len(scheduler.clusters) != 1 || scheduler.clusters[0] != "10000" {
+		t.Errorf("removed clusters %v instead of the held job", scheduler.clusters)
+	}
+	if len(client.updates) != 2 || client.updates[1].State != messaging.FailedState || !strings.Contains(client.updates[1].Message, "Transfer input files failure") {
+		t.Fatalf("published %v instead of a failed update for the held job", client.updates)
+	}
+	if len(scheduler.queries) != 0 {
+		t.Errorf("ran queries %v", scheduler.queries)
+	}
+
+	appendEvents(t, cl, logPath, abortedEvent)
+	if len(client.updates) != 2 {
+		t.Errorf("published %v after the held job was removed", client.updates[2:])
+	}
+	if len(cl.eventLog.held) != 0 {
+		t.Errorf("still tracking held jobs %v", cl.eventLog.held)
+	}
+}
+
+func TestTailEventLogsGlobalLog(t *testing.T) {
+	cl, _, client := newTestLauncherWith(t, eventLogFixture())
+	logPath := enableEventLog(t, cl, "/var/log/condor/EventLog")
+	other := strings.Replace(executeEvent, "10000", "20000", 1)
+
+	// The terminated event isn't handled until it's complete.
+	appendEvents(t, cl, logPath, other, executeEvent, strings.TrimSuffix(terminatedEvent, "...\n"))
+	if len(client.updates) != 1 || client.updates[0].State != messaging.RunningState {
+		t.Fatalf("published %v instead of a single running update", client.updates)
+	}
+
+	appendEvents(t, cl, logPath, "...\n")
+	if len(client.updates) != 2 || client.updates[1].State != messaging.FailedState || client.updates[1].Message != "Job exited with code 2" {
+		t.Fatalf("published %v instead of a failed update", client.updates)
+	}
+
+	// A restarted launcher carries on from where the last one left off.
+	if offset, err := cl.ledger.EventLogOffset(logPath); err != nil || offset == 0 {
+		t.Fatalf("the offset of the event log was %d: %v", offset, err)
+	}
+	cl.eventLog = DefaultEventLog()
+	cl.eventLog.Path = logPath
+	appendEvents(t, cl, logPath, other)
+	if len(client.updates) != 2 {
+		t.Errorf("republished %v", client.updates[2:])
+	}
+
+	// Reading the log from the start again doesn't repeat the updates.
+	if err := cl.ledger.SetEventLogOffset(logPath, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tailEventLogs(cl, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.updates) != 2 {
+		t.Errorf("republished %v", client.updates[2:])
+	}
+}
+
+func TestTailEventLogsLoadsHeldJobs(t *testing.T) {
+	cl, scheduler, client := newTestLauncherWith(t, eventLogFixture())
+	logPath := enableEventLog(t, cl, "")
+	cl.heldPolicy.DefaultAction = HeldActionNotify
+	scheduler.held = []HeldJob{{InvocationID: "job", ClusterID: "10000", NumHolds: 2, HeldSince: time.Now()}}
+
+	// The events that held the job were read before the launcher restarted.
+	appendEvents(t, cl, logPath)
+	if h, ok := cl.eventLog.held["job"]; !ok || h.job.NumHolds != 2 {
+		t.Fatalf("held jobs were %v after the first read", cl.eventLog.held)
+	}
+	if len(client.updates) != 1 || client.updates[0].State != messaging.SubmittedState || !strings.Contains(client.updates[0].Message, "held") {
+		t.Errorf("published %v instead of a held notification", client.updates)
+	}
+}
+
+func TestTailEventLogsSkipsOldJobs(t *testing.T) {
+	cl, _, client := newTestLauncherWith(t, eventLogFixture())
+	logPath := enableEventLog(t, cl, "")
+	cl.statusPoller.Lookback = time.Hour
+
+	appendEvents(t, cl, logPath, submitEvent, executeEvent)
+	if len(client.updates) != 1 {
+		t.Fatalf("published %v instead of a single running update", client.updates)
+	}
+
+	// Once the job is older than the lookback period its log isn't read.
+	data, _ := cl.fs.ReadFile(logPath)
+	if err := cl.fs.WriteFile(logPath, append(data, abortedEvent...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := tailEventLogs(cl, time.Now().Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.updates) != 1 {
+		t.Errorf("published %v for a job older than the lookback period", client.updates[1:])
+	}
+}
@@ -1,13 +1,29 @@
 package main
 
 import (
+	"io"
 	"os"
+	"path"
+
+	"github.com/pkg/errors"
 )
 
-// fsys defines an interface for file operations.
+// fsys defines an interface for file operations. The submission directory of a
+// job is only written through it, although the job submission builder's output
+// is staged in a scratch directory on the local filesystem first. The HTCondor
+// schedulers read submission files from the local filesystem, so the service
+// itself always uses osys.
 type fsys interface {
 	MkdirAll(string, os.FileMode) error
 	WriteFile(string, []byte, os.FileMode) error
+	Create(string, os.FileMode) (io.WriteCloser, error)
+	ReadFile(string) ([]byte, error)
+	Open(string) (io.ReadSeekCloser, error)
+	ReadDir(string) ([]os.DirEntry, error)
+	Stat(string) (os.FileInfo, error)
+	Remove(string) error
+	RemoveAll(string) error
+	Rename(string, string) error
 }
 
 // osys is an implementation of fsys that hits the os and ioutil packages.
@@ -20,3 +36,61 @@ func (o *osys) MkdirAll(path string, mode os.FileMode) error {
 func (o *osys) WriteFile(path string, contents []byte, mode os.FileMode) error {
 	return os.WriteFile(path, contents, mode)
 }
+
+func (o *osys) Create(path string, mode os.FileMode) (io.WriteCloser, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+}
+
+func (o *osys) ReadFile(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+func (o *osys) Open(path string) (io.ReadSeekCloser, error) {
+	return os.Open(path)
+}
+
+func (o *osys) ReadDir(path string) ([]os.DirEntry, error) {
+	return os.ReadDir(path)
+}
+
+func (o *osys) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(path)
+}
+
+func (o *osys) Remove(path string) error {
+	return os.Remove(path)
+}
+
+func (o *osys) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (o *osys) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+// importDir copies the regular files in the directory src on the local
+// filesystem into the directory dst in fsys, which must already exist.
+func importDir(fs fsys, src, dst string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return errors.Wrapf(err, "failed to list %s", src)
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return errors.Wrapf(err, "failed to stat %s", path.Join(src, entry.Name()))
+		}
+		contents, err := os.ReadFile(path.Join(src, entry.Name()))
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %s", path.Join(src, entry.Name()))
+		}
+		if err = fs.WriteFile(path.Join(dst, entry.Name()), contents, info.Mode().Perm()); err != nil {
+			return errors.Wrapf(err, "failed to write %s", path.Join(dst, entry.Name()))
+		}
+	}
+	return nil
+}
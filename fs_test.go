@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// memfs is an in-memory implementation of fsys. It follows the semantics of
+// the os package closely enough for testing: parent directories must exist,
+// existing files keep their mode when they're overwritten, and missing files
+// produce errors that satisfy os.IsNotExist.
+type memfs struct {
+	mu      sync.Mutex
+	entries map[string]*memEntry
+}
+
+// memEntry is a single file or directory in a memfs.
+type memEntry struct {
+	contents []byte
+	mode     os.FileMode
+	modTime  time.Time
+}
+
+// newMemFS returns a new, empty *memfs containing only the root directory.
+func newMemFS() *memfs {
+	return &memfs{
+		entries: map[string]*memEntry{
+			"/": {mode: os.ModeDir | 0755, modTime: time.Now()},
+		},
+	}
+}
+
+// clean returns the absolute, cleaned form of the path. Relative paths are
+// treated as relative to the root directory.
+func (m *memfs) clean(name string) string {
+	return path.Clean("/" + name)
+}
+
+// isDir returns true if the cleaned path is a directory.
+func (m *memfs) isDir(name string) bool {
+	e, ok := m.entries[name]
+	return ok && e.mode.IsDir()
+}
+
+// children returns the cleaned paths of the direct children of the cleaned
+// directory path, sorted by name.
+func (m *memfs) children(dir string) []string {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	var retval []string
+	for name := range m.entries {
+		if name != dir && strings.HasPrefix(name, prefix) && !strings.Contains(name[len(prefix):], "/") {
+			retval = append(retval, name)
+		}
+	}
+	sort.Strings(retval)
+	return retval
+}
+
+func (m *memfs) MkdirAll(name string, mode os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = m.clean(name)
+	var dirs []string
+	for dir := name; dir != "/"; dir = path.Dir(dir) {
+		dirs = append(dirs, dir)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		e, ok := m.entries[dirs[i]]
+		if !ok {
+			m.entries[dirs[i]] = &memEntry{mode: os.ModeDir | mode.Perm(), modTime: time.Now()}
+			continue
+		}
+		if !e.mode.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: dirs[i], Err: fs.ErrExist}
+		}
+	}
+	return nil
+}
+
+func (m *memfs) WriteFile(name string, contents []byte, mode os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = m.clean(name)
+	if !m.isDir(path.Dir(name)) {
+		return &os.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if e, ok := m.entries[name]; ok {
+		if e.mode.IsDir() {
+			return &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+		}
+		mode = e.mode
+	}
+	m.entries[name] = &memEntry{
+		contents: append([]byte(nil), contents...),
+		mode:     mode.Perm(),
+		modTime:  time.Now(),
+	}
+	return nil
+}
+
+// memWriter is a file in a memfs that's open for writing. Writes are appended
+// to the file's contents as they're made.
+type memWriter struct {
+	m    *memfs
+	name string
+}
+
+func (w *memWriter) Write(p []byte) (int, error) {
+	w.m.mu.Lock()
+	defer w.m.mu.Unlock()
+	e, ok := w.m.entries[w.name]
+	if !ok {
+		return 0, &os.PathError{Op: "write", Path: w.name, Err: fs.ErrNotExist}
+	}
+	e.contents = append(e.contents, p...)
+	e.modTime = time.Now()
+	return len(p), nil
+}
+
+func (w *memWriter) Close() error {
+	return nil
+}
+
+func (m *memfs) Create(name string, mode os.FileMode) (io.WriteCloser, error) {
+	if err := m.WriteFile(name, nil, mode); err != nil {
+		return nil, err
+	}
+	return &memWriter{m: m, name: m.clean(name)}, nil
+}
+
+func (m *memfs) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = m.clean(name)
+	e, ok := m.entries[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if e.mode.IsDir() {
+		return nil, &os.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	}
+	return append([]byte(nil), e.contents...), nil
+}
+
+// memFile is an open file in a memfs. It reads from a copy of the file's
+// contents made when it was opened.
+type memFile struct {
+	*bytes.Reader
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+func (m *memfs) Open(name string) (io.ReadSeekCloser, error) {
+	contents, err := m.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return &memFile{bytes.NewReader(contents)}, nil
+}
+
+func (m *memfs) ReadDir(name string) ([]os.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = m.clean(name)
+	if _, ok := m.entries[name]; !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if !m.isDir(name) {
+		return nil, &os.PathError{Op: "readdirent", Path: name, Err: errors.New("not a directory")}
+	}
+	var retval []os.DirEntry
+	for _, child := range m.children(name) {
+		retval = append(retval, fs.FileInfoToDirEntry(m.info(child)))
+	}
+	return retval, nil
+}
+
+// info returns the os.FileInfo for the cleaned path, which must exist.
+func (m *memfs) info(name string) os.FileInfo {
+	e := m.entries[name]
+	return &memFileInfo{
+		name:    path.Base(name),
+		size:    int64(len(e.contents)),
+		mode:    e.mode,
+		modTime: e.modTime,
+	}
+}
+
+func (m *memfs) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = m.clean(name)
+	if _, ok := m.entries[name]; !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return m.info(name), nil
+}
+
+func (m *memfs) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = m.clean(name)
+	if _, ok := m.entries[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if name == "/" || len(m.children(name)) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+	}
+	delete(m.entries, name)
+	return nil
+}
+
+func (m *memfs) RemoveAll(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = m.clean(name)
+	if name == "/" {
+		return &os.PathError{Op: "removeall", Path: name, Err: fs.ErrInvalid}
+	}
+	for entry := range m.entries {
+		if entry == name || strings.HasPrefix(entry, name+"/") {
+			delete(m.entries, entry)
+		}
+	}
+	return nil
+}
+
+func (m *memfs) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldpath, newpath = m.clean(oldpath), m.clean(newpath)
+	src, ok := m.entries[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	if !m.isDir(path.Dir(newpath)) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	if dst, ok := m.entries[newpath]; ok && oldpath != newpath {
+		if dst.mode.IsDir() != src.mode.IsDir() || (dst.mode.IsDir() && len(m.children(newpath)) > 0) {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrExist}
+		}
+	}
+	if src.mode.IsDir() && strings.HasPrefix(newpath, oldpath+"/") {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrInvalid}
+	}
+
+	// Move the entry along with everything under it.
+	moved := make(map[string]*memEntry)
+	for name, e := range m.entries {
+		if name == oldpath || strings.HasPrefix(name, oldpath+"/") {
+			moved[newpath+name[len(oldpath):]] = e
+			delete(m.entries, name)
+		}
+	}
+	for name, e := range moved {
+		m.entries[name] = e
+	}
+	return nil
+}
+
+// memFileInfo is the os.FileInfo for an entry in a memfs.
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i *memFileInfo) Name() string       { return i.name }
+func (i *memFileInfo) Size() int64        { return i.size }
+func (i *memFileInfo) Mode() os.FileMode  { return i.mode }
+func (i *memFileInfo) ModTime() time.Time { return i.modTime }
+func (i *memFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *memFileInfo) Sys() interface{}   { return nil }
+
+func TestMemFSReadWrite(t *testing.T) {
+	m := newMemFS()
+	if err := m.WriteFile("/a/b/file", []byte("x"), 0644); !os.IsNotExist(err) {
+		t.Errorf("WriteFile without a parent directory returned %v", err)
+	}
+	if err := m.MkdirAll("/a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteFile("/a/b/file", []byte("first"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteFile("/a/b/file", []byte("second"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := m.ReadFile("/a/b/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "second" {
+		t.Errorf("ReadFile returned %q instead of second", contents)
+	}
+	info, err := m.Stat("/a/b/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 || info.Size() != 6 || info.IsDir() {
+		t.Errorf("Stat returned mode %o, size %d, dir %t", info.Mode().Perm(), info.Size(), info.IsDir())
+	}
+	if _, err = m.ReadFile("/a/b/missing"); !os.IsNotExist(err) {
+		t.Errorf("ReadFile of a missing file returned %v", err)
+	}
+	if err = m.MkdirAll("/a/b/file/c", 0755); err == nil {
+		t.Error("MkdirAll under a file did not return an error")
+	}
+}
+
+func TestMemFSReadDir(t *testing.T) {
+	m := newMemFS()
+	if err := m.MkdirAll("/dir/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"b", "a"} {
+		if err := m.WriteFile(path.Join("/dir", name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.WriteFile("/dir/sub/nested", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := m.ReadDir("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if len(names) != 3 || names[0] != "a" || names[1] != "b" || names[2] != "sub" {
+		t.Errorf("ReadDir returned %v", names)
+	}
+	if !entries[2].IsDir() {
+		t.Error("ReadDir did not report sub as a directory")
+	}
+	if _, err = m.ReadDir("/missing"); !os.IsNotExist(err) {
+		t.Errorf("ReadDir of a missing directory returned %v", err)
+	}
+}
+
+func TestMemFSRemoveRename(t *testing.T) {
+	m := newMemFS()
+	if err := m.MkdirAll("/staging/job", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteFile("/staging/job/iplant.cmd", []byte("universe = vanilla\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Remove("/staging/job"); err == nil {
+		t.Error("Remove of a non-empty directory did not return an error")
+	}
+
+	if err := m.Rename("/staging/job", "/missing/job"); !os.IsNotExist(err) {
+		t.Errorf("Rename into a missing directory returned %v", err)
+	}
+	if err := m.Rename("/staging/job", "/job"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Stat("/staging/job"); !os.IsNotExist(err) {
+		t.Errorf("the old directory still exists: %v", err)
+	}
+	if _, err := m.ReadFile("/job/iplant.cmd"); err != nil {
+		t.Errorf("the file was not moved: %s", err)
+	}
+
+	if err := m.Remove("/job/iplant.cmd"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Remove("/job"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Remove("/job"); !os.IsNotExist(err) {
+		t.Errorf("Remove of a missing directory returned %v", err)
+	}
+
+	if err := m.MkdirAll("/tree/a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RemoveAll("/tree"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Stat("/tree/a"); !os.IsNotExist(err) {
+		t.Errorf("RemoveAll left /tree/a behind: %v", err)
+	}
+	if err := m.RemoveAll("/tree"); err != nil {
+		t.Errorf("RemoveAll of a missing directory returned %s", err)
+	}
+}
@@ -6,33 +6,41 @@ require (
 	github.com/cyverse-de/configurate v0.0.0-20180510193728-31a2137ff467
 	github.com/cyverse-de/version v0.0.0-20160721234331-5119d6500655
 	github.com/pkg/errors v0.8.0
+	github.com/prometheus/client_golang v1.18.0
 	github.com/sirupsen/logrus v0.11.6-0.20170315151320-547e984ad93a
 	github.com/spf13/viper v0.0.0-20160830143246-16990631d4aa
 	github.com/streadway/amqp v0.0.0-20180528204448-e5adc2ada8b8
+	go.etcd.io/bbolt v1.3.10
 	gopkg.in/cyverse-de/job-templates.v6 v6.0.0-20191010224106-1855b61f1b48
 	gopkg.in/cyverse-de/messaging.v6 v6.0.0
 	gopkg.in/cyverse-de/model.v4 v4.0.0-20191009005545-deb84d06e56c
 )
 
 require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/cyverse-de/model v0.0.0-20170711180048-bf8453314372 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/fsnotify/fsnotify v1.3.2-0.20160816051541-f12c6236fe7b // indirect
 	github.com/hashicorp/hcl v0.0.0-20160822214145-baeb59c71071 // indirect
 	github.com/kr/fs v0.0.0-20131111012553-2788f0dbd169 // indirect
+	github.com/kr/text v0.1.0 // indirect
 	github.com/magiconair/properties v1.7.1-0.20160816085511-61b492c03cf4 // indirect
+	github.com/matttproud/golang_protobuf_extensions/v2 v2.0.0 // indirect
 	github.com/mitchellh/mapstructure v0.0.0-20160808181253-ca63d7c062ee // indirect
 	github.com/pelletier/go-buffruneio v0.1.0 // indirect
 	github.com/pelletier/go-toml v0.3.6-0.20160823074707-5a62685873ef // indirect
 	github.com/pkg/sftp v0.0.0-20160721231453-a71e8f580e3b // indirect
+	github.com/prometheus/client_model v0.5.0 // indirect
+	github.com/prometheus/common v0.45.0 // indirect
+	github.com/prometheus/procfs v0.12.0 // indirect
 	github.com/spf13/afero v0.0.0-20160821083612-20500e2abd0d // indirect
 	github.com/spf13/cast v0.0.0-20160730092037-e31f36ffc91a // indirect
 	github.com/spf13/jwalterweatherman v0.0.0-20160311093646-33c24e77fb80 // indirect
 	github.com/spf13/pflag v0.0.0-20160820154156-103ce5cd2042 // indirect
-	github.com/stretchr/testify v1.7.0 // indirect
 	golang.org/x/crypto v0.17.0 // indirect
 	golang.org/x/sys v0.15.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
-	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
-	gopkg.in/yaml.v2 v2.0.0-20160715033755-e4d366fc3c79 // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
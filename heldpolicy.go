@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"gopkg.in/cyverse-de/messaging.v6"
+	"gopkg.in/cyverse-de/model.v4"
+)
+
+// The actions that can be taken for a held job.
+const (
+	// HeldActionRemove removes the job from the queue and marks it as failed.
+	HeldActionRemove = "remove"
+
+	// HeldActionRelease releases the job so that HTCondor tries to run it
+	// again, up to the rule's release limit.
+	HeldActionRelease = "release"
+
+	// HeldActionNotify leaves the job in the queue and tells the user why it's
+	// being held.
+	HeldActionNotify = "notify"
+
+	// heldActionWait leaves the job alone until its grace period has passed.
+	heldActionWait = "wait"
+)
+
+// defaultHeldInterval is how often held jobs are swept when
+// condor.held_jobs.interval isn't set.
+const defaultHeldInterval = 30 * time.Second
+
+// HeldRule is the action to take for jobs held with a particular
+// HoldReasonCode.
+type HeldRule struct {
+	Code        int    `mapstructure:"code"`
+	Action      string `mapstructure:"action"`
+	MaxReleases int    `mapstructure:"max_releases"` // defaults to 1 for the release action
+}
+
+// HeldPolicy decides what to do with jobs in the held state. It's configured
+// with the condor.held_jobs settings, for example:
+//
+//	condor:
+//	  held_jobs:
+//	    interval: 30s
+//	    grace_period: 5m
+//	    default_action: remove
+//	    reasons:
+//	      - code: 13       # transferring input files failed
+//	        action: release
+//	        max_releases: 3
+//	      - code: 34       # memory or disk usage exceeded the request
+//	        action: notify
+type HeldPolicy struct {
+	Interval      time.Duration // how often held jobs are swept
+	GracePeriod   time.Duration // how long a job must be held before anything is done
+	DefaultAction string        // the action for hold codes without a rule
+	Rules         map[int]HeldRule
+
+	mu       sync.Mutex
+	notified map[string]time.Time // invocation ID -> hold time the user was told about
+}
+
+// DefaultHeldPolicy returns a *HeldPolicy that removes every held job every
+// 30 seconds.
+func DefaultHeldPolicy() *HeldPolicy {
+	return &HeldPolicy{
+		Interval:      defaultHeldInterval,
+		DefaultAction: HeldActionRemove,
+		Rules:         map[int]HeldRule{},
+		notified:      map[string]time.Time{},
+	}
+}
+
+func validHeldAction(action string) bool {
+	switch action {
+	case HeldActionRemove, HeldActionRelease, HeldActionNotify:
+		return true
+	}
+	return false
+}
+
+// NewHeldPolicy returns a *HeldPolicy based on the condor.held_jobs settings.
+func NewHeldPolicy(cfg *viper.Viper) (*HeldPolicy, error) {
+	p := DefaultHeldPolicy()
+
+	if interval := cfg.GetDuration("condor.held_jobs.interval"); interval > 0 {
+		p.Interval = interval
+	}
+	p.GracePeriod = cfg.GetDuration("condor.held_jobs.grace_period")
+
+	if action := cfg.GetString("condor.held_jobs.default_action"); action != "" {
+		if !validHeldAction(action) || action == HeldActionRelease {
+			return nil, fmt.Errorf("invalid held job default action %s", action)
+		}
+		p.DefaultAction = action
+	}
+
+	var rules []HeldRule
+	if err := cfg.UnmarshalKey("condor.held_jobs.reasons", &rules); err != nil {
+		return nil, errors.Wrap(err, "failed to parse condor.held_jobs.reasons")
+	}
+	for _, rule := range rules {
+		if !validHeldAction(rule.Action) {
+			return nil, fmt.Errorf("invalid held job action %s for hold reason code %d", rule.Action, rule.Code)
+		}
+		if rule.Action == HeldActionRelease && rule.MaxReleases <= 0 {
+			rule.MaxReleases = 1
+		}
+		p.Rules[rule.Code] = rule
+	}
+
+	return p, nil
+}
+
+// Action returns the action to take for the held job at the given time.
+// Jobs within the grace period are left alone, and jobs that have already
+// been released as many times as their rule allows are removed.
+func (p *HeldPolicy) Action(job HeldJob, now time.Time) string {
+	if !job.HeldSince.IsZero() && now.Sub(job.HeldSince) < p.GracePeriod {
+		return heldActionWait
+	}
+
+	rule, ok := p.Rules[job.HoldReasonCode]
+	if !ok {
+		return p.DefaultAction
+	}
+	if rule.Action == HeldActionRelease && job.NumHolds > rule.MaxReleases {
+		return HeldActionRemove
+	}
+	return rule.Action
+}
+
+// shouldNotify returns true if the user hasn't been told about the job's
+// current hold yet.
+func (p *HeldPolicy) shouldNotify(job HeldJob) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if since, ok := p.notified[job.InvocationID]; ok && since.Equal(job.HeldSince) {
+		return false
+	}
+	p.notified[job.InvocationID] = job.HeldSince
+	return true
+}
+
+// forget drops the notification history of jobs that are no longer held.
+func (p *HeldPolicy) forget(held []HeldJob) {
+	current := make(map[string]bool, len(held))
+	for _, job := range held {
+		current[job.InvocationID] = true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for invocationID := range p.notified {
+		if !current[invocationID] {
+			delete(p.notified, invocationID)
+		}
+	}
+}
+
+// heldMessage returns the status message for a held job, built from the hold
+// reason reported by HTCondor.
+func heldMessage(prefix string, job HeldJob) string {
+	explanation := job.Explanation()
+	if explanation == "" {
+		return prefix
+	}
+	return fmt.Sprintf("%s: %s", prefix, explanation)
+}
+
+// sweepHeldJobs applies the launcher's held job policy to every job in the
+// held state in every pool.
+func sweepHeldJobs(launcher *CondorLauncher) {
+	var (
+		held     = map[*Pool][]HeldJob{}
+		complete = true
+	)
+	log.Infoln("Looking for jobs in the held state...")
+	for _, pool := range launcher.pools.All() {
+		heldEntries, err := pool.Scheduler.QueryHeld()
+		if err != nil {
+			log.Errorf("%+v\n", errors.Wrapf(err, "error querying held jobs in pool %s", pool.Name))
+			complete = false
+			continue
+		}
+		log.Infof("There are %d jobs in the held state in pool %s", len(heldEntries), pool.Name)
+		held[pool] = heldEntries
+	}
+	applyHeldPolicy(launcher, held, complete)
+}
+
+// applyHeldPolicy applies the launcher's held job policy to the held jobs in
+// each pool. complete is false if the held jobs in some pools couldn't be
+// listed. It returns the jobs that were removed or released.
+func applyHeldPolicy(launcher *CondorLauncher, held map[*Pool][]HeldJob, complete bool) []HeldJob {
+	var (
+		allHeld []HeldJob
+		handled []HeldJob
+		killed  = 0
+		now     = time.Now()
+		policy  = launcher.heldPolicy
+	)
+	for _, pool := range launcher.pools.All() {
+		heldEntries := held[pool]
+		allHeld = append(allHeld, heldEntries...)
+
+		for _, job := range heldEntries {
+			if job.InvocationID == "" {
+				continue
+			}
+
+			action := policy.Action(job, now)
+			log.Infof("Held job %s (cluster %s in pool %s, hold code %d.%d, %d holds): %s", job.InvocationID, job.ClusterID, pool.Name, job.HoldReasonCode, job.HoldReasonSubCode, job.NumHolds, action)
+
+			switch action {
+			case HeldActionRemove:
+				if err := launcher.killJob(job.InvocationID, heldMessage("Job was held by HTCondor and removed", job)); err != nil {
+					log.Errorf("%+v\n", errors.Wrap(err, "error removing held job"))
+					continue
+				}
+				killed++
+				handled = append(handled, job)
+			case HeldActionRelease:
+				if err := launcher.releaseJob(pool, job); err != nil {
+					log.Errorf("%+v\n", errors.Wrap(err, "error releasing held job"))
+					continue
+				}
+				handled = append(handled, job)
+			case HeldActionNotify:
+				if !policy.shouldNotify(job) {
+					continue
+				}
+				launcher.publishHeldUpdate(job, heldMessage("Job is held by HTCondor", job))
+			default:
+				continue
+			}
+			heldJobActionsTotal.WithLabelValues(action).Inc()
+		}
+	}
+
+	// Only forget the notifications for jobs that are known to no longer be
+	// held, otherwise users would be notified again after a failed query.
+	if complete {
+		policy.forget(allHeld)
+	}
+	heldJobsKilledTotal.Add(float64(killed))
+	heldJobsKilledLastSweep.Set(float64(killed))
+	return handled
+}
+
+// releaseJob releases a held job in the pool and tells the user that it's
+// being retried.
+func (cl *CondorLauncher) releaseJob(pool *Pool, job HeldJob) error {
+	log.Infof("Running condor_release for %s (cluster %s in pool %s)", job.InvocationID, job.ClusterID, pool.Name)
+	output, err := pool.Scheduler.Release(job.ClusterID)
+	if err != nil {
+		return errors.Wrapf(err, "failed to run 'condor_release %s' in pool %s", job.ClusterID, pool.Name)
+	}
+	log.Infof("condor_release output for job %s:\n%s", job.InvocationID, output)
+
+	cl.publishHeldUpdate(job, heldMessage(fmt.Sprintf("Job was released after hold %d", job.NumHolds), job))
+	return nil
+}
+
+// publishHeldUpdate sends a non-terminal status update for a held job.
+func (cl *CondorLauncher) publishHeldUpdate(job HeldJob, message string) {
+	fauxJob := model.New(cl.cfg)
+	fauxJob.InvocationID = job.InvocationID
+	update := &messaging.UpdateMessage{
+		Job:     fauxJob,
+		State:   messaging.SubmittedState,
+		Message: message,
+	}
+	if err := cl.client.PublishJobUpdate(update); err != nil {
+		log.Errorf("%+v\n", errors.Wrap(err, "failed to publish job update for a held job"))
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/condor-launcher/test"
+	"gopkg.in/cyverse-de/messaging.v6"
+)
+
+func TestNewHeldPolicy(t *testing.T) {
+	cfg := test.InitConfig(t)
+	cfg.Set("condor.held_jobs.interval", "1m")
+	cfg.Set("condor.held_jobs.grace_period", "5m")
+	cfg.Set("condor.held_jobs.default_action", "notify")
+	cfg.Set("condor.held_jobs.reasons", []map[string]interface{}{
+		{"code": 13, "action": "release", "max_releases": 3},
+		{"code": 26, "action": "release"},
+		{"code": 34, "action": "remove"},
+	})
+
+	p, err := NewHeldPolicy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Interval != time.Minute {
+		t.Errorf("interval was %s instead of 1m", p.Interval)
+	}
+	if p.GracePeriod != 5*time.Minute {
+		t.Errorf("grace period was %s instead of 5m", p.GracePeriod)
+	}
+	if p.DefaultAction != HeldActionNotify {
+		t.Errorf("default action was %s instead of %s", p.DefaultAction, HeldActionNotify)
+	}
+	if p.Rules[13].MaxReleases != 3 {
+		t.Errorf("max releases for code 13 was %d instead of 3", p.Rules[13].MaxReleases)
+	}
+	if p.Rules[26].MaxReleases != 1 {
+		t.Errorf("max releases for code 26 was %d instead of 1", p.Rules[26].MaxReleases)
+	}
+	if p.Rules[34].Action != HeldActionRemove {
+		t.Errorf("action for code 34 was %s instead of %s", p.Rules[34].Action, HeldActionRemove)
+	}
+}
+
+func TestNewHeldPolicyDefaults(t *testing.T) {
+	p, err := NewHeldPolicy(test.InitConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Interval != defaultHeldInterval {
+		t.Errorf("interval was %s instead of %s", p.Interval, defaultHeldInterval)
+	}
+	if p.DefaultAction != HeldActionRemove {
+		t.Errorf("default action was %s instead of %s", p.DefaultAction, HeldActionRemove)
+	}
+}
+
+func TestNewHeldPolicyInvalidAction(t *testing.T) {
+	cfg := test.InitConfig(t)
+	cfg.Set("condor.held_jobs.reasons", []map[string]interface{}{
+		{"code": 13, "action": "explode"},
+	})
+	if _, err := NewHeldPolicy(cfg); err == nil {
+		t.Error("NewHeldPolicy did not return an error for an invalid action")
+	}
+
+	cfg = test.InitConfig(t)
+	cfg.Set("condor.held_jobs.default_action", "release")
+	if _, err := NewHeldPolicy(cfg); err == nil {
+		t.Error("NewHeldPolicy did not return an error for a release default action")
+	}
+}
+
+func TestHeldPolicyAction(t *testing.T) {
+	now := time.Now()
+	p := DefaultHeldPolicy()
+	p.GracePeriod = 5 * time.Minute
+	p.Rules[13] = HeldRule{Code: 13, Action: HeldActionRelease, MaxReleases: 2}
+	p.Rules[34] = HeldRule{Code: 34, Action: HeldActionNotify}
+
+	tests := []struct {
+		name     string
+		job      HeldJob
+		expected string
+	}{
+		{"grace period", HeldJob{HoldReasonCode: 13, NumHolds: 1, HeldSince: now.Add(-time.Minute)}, heldActionWait},
+		{"release", HeldJob{HoldReasonCode: 13, NumHolds: 2, HeldSince: now.Add(-time.Hour)}, HeldActionRelease},
+		{"release limit", HeldJob{HoldReasonCode: 13, NumHolds: 3, HeldSince: now.Add(-time.Hour)}, HeldActionRemove},
+		{"notify", HeldJob{HoldReasonCode: 34, HeldSince: now.Add(-time.Hour)}, HeldActionNotify},
+		{"default", HeldJob{HoldReasonCode: 1, HeldSince: now.Add(-time.Hour)}, HeldActionRemove},
+		{"unknown hold time", HeldJob{HoldReasonCode: 1}, HeldActionRemove},
+	}
+	for _, tt := range tests {
+		if actual := p.Action(tt.job, now); actual != tt.expected {
+			t.Errorf("%s: action was %s instead of %s", tt.name, actual, tt.expected)
+		}
+	}
+}
+
+func TestHeldJobExplanation(t *testing.T) {
+	tests := []struct {
+		job      HeldJob
+		expected string
+	}{
+		{
+			HeldJob{HoldReasonCode: 35, HoldReasonSubCode: 2, HoldReason: "Cannot pull image discoenv/missing"},
+			"The job's Docker image could not be used. HTCondor reported: Cannot pull image discoenv/missing (hold reason code 35, subcode 2)",
+		},
+		{
+			HeldJob{HoldReasonCode: 34, HoldReasonSubCode: 102, HoldReason: "Job has gone over memory limit"},
+			"The job used more memory or disk than it requested. HTCondor reported: Job has gone over memory limit (hold reason code 34, subcode 102)",
+		},
+		{
+			HeldJob{HoldReasonCode: 42, HoldReason: "EC2 instance potentially lost"},
+			"HTCondor reported: EC2 instance potentially lost (hold reason code 42, subcode 0)",
+		},
+		{
+			HeldJob{HoldReasonCode: 1000, HoldReason: "Site policy"},
+			"HTCondor reported: Site policy (hold reason code 1000, subcode 0)",
+		},
+		{HeldJob{}, ""},
+	}
+	for _, tt := range tests {
+		if actual := tt.job.Explanation(); actual != tt.expected {
+			t.Errorf("explanation was %q instead of %q", actual, tt.expected)
+		}
+	}
+	if actual := heldMessage("Job was killed", HeldJob{}); actual != "Job was killed" {
+		t.Errorf("message was %q instead of the prefix", actual)
+	}
+}
+
+func TestSweepHeldJobsPolicy(t *testing.T) {
+	cl, scheduler, client := newTestLauncher(t)
+	cl.heldPolicy.Rules[13] = HeldRule{Code: 13, Action: HeldActionRelease, MaxReleases: 1}
+	cl.heldPolicy.Rules[34] = HeldRule{Code: 34, Action: HeldActionNotify}
+
+	heldSince := time.Now().Add(-time.Hour)
+	scheduler.held = []HeldJob{
+		{InvocationID: "released", ClusterID: "1", HoldReasonCode: 13, NumHolds: 1, HeldSince: heldSince},
+		{InvocationID: "notified", ClusterID: "2", HoldReasonCode: 34, NumHolds: 1, HeldSince: heldSince, HoldReason: "memory usage exceeded request_memory"},
+		{InvocationID: "removed", ClusterID: "3", HoldReasonCode: 12, NumHolds: 1, HeldSince: heldSince, HoldReason: "Error from slot1: failed to create the sandbox"},
+	}
+
+	sweepHeldJobs(cl)
+	if len(scheduler.released) != 1 || scheduler.released[0] != "1" {
+		t.Errorf("released clusters %v instead of [1]", scheduler.released)
+	}
+	if len(scheduler.removed) != 1 || scheduler.removed[0] != "removed" {
+		t.Errorf("removed %v instead of [removed]", scheduler.removed)
+	}
+	if len(client.updates) != 3 {
+		t.Fatalf("published %d updates instead of 3", len(client.updates))
+	}
+
+	messages := map[string]*messaging.UpdateMessage{}
+	for _, update := range client.updates {
+		messages[update.Job.InvocationID] = update
+	}
+	if update := messages["removed"]; update.State != messaging.FailedState ||
+		update.Message != "Job was held by HTCondor and removed: The job's output files could not be transferred. "+
+			"HTCondor reported: Error from slot1: failed to create the sandbox (hold reason code 12, subcode 0)" {
+		t.Errorf("removed job update was %s %q", update.State, update.Message)
+	}
+	if update := messages["notified"]; update.State != messaging.SubmittedState ||
+		update.Message != "Job is held by HTCondor: The job used more memory or disk than it requested. "+
+			"HTCondor reported: memory usage exceeded request_memory (hold reason code 34, subcode 0)" {
+		t.Errorf("notified job update was %s %q", update.State, update.Message)
+	}
+	if update := messages["released"]; update.State != messaging.SubmittedState {
+		t.Errorf("released job update was %s %q", update.State, update.Message)
+	}
+
+	// The user should only be told about each hold once.
+	client.updates = nil
+	scheduler.held = scheduler.held[1:2]
+	sweepHeldJobs(cl)
+	if len(client.updates) != 0 {
+		t.Errorf("published %d updates for a job that was already reported as held", len(client.updates))
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// The actions the janitor can take for an old submission directory.
+const (
+	// JanitorActionDelete removes the submission directory.
+	JanitorActionDelete = "delete"
+
+	// JanitorActionArchive writes the submission directory to a tar.gz file
+	// in the archive directory and then removes it.
+	JanitorActionArchive = "archive"
+)
+
+const (
+	// defaultJanitorInterval is how often the janitor runs when
+	// condor.janitor.interval isn't set.
+	defaultJanitorInterval = time.Hour
+
+	// defaultJanitorRetention is how long submission directories are kept
+	// when condor.janitor.retention isn't set.
+	defaultJanitorRetention = 30 * 24 * time.Hour
+)
+
+// Janitor cleans up the submission directories of jobs that finished a while
+// ago, since they contain credentials and are never removed otherwise. It's
+// configured with the condor.janitor settings, for example:
+//
+//	condor:
+//	  janitor:
+//	    enabled: true
+//	    interval: 1h
+//	    retention: 720h
+//	    action: archive
+//	    archive_dir: /var/lib/condor-launcher/archive
+//	    dry_run: false
+//
+// A directory is cleaned up once the job was launched longer ago than the
+// retention period and the job is no longer in its pool's queue. Only jobs in
+// the launch ledger are considered, and their launch records are removed once
+// their directories have been cleaned up. The irods-config file is never
+// archived.
+// In dry run mode, the janitor only reports what it would have done.
+type Janitor struct {
+	Enabled    bool
+	Interval   time.Duration
+	Retention  time.Duration
+	Action     string
+	ArchiveDir string
+	DryRun     bool
+}
+
+// DefaultJanitor returns a disabled *Janitor.
+func DefaultJanitor() *Janitor {
+	return &Janitor{
+		Interval:  defaultJanitorInterval,
+		Retention: defaultJanitorRetention,
+		Action:    JanitorActionDelete,
+	}
+}
+
+// NewJanitor returns a *Janitor based on the condor.janitor settings.
+func NewJanitor(cfg *viper.Viper) (*Janitor, error) {
+	j := DefaultJanitor()
+	j.Enabled = cfg.GetBool("condor.janitor.enabled")
+	j.DryRun = cfg.GetBool("condor.janitor.dry_run")
+
+	if interval := cfg.GetDuration("condor.janitor.interval"); interval > 0 {
+		j.Interval = interval
+	}
+	if retention := cfg.GetDuration("condor.janitor.retention"); retention > 0 {
+		j.Retention = retention
+	}
+
+	if action := cfg.GetString("condor.janitor.action"); action != "" {
+		if action != JanitorActionDelete && action != JanitorActionArchive {
+			return nil, fmt.Errorf("invalid janitor action %s", action)
+		}
+		j.Action = action
+	}
+	j.ArchiveDir = cfg.GetString("condor.janitor.archive_dir")
+	if j.Action == JanitorActionArchive && j.ArchiveDir == "" {
+		return nil, errors.New("condor.janitor.archive_dir must be set when condor.janitor.action is archive")
+	}
+
+	return j, nil
+}
+
+// JanitorEntry describes what the janitor did, or would have done, with a
+// single submission directory.
+type JanitorEntry struct {
+	InvocationID  string    `json:"invocation_id"`
+	SubmissionDir string    `json:"submission_dir"`
+	SubmittedAt   time.Time `json:"submitted_at"`
+	Action        string    `json:"action"`
+	Archive       string    `json:"archive,omitempty"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// JanitorReport lists the submission directories handled by a janitor run.
+type JanitorReport struct {
+	DryRun  bool           `json:"dry_run"`
+	Entries []JanitorEntry `json:"entries"`
+}
+
+// jobFinished returns true if the launched job is no longer in its pool's
+// queue.
+func (cl *CondorLauncher) jobFinished(record *LaunchRecord) (bool, error) {
+	pool := cl.pools.Get(record.Pool)
+	if pool == nil {
+		return false, fmt.Errorf("invocation %s was launched on unknown pool %s", record.InvocationID, record.Pool)
+	}
+
+	constraint := fmt.Sprintf(`IpcUuid =?= "%s"`, record.InvocationID)
+	if record.ClusterID != "" {
+		constraint = fmt.Sprintf("ClusterId == %s", record.ClusterID)
+	}
+	ads, err := pool.Scheduler.Query(constraint, "ClusterId")
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to check whether invocation %s has finished", record.InvocationID)
+	}
+	return len(ads) == 0, nil
+}
+
+// cleanSubmissionDirs archives or deletes the submission directories of the
+// finished jobs that were launched before the retention period. Nothing is
+// changed if dryRun is true.
+func cleanSubmissionDirs(cl *CondorLauncher, dryRun bool, now time.Time) (*JanitorReport, error) {
+	j := cl.janitor
+	records, err := cl.ledger.Recent(0)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &JanitorReport{DryRun: dryRun, Entries: []JanitorEntry{}}
+	for _, record := range records {
+		if record.SubmissionDir == "" || now.Sub(record.SubmittedAt) < j.Retention {
+			continue
+		}
+		if _, err = cl.fs.Stat(record.SubmissionDir); err != nil {
+			if !os.IsNotExist(err) {
+				log.Errorf("%+v\n", errors.Wrapf(err, "failed to check %s", record.SubmissionDir))
+			}
+			continue
+		}
+
+		finished, err := cl.jobFinished(record)
+		if err != nil {
+			log.Errorf("%+v\n", err)
+			continue
+		}
+		if !finished {
+			continue
+		}
+
+		entry := JanitorEntry{
+			InvocationID:  record.InvocationID,
+			SubmissionDir: record.SubmissionDir,
+			SubmittedAt:   record.SubmittedAt,
+			Action:        j.Action,
+		}
+		if j.Action == JanitorActionArchive {
+			entry.Archive = path.Join(j.ArchiveDir, fmt.Sprintf("%s.tar.gz", record.InvocationID))
+		}
+
+		if dryRun {
+			log.Infof("Janitor dry run: would %s %s for invocation %s", entry.Action, entry.SubmissionDir, entry.InvocationID)
+		} else if err = cl.cleanSubmissionDir(&entry); err != nil {
+			log.Errorf("%+v\n", err)
+			entry.Error = err.Error()
+		} else {
+			log.Infof("Janitor: %s %s for invocation %s", entry.Action, entry.SubmissionDir, entry.InvocationID)
+			submissionDirsCleanedTotal.WithLabelValues(entry.Action).Inc()
+			cl.forgetLaunch(record)
+		}
+		report.Entries = append(report.Entries, entry)
+	}
+
+	return report, nil
+}
+
+// cleanSubmissionDir carries out the janitor's action for a single
+// submission directory. The job's directory is removed as well if the
+// submission directory was the only thing in it.
+func (cl *CondorLauncher) cleanSubmissionDir(entry *JanitorEntry) error {
+	if entry.Archive != "" {
+		if err := cl.archiveDir(entry.SubmissionDir, entry.InvocationID, entry.Archive); err != nil {
+			return err
+		}
+	}
+	if err := cl.fs.RemoveAll(entry.SubmissionDir); err != nil {
+		return errors.Wrapf(err, "failed to remove %s", entry.SubmissionDir)
+	}
+	cl.fs.Remove(path.Dir(entry.SubmissionDir))
+	return nil
+}
+
+// forgetLaunch removes the launch record for a job whose submission directory
+// has been cleaned up, along with the offset of its event log.
+func (cl *CondorLauncher) forgetLaunch(record *LaunchRecord) {
+	if err := cl.ledger.Delete(record.InvocationID); err != nil {
+		log.Errorf("%+v\n", err)
+	}
+	if err := cl.ledger.SetEventLogOffset(path.Join(record.SubmissionDir, jobEventLogName), 0); err != nil {
+		log.Errorf("%+v\n", err)
+	}
+}
+
+// archiveDir writes the contents of dir to a gzipped tar file at dest, under
+// a top-level directory called name. Credentials aren't archived. The archive
+// is streamed to a temporary file next to dest, which is renamed to dest once
+// it's complete, so dest is never left partially written.
+func (cl *CondorLauncher) archiveDir(dir, name, dest string) error {
+	if err := cl.fs.MkdirAll(path.Dir(dest), 0700); err != nil {
+		return errors.Wrapf(err, "failed to create the directory %s", path.Dir(dest))
+	}
+
+	tmp := path.Join(path.Dir(dest), fmt.Sprintf(".%s.tmp", path.Base(dest)))
+	f, err := cl.fs.Create(tmp, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create %s", tmp)
+	}
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	err = cl.addToArchive(tw, dir, name)
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gw.Close()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = errors.Wrapf(cl.fs.Rename(tmp, dest), "failed to rename %s to %s", tmp, dest)
+	} else {
+		err = errors.Wrapf(err, "failed to archive %s", dir)
+	}
+	if err != nil {
+		cl.fs.Remove(tmp)
+	}
+	return err
+}
+
+// addToArchive adds the contents of dir to the archive, recursively, with
+// names beginning with name.
+func (cl *CondorLauncher) addToArchive(tw *tar.Writer, dir, name string) error {
+	entries, err := cl.fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == "irods-config" {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			continue
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = path.Join(name, entry.Name())
+		if info.IsDir() {
+			hdr.Name += "/"
+			if err = tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if err = cl.addToArchive(tw, path.Join(dir, entry.Name()), hdr.Name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if err = cl.copyFile(tw, path.Join(dir, entry.Name()), info.Size()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies size bytes of the file at filePath to w.
+func (cl *CondorLauncher) copyFile(w io.Writer, filePath string, size int64) error {
+	f, err := cl.fs.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.CopyN(w, f, size)
+	return err
+}
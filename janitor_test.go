@@ -0,0 +1,167 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/condor-launcher/test"
+)
+
+func TestNewJanitor(t *testing.T) {
+	cfg := test.InitConfig(t)
+	j, err := NewJanitor(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Enabled || j.DryRun || j.Interval != defaultJanitorInterval || j.Retention != defaultJanitorRetention || j.Action != JanitorActionDelete {
+		t.Errorf("unexpected default janitor %#v", j)
+	}
+
+	cfg.Set("condor.janitor.enabled", true)
+	cfg.Set("condor.janitor.interval", "10m")
+	cfg.Set("condor.janitor.retention", "48h")
+	cfg.Set("condor.janitor.action", "archive")
+	cfg.Set("condor.janitor.archive_dir", "/archive")
+	if j, err = NewJanitor(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !j.Enabled || j.Interval != 10*time.Minute || j.Retention != 48*time.Hour || j.Action != JanitorActionArchive || j.ArchiveDir != "/archive" {
+		t.Errorf("unexpected janitor %#v", j)
+	}
+
+	cfg.Set("condor.janitor.archive_dir", "")
+	if _, err = NewJanitor(cfg); err == nil {
+		t.Error("NewJanitor did not return an error for archiving without an archive directory")
+	}
+	cfg.Set("condor.janitor.action", "shred")
+	if _, err = NewJanitor(cfg); err == nil {
+		t.Error("NewJanitor did not return an error for an invalid action")
+	}
+}
+
+// janitorOldDir is the submission directory of the old job in janitorFixture.
+const janitorOldDir = "/condor/logs/ipcdev/old-job/logs"
+
+// janitorFixture returns launch records for an old job, a recent job and an
+// old job whose directory is already gone.
+func janitorFixture(now time.Time) launcherFixture {
+	recentDir := "/condor/logs/ipcdev/recent-job/logs"
+	files := map[string]string{}
+	for _, dir := range []string{janitorOldDir, recentDir} {
+		for _, name := range []string{"iplant.cmd", "irods-config"} {
+			files[path.Join(dir, name)] = name
+		}
+	}
+	return launcherFixture{
+		files: files,
+		records: []*LaunchRecord{
+			{InvocationID: "old", ClusterID: "10000", SubmittedAt: now.Add(-60 * 24 * time.Hour), SubmissionDir: janitorOldDir},
+			{InvocationID: "recent", ClusterID: "10001", SubmittedAt: now.Add(-time.Hour), SubmissionDir: recentDir},
+			{InvocationID: "gone", ClusterID: "10002", SubmittedAt: now.Add(-60 * 24 * time.Hour), SubmissionDir: "/condor/logs/ipcdev/gone-job/logs"},
+		},
+	}
+}
+
+func TestCleanSubmissionDirsDelete(t *testing.T) {
+	now := time.Now()
+	cl, scheduler, _ := newTestLauncherWith(t, janitorFixture(now))
+
+	// The old job is still in the queue.
+	scheduler.queryAds = []JobAd{{ClusterID: 10000}}
+	report, err := cleanSubmissionDirs(cl, false, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Entries) != 0 {
+		t.Errorf("cleaned up %v while the job was still queued", report.Entries)
+	}
+	if len(scheduler.queries) != 1 || scheduler.queries[0] != "ClusterId == 10000" {
+		t.Errorf("queried %v", scheduler.queries)
+	}
+
+	scheduler.queryAds = nil
+	if report, err = cleanSubmissionDirs(cl, false, now); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Entries) != 1 || report.Entries[0].InvocationID != "old" || report.Entries[0].Error != "" {
+		t.Fatalf("unexpected report %#v", report)
+	}
+	if _, err = cl.fs.Stat(path.Dir(janitorOldDir)); !os.IsNotExist(err) {
+		t.Errorf("the old job directory was not removed: %v", err)
+	}
+	if _, err = cl.fs.Stat("/condor/logs/ipcdev/recent-job/logs/iplant.cmd"); err != nil {
+		t.Errorf("the recent job directory was removed: %s", err)
+	}
+	if r, err := cl.ledger.Lookup("old"); err != nil || r != nil {
+		t.Errorf("the launch record for the cleaned up job was %+v: %v", r, err)
+	}
+	if r, err := cl.ledger.Lookup("recent"); err != nil || r == nil {
+		t.Errorf("the launch record for the recent job was removed: %v", err)
+	}
+}
+
+func TestCleanSubmissionDirsDryRun(t *testing.T) {
+	now := time.Now()
+	cl, _, _ := newTestLauncherWith(t, janitorFixture(now))
+	report, err := cleanSubmissionDirs(cl, true, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.DryRun || len(report.Entries) != 1 || report.Entries[0].SubmissionDir != janitorOldDir {
+		t.Errorf("unexpected report %#v", report)
+	}
+	if _, err = cl.fs.Stat(path.Join(janitorOldDir, "iplant.cmd")); err != nil {
+		t.Errorf("the dry run removed a file: %s", err)
+	}
+}
+
+func TestCleanSubmissionDirsArchive(t *testing.T) {
+	now := time.Now()
+	cl, _, _ := newTestLauncherWith(t, janitorFixture(now))
+	cl.janitor.Action = JanitorActionArchive
+	cl.janitor.ArchiveDir = "/archive"
+
+	report, err := cleanSubmissionDirs(cl, false, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Entries) != 1 || report.Entries[0].Archive != "/archive/old.tar.gz" {
+		t.Fatalf("unexpected report %#v", report)
+	}
+	if _, err = cl.fs.Stat(janitorOldDir); !os.IsNotExist(err) {
+		t.Errorf("the archived directory was not removed: %v", err)
+	}
+	if entries, err := cl.fs.ReadDir("/archive"); err != nil || len(entries) != 1 {
+		t.Errorf("the archive directory contained %v: %v", entries, err)
+	}
+
+	data, err := cl.fs.ReadFile("/archive/old.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	if len(names) != 1 || names[0] != "old/iplant.cmd" {
+		t.Errorf("the archive contained %v", names)
+	}
+}
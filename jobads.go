@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// JobAd holds the attributes of a job's ClassAd that condor-launcher uses.
+// Queries only return the attributes they ask for, so the others are left at
+// their zero values, as are attributes that aren't defined for the job.
+// Attribute names are matched case-insensitively, the same way HTCondor
+// matches them.
+type JobAd struct {
+	ClusterID            int    `json:"ClusterId"`
+	ProcID               int    `json:"ProcId"`
+	JobStatus            int    `json:"JobStatus"`
+	IpcUUID              string `json:"IpcUuid"`
+	IpcUsername          string `json:"IpcUsername"`
+	Owner                string `json:"Owner"`
+	QDate                int64  `json:"QDate"`
+	RemoteHost           string `json:"RemoteHost"`
+	EnteredCurrentStatus int64  `json:"EnteredCurrentStatus"`
+	HoldReason           string `json:"HoldReason"`
+	HoldReasonCode       int    `json:"HoldReasonCode"`
+	HoldReasonSubCode    int    `json:"HoldReasonSubCode"`
+	NumHolds             int    `json:"NumHolds"`
+	ExitCode             *int   `json:"ExitCode"`
+	ExitBySignal         bool   `json:"ExitBySignal"`
+	ExitSignal           int    `json:"ExitSignal"`
+}
+
+// decodeJobAds decodes the output of `condor_q -json` or
+// `condor_history -json`, which is empty rather than an empty array when no
+// jobs match.
+func decodeJobAds(data []byte) ([]JobAd, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var ads []JobAd
+	if err := json.Unmarshal(data, &ads); err != nil {
+		return nil, errors.Wrap(err, "failed to decode the job ClassAds")
+	}
+	return ads, nil
+}
+
+// queryArgs returns the arguments for a condor_q or condor_history query that
+// returns the requested attributes of the jobs matching the constraint as
+// JSON.
+func queryArgs(constraint string, attrs []string) []string {
+	args := []string{"-constraint", constraint, "-json"}
+	if len(attrs) > 0 {
+		args = append(args, "-attributes", strings.Join(attrs, ","))
+	}
+	return args
+}
+
+// Cluster returns the job's cluster ID in the form used by the launch ledger.
+func (a *JobAd) Cluster() string {
+	return strconv.Itoa(a.ClusterID)
+}
+
+// HeldJob returns the HeldJob for a job in the held state. The ClassAd must
+// include the heldJobAttrs.
+func (a *JobAd) HeldJob() HeldJob {
+	job := HeldJob{
+		InvocationID:      a.IpcUUID,
+		ClusterID:         a.Cluster(),
+		HoldReasonCode:    a.HoldReasonCode,
+		HoldReasonSubCode: a.HoldReasonSubCode,
+		NumHolds:          a.NumHolds,
+		HoldReason:        a.HoldReason,
+	}
+	if a.EnteredCurrentStatus != 0 {
+		job.HeldSince = time.Unix(a.EnteredCurrentStatus, 0)
+	}
+	return job
+}
+
+// heldJobs returns the HeldJobs for the ClassAds of held jobs.
+func heldJobs(ads []JobAd) []HeldJob {
+	var held []HeldJob
+	for i := range ads {
+		held = append(held, ads[i].HeldJob())
+	}
+	return held
+}
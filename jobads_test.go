@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDecodeJobAds(t *testing.T) {
+	ads, err := decodeJobAds([]byte("\n"))
+	if err != nil || ads != nil {
+		t.Errorf("decodeJobAds returned %+v, %v for empty output", ads, err)
+	}
+
+	ads, err = decodeJobAds([]byte(`[{"ClusterId": 10000, "ProcId": 0, "JobStatus": 4, "ipcuuid": "a", "ExitCode": 0, "Owner": "ipcdev"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zero := 0
+	expected := []JobAd{{ClusterID: 10000, JobStatus: 4, IpcUUID: "a", ExitCode: &zero, Owner: "ipcdev"}}
+	if !reflect.DeepEqual(ads, expected) {
+		t.Errorf("decodeJobAds returned %+v instead of %+v", ads, expected)
+	}
+
+	if _, err = decodeJobAds([]byte("a\t10000\n")); err == nil {
+		t.Error("decodeJobAds didn't fail for output that isn't JSON")
+	}
+}
+
+func TestQueryArgs(t *testing.T) {
+	expected := []string{"-constraint", "JobStatus == 5", "-json", "-attributes", "IpcUuid,ClusterId"}
+	if actual := queryArgs("JobStatus == 5", []string{"IpcUuid", "ClusterId"}); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("queryArgs returned %v instead of %v", actual, expected)
+	}
+	expected = []string{"-constraint", "true", "-json"}
+	if actual := queryArgs("true", nil); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("queryArgs returned %v instead of %v", actual, expected)
+	}
+}
+
+func TestHeldJobs(t *testing.T) {
+	ads := []JobAd{
+		{
+			IpcUUID:              "63c5523d-d8a5-49bc-addc-99a73566cd89",
+			ClusterID:            10000,
+			HoldReasonCode:       13,
+			HoldReasonSubCode:    256,
+			NumHolds:             2,
+			EnteredCurrentStatus: 1500000000,
+			HoldReason:           "Transfer input files failure",
+		},
+		{
+			IpcUUID:   "b788569f-6948-4586-b5bd-5ea096986331",
+			ClusterID: 10001,
+		},
+	}
+	expected := []HeldJob{
+		{
+			InvocationID:      "63c5523d-d8a5-49bc-addc-99a73566cd89",
+			ClusterID:         "10000",
+			HoldReasonCode:    13,
+			HoldReasonSubCode: 256,
+			NumHolds:          2,
+			HeldSince:         time.Unix(1500000000, 0),
+			HoldReason:        "Transfer input files failure",
+		},
+		{
+			InvocationID: "b788569f-6948-4586-b5bd-5ea096986331",
+			ClusterID:    "10001",
+		},
+	}
+	if actual := heldJobs(ads); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("heldJobs returned %+v instead of %+v", actual, expected)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ErrorClass says whether a failed launch might succeed if it's retried.
+type ErrorClass string
+
+const (
+	// Transient errors, such as an unreachable schedd or a full disk, might
+	// go away if the launch is retried.
+	Transient ErrorClass = "transient"
+
+	// Permanent errors, such as an invalid job or a broken template, happen
+	// again every time the launch is retried.
+	Permanent ErrorClass = "permanent"
+)
+
+// LaunchError is an error from one step of launching a job, along with
+// whether it's worth retrying.
+type LaunchError struct {
+	Class ErrorClass
+	Step  string // the step that failed: parse, command, quota, credentials, render, stage or submit
+	Err   error
+}
+
+func (e *LaunchError) Error() string {
+	return e.Err.Error()
+}
+
+// Format includes the stack trace of the underlying error and the error's
+// class when it's formatted with %+v.
+func (e *LaunchError) Format(s fmt.State, verb rune) {
+	if verb == 'v' && s.Flag('+') {
+		fmt.Fprintf(s, "%+v\n%s %s error", e.Err, e.Class, e.Step)
+		return
+	}
+	io.WriteString(s, e.Error())
+}
+
+// Cause returns the underlying error, for errors.Cause.
+func (e *LaunchError) Cause() error {
+	return e.Err
+}
+
+// classified returns a *LaunchError with the given class for err. Errors that
+// have already been classified are returned unchanged, so the step closest to
+// the failure decides the class. A nil error is returned as nil.
+func classified(class ErrorClass, step string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if findLaunchError(err) != nil {
+		return err
+	}
+	return &LaunchError{Class: class, Step: step, Err: err}
+}
+
+// transientError classifies err as a transient failure of the step.
+func transientError(step string, err error) error {
+	return classified(Transient, step, err)
+}
+
+// permanentError classifies err as a permanent failure of the step.
+func permanentError(step string, err error) error {
+	return classified(Permanent, step, err)
+}
+
+// findLaunchError returns the first *LaunchError in err's chain of causes, or
+// nil if there isn't one.
+func findLaunchError(err error) *LaunchError {
+	for err != nil {
+		if le, ok := err.(*LaunchError); ok {
+			return le
+		}
+		cause, ok := err.(interface{ Cause() error })
+		if !ok {
+			return nil
+		}
+		err = cause.Cause()
+	}
+	return nil
+}
+
+// ErrorClassOf returns the class of a launch error. Errors that weren't
+// classified are treated as transient.
+func ErrorClassOf(err error) ErrorClass {
+	if le := findLaunchError(err); le != nil {
+		return le.Class
+	}
+	return Transient
+}
+
+// submitError classifies an error returned by a scheduler's Submit method.
+// Submission files rejected by condor_submit and requests rejected by the
+// HTCondor REST API as invalid are permanent, and everything else is assumed
+// to be a problem reaching the schedd.
+func submitError(err error) error {
+	if _, ok := causeOf(err).(*submitRejectedError); ok {
+		return permanentError("submit", err)
+	}
+	if se, ok := causeOf(err).(*httpStatusError); ok && se.StatusCode >= 400 && se.StatusCode < 500 {
+		switch se.StatusCode {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		default:
+			return permanentError("submit", err)
+		}
+	}
+	return transientError("submit", err)
+}
+
+// causeOf returns the innermost cause of err.
+func causeOf(err error) error {
+	for {
+		cause, ok := err.(interface{ Cause() error })
+		if !ok {
+			return err
+		}
+		err = cause.Cause()
+	}
+}
+
+// launchFailureMessage returns the message sent to the user when their job
+// can't be launched.
+func launchFailureMessage(err error) string {
+	if qe := quotaExceeded(err); qe != nil {
+		return fmt.Sprintf("condor-launcher did not launch this job, %s", qe)
+	}
+	if le := findLaunchError(err); le != nil && le.Class == Permanent {
+		return fmt.Sprintf("condor-launcher cannot launch this job, and retrying it will not help (%s failed):\n %s", le.Step, err)
+	}
+	return fmt.Sprintf("condor-launcher failed to launch job:\n %s", err)
+}
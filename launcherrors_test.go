@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/cyverse-de/condor-launcher/test"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/streadway/amqp"
+	"gopkg.in/cyverse-de/messaging.v6"
+)
+
+func TestErrorClassOf(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected ErrorClass
+	}{
+		{"unclassified", errors.New("boom"), Transient},
+		{"transient", transientError("stage", errors.New("disk full")), Transient},
+		{"permanent", permanentError("render", errors.New("bad template")), Permanent},
+		{"wrapped", errors.Wrap(permanentError("parse", errors.New("bad json")), "launch failed"), Permanent},
+		{"innermost wins", transientError("stage", permanentError("render", errors.New("bad template"))), Permanent},
+		{"rest 400", submitError(errors.Wrap(&httpStatusError{StatusCode: http.StatusBadRequest}, "submit")), Permanent},
+		{"rest 429", submitError(&httpStatusError{StatusCode: http.StatusTooManyRequests}), Transient},
+		{"rest 503", submitError(&httpStatusError{StatusCode: http.StatusServiceUnavailable}), Transient},
+		{"cli", submitError(errors.New("failed to execute condor_submit")), Transient},
+	}
+	for _, tt := range tests {
+		if actual := ErrorClassOf(tt.err); actual != tt.expected {
+			t.Errorf("%s: class was %s instead of %s", tt.name, actual, tt.expected)
+		}
+	}
+	if transientError("stage", nil) != nil {
+		t.Error("transientError did not return nil for a nil error")
+	}
+}
+
+// fakeCondorSubmit puts a condor_submit that prints the output and exits with
+// an error at the front of the PATH. The condor commands are run with an
+// empty PATH, so the script only uses shell builtins.
+func fakeCondorSubmit(t *testing.T, output string) {
+	test.InitPath(t)
+	dir := t.TempDir()
+	script := "#!/bin/sh\nwhile IFS= read -r line; do echo \"$line\" >&2; done <<'EOF'\n" + output + "\nEOF\nexit 1\n"
+	if err := os.WriteFile(path.Join(dir, "condor_submit"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+}
+
+func TestCondorCLISubmitErrorClass(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		expected ErrorClass
+	}{
+		{"parse error", "Submitting job(s)\nERROR: on Line 12 of submit file: \nERROR: Parse error in expression:\n\t+IpcUsername = \"ipcdev", Permanent},
+		{"missing executable", "ERROR: Executable file /usr/local/bin/road-runner does not exist", Permanent},
+		{"unreachable schedd", "ERROR: Can't find address of local schedd", Transient},
+		{"no output", "", Transient},
+	}
+	for _, tt := range tests {
+		fakeCondorSubmit(t, tt.output)
+		scheduler, err := NewCondorCLI("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = scheduler.Submit(path.Join(t.TempDir(), "iplant.cmd"))
+		if err == nil {
+			t.Fatalf("%s: the failed submission didn't return an error", tt.name)
+		}
+		if actual := ErrorClassOf(submitError(err)); actual != tt.expected {
+			t.Errorf("%s: class was %s instead of %s: %v", tt.name, actual, tt.expected, err)
+		}
+	}
+}
+
+func TestLaunchTransientErrorsAreNotRetriedInProcess(t *testing.T) {
+	cl, scheduler, client := newTestLauncher(t)
+	cl.delayedRetries.MaxRetries = 0
+	scheduler.submitErrs = []error{errors.New("schedd unavailable")}
+
+	rejects := testutil.ToFloat64(deliveryRejectsTotal.WithLabelValues("true"))
+	cl.handleLaunchRequests()(launchDelivery(t, cl, false))
+	if len(scheduler.submitted) != 0 {
+		t.Errorf("the launch was retried in-process: %v", scheduler.submitted)
+	}
+	if actual := testutil.ToFloat64(deliveryRejectsTotal.WithLabelValues("true")); actual != rejects+1 {
+		t.Errorf("requeued rejects was %f instead of %f", actual, rejects+1)
+	}
+	if len(client.updates) != 0 {
+		t.Errorf("published %v for a request that was requeued", client.updates)
+	}
+}
+
+func TestLaunchPermanentErrorsFailFast(t *testing.T) {
+	cl, scheduler, client := newTestLauncher(t)
+	cl.cfg.Set("irods.password_source", "bogus")
+
+	rejects := testutil.ToFloat64(deliveryRejectsTotal.WithLabelValues("false"))
+	cl.handleLaunchRequests()(launchDelivery(t, cl, false))
+	if actual := testutil.ToFloat64(deliveryRejectsTotal.WithLabelValues("false")); actual != rejects+1 {
+		t.Errorf("rejects without requeue was %f instead of %f", actual, rejects+1)
+	}
+	if len(scheduler.submitted) != 0 {
+		t.Errorf("submitted %v", scheduler.submitted)
+	}
+	if len(client.updates) != 1 || client.updates[0].State != messaging.FailedState {
+		t.Fatalf("published %v instead of a single failed update", client.updates)
+	}
+	if msg := client.updates[0].Message; !strings.Contains(msg, "retrying it will not help") || !strings.Contains(msg, "bogus") {
+		t.Errorf("unexpected failure message %q", msg)
+	}
+}
+
+func TestLaunchInvalidRequestIsNotRequeued(t *testing.T) {
+	cl, _, client := newTestLauncher(t)
+	rejects := testutil.ToFloat64(deliveryRejectsTotal.WithLabelValues("true"))
+	cl.handleLaunchRequests()(amqp.Delivery{Body: []byte("{not json")})
+	cl.handleLaunchRequests()(amqp.Delivery{Body: []byte(`{"command": "launch"}`)})
+	if actual := testutil.ToFloat64(deliveryRejectsTotal.WithLabelValues("true")); actual != rejects {
+		t.Errorf("requeued %f invalid requests", actual-rejects)
+	}
+	if len(client.deadLetters) != 2 {
+		t.Fatalf("dead-lettered %d invalid requests instead of 2", len(client.deadLetters))
+	}
+	for _, dl := range client.deadLetters {
+		if dl.headers[deadLetterReasonHeader] != DeadLetterUnparseable {
+			t.Errorf("unexpected dead letter headers %v", dl.headers)
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// defaultLedgerPath is the location of the launch ledger when
+	// condor.ledger_path isn't set.
+	defaultLedgerPath = "/var/lib/condor-launcher/ledger.db"
+
+	// defaultLedgerRetention is how long launch records are kept when
+	// condor.ledger_retention isn't set.
+	defaultLedgerRetention = 90 * 24 * time.Hour
+
+	// ledgerPruneInterval is how often the launch records that are older than
+	// the retention period are removed.
+	ledgerPruneInterval = time.Hour
+)
+
+var (
+	// launchesBucket is the name of the bbolt bucket containing launch
+	// records, keyed by invocation ID.
+	launchesBucket = []byte("launches")
+
+	// launchTimesBucket is the name of the bbolt bucket that indexes the
+	// launch records by submission time. Each key is the submission time
+	// followed by the invocation ID, and each value is the invocation ID.
+	launchTimesBucket = []byte("launch_times")
+
+	// eventLogOffsetsBucket is the name of the bbolt bucket containing the
+	// number of bytes of each job event log that have been read, keyed by
+	// the log's path.
+	eventLogOffsetsBucket = []byte("event_log_offsets")
+)
+
+// LaunchRecord describes a single job submission made by condor-launcher.
+type LaunchRecord struct {
+	InvocationID    string    `json:"invocation_id"`
+	ClusterID       string    `json:"cluster_id"`
+	Pool            string    `json:"pool,omitempty"`
+	SubmittedAt     time.Time `json:"submitted_at"`
+	Submitter       string    `json:"submitter"`
+	ExecutionTarget string    `json:"execution_target"`
+	SubmissionDir   string    `json:"submission_dir"`
+	SubmitOutput    string    `json:"submit_output"`
+
+	// The last status of the job seen by the status poller, which is empty
+	// until the job's status has been polled.
+	Status          string    `json:"status,omitempty"`
+	StatusChangedAt time.Time `json:"status_changed_at"`
+	ExitCode        *int      `json:"exit_code,omitempty"`
+}
+
+// Ledger defines an interface for recording which Condor cluster ran each
+// invocation.
+type Ledger interface {
+	// Record stores the launch record, replacing any existing record for the
+	// same invocation ID.
+	Record(*LaunchRecord) error
+
+	// Lookup returns the launch record for the invocation ID, or nil if the
+	// invocation hasn't been launched.
+	Lookup(invocationID string) (*LaunchRecord, error)
+
+	// Delete removes the launch record for the invocation ID, if there is
+	// one.
+	Delete(invocationID string) error
+
+	// Recent returns up to limit launch records, most recent first.
+	Recent(limit int) ([]*LaunchRecord, error)
+
+	// Since returns the launch records submitted at or after t, most recent
+	// first.
+	Since(t time.Time) ([]*LaunchRecord, error)
+
+	// Prune removes the launch records submitted before t, along with the
+	// offsets of their job event logs, and returns how many were removed.
+	Prune(before time.Time) (int, error)
+
+	// EventLogOffset returns the number of bytes of the event log at logPath
+	// that have been read, or 0 if it hasn't been read.
+	EventLogOffset(logPath string) (int64, error)
+
+	// SetEventLogOffset stores the number of bytes of the event log at
+	// logPath that have been read. An offset of 0 forgets the log.
+	SetEventLogOffset(logPath string, offset int64) error
+
+	Close() error
+}
+
+// BoltLedger is an implementation of Ledger backed by an embedded bbolt
+// database on the local disk.
+type BoltLedger struct {
+	db *bolt.DB
+}
+
+// NewBoltLedger opens (or creates) the ledger database at dbPath. The index of
+// launch times is built from the launch records if it doesn't exist yet.
+func NewBoltLedger(dbPath string) (*BoltLedger, error) {
+	if err := os.MkdirAll(filepath.Dir(dbPath), 0700); err != nil {
+		return nil, errors.Wrapf(err, "failed to create the directory for %s", dbPath)
+	}
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open the launch ledger at %s", dbPath)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{launchesBucket, eventLogOffsetsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		if tx.Bucket(launchTimesBucket) != nil {
+			return nil
+		}
+		index, err := tx.CreateBucket(launchTimesBucket)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(launchesBucket).ForEach(func(k, v []byte) error {
+			r, err := unmarshalRecord(k, v)
+			if err != nil {
+				return err
+			}
+			return index.Put(launchTimeKey(r), k)
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrapf(err, "failed to initialize the launch ledger at %s", dbPath)
+	}
+	return &BoltLedger{db: db}, nil
+}
+
+// launchTimeKey returns the record's key in the index of launch times. The
+// submission time is stored big-endian so that the keys sort by time, and
+// records without one sort first.
+func launchTimeKey(r *LaunchRecord) []byte {
+	key := make([]byte, 8, 8+len(r.InvocationID))
+	if nanos := r.SubmittedAt.UnixNano(); !r.SubmittedAt.IsZero() && nanos > 0 {
+		binary.BigEndian.PutUint64(key, uint64(nanos))
+	}
+	return append(key, r.InvocationID...)
+}
+
+// launchTime returns the submission time stored in a key from the index of
+// launch times.
+func launchTime(key []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(key[:8])))
+}
+
+// unmarshalRecord parses the launch record stored for the invocation ID.
+func unmarshalRecord(invocationID, value []byte) (*LaunchRecord, error) {
+	r := &LaunchRecord{}
+	if err := json.Unmarshal(value, r); err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal the launch record for %s", invocationID)
+	}
+	return r, nil
+}
+
+// unindex removes the stored record for the invocation ID, if there is one,
+// from the index of launch times.
+func unindex(tx *bolt.Tx, invocationID []byte) error {
+	value := tx.Bucket(launchesBucket).Get(invocationID)
+	if value == nil {
+		return nil
+	}
+	r, err := unmarshalRecord(invocationID, value)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(launchTimesBucket).Delete(launchTimeKey(r))
+}
+
+// Record stores the launch record.
+func (l *BoltLedger) Record(r *LaunchRecord) error {
+	value, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal the launch record for %s", r.InvocationID)
+	}
+	err = l.db.Update(func(tx *bolt.Tx) error {
+		if err := unindex(tx, []byte(r.InvocationID)); err != nil {
+			return err
+		}
+		if err := tx.Bucket(launchTimesBucket).Put(launchTimeKey(r), []byte(r.InvocationID)); err != nil {
+			return err
+		}
+		return tx.Bucket(launchesBucket).Put([]byte(r.InvocationID), value)
+	})
+	return errors.Wrapf(err, "failed to store the launch record for %s", r.InvocationID)
+}
+
+// Lookup returns the launch record for the invocation ID, or nil if there
+// isn't one.
+func (l *BoltLedger) Lookup(invocationID string) (*LaunchRecord, error) {
+	var r *LaunchRecord
+	err := l.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(launchesBucket).Get([]byte(invocationID))
+		if value == nil {
+			return nil
+		}
+		r = &LaunchRecord{}
+		return json.Unmarshal(value, r)
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to look up the launch record for %s", invocationID)
+	}
+	return r, nil
+}
+
+// Delete removes the launch record for the invocation ID.
+func (l *BoltLedger) Delete(invocationID string) error {
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		if err := unindex(tx, []byte(invocationID)); err != nil {
+			return err
+		}
+		return tx.Bucket(launchesBucket).Delete([]byte(invocationID))
+	})
+	return errors.Wrapf(err, "failed to delete the launch record for %s", invocationID)
+}
+
+// Recent returns up to limit launch records, most recent first. A limit of
+// zero or less returns every record.
+func (l *BoltLedger) Recent(limit int) ([]*LaunchRecord, error) {
+	records, err := l.scan(time.Time{}, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list launch records")
+	}
+	return records, nil
+}
+
+// Since returns the launch records submitted at or after t, most recent first.
+func (l *BoltLedger) Since(t time.Time) ([]*LaunchRecord, error) {
+	records, err := l.scan(t, 0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list the launch records submitted since %s", t)
+	}
+	return records, nil
+}
+
+// scan walks the index of launch times backwards, returning up to limit
+// launch records submitted at or after since. A zero since or a limit of zero
+// or less doesn't restrict the records returned.
+func (l *BoltLedger) scan(since time.Time, limit int) ([]*LaunchRecord, error) {
+	var records []*LaunchRecord
+	err := l.db.View(func(tx *bolt.Tx) error {
+		launches := tx.Bucket(launchesBucket)
+		c := tx.Bucket(launchTimesBucket).Cursor()
+		for k, id := c.Last(); k != nil; k, id = c.Prev() {
+			if limit > 0 && len(records) >= limit {
+				break
+			}
+			if !since.IsZero() && launchTime(k).Before(since) {
+				break
+			}
+			value := launches.Get(id)
+			if value == nil {
+				continue
+			}
+			r, err := unmarshalRecord(id, value)
+			if err != nil {
+				return err
+			}
+			records = append(records, r)
+		}
+		return nil
+	})
+	return records, err
+}
+
+// Prune removes the launch records submitted before the given time, along with
+// the offsets of their job event logs.
+func (l *BoltLedger) Prune(before time.Time) (int, error) {
+	var pruned int
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		launches := tx.Bucket(launchesBucket)
+		offsets := tx.Bucket(eventLogOffsetsBucket)
+		c := tx.Bucket(launchTimesBucket).Cursor()
+		for k, id := c.First(); k != nil && launchTime(k).Before(before); k, id = c.First() {
+			if value := launches.Get(id); value != nil {
+				r, err := unmarshalRecord(id, value)
+				if err != nil {
+					return err
+				}
+				if r.SubmissionDir != "" {
+					if err = offsets.Delete([]byte(path.Join(r.SubmissionDir, jobEventLogName))); err != nil {
+						return err
+					}
+				}
+				if err = launches.Delete(id); err != nil {
+					return err
+				}
+				pruned++
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to prune the launch records submitted before %s", before)
+	}
+	return pruned, nil
+}
+
+// ledgerRetention returns how long launch records are kept, based on the
+// condor.ledger_retention setting.
+func ledgerRetention(cfg *viper.Viper) time.Duration {
+	if retention := cfg.GetDuration("condor.ledger_retention"); retention > 0 {
+		return retention
+	}
+	return defaultLedgerRetention
+}
+
+// checkLedgerRetention returns an error if launch records would be pruned
+// before the status poller, the event log and the quotas stop looking at them,
+// or before the janitor has cleaned up their submission directories.
+func (cl *CondorLauncher) checkLedgerRetention() error {
+	if cl.ledgerRetention < cl.statusPoller.Lookback {
+		return fmt.Errorf("condor.ledger_retention %s is shorter than condor.status_poller.lookback %s", cl.ledgerRetention, cl.statusPoller.Lookback)
+	}
+	if cl.janitor.Enabled && cl.ledgerRetention <= cl.janitor.Retention {
+		return fmt.Errorf("condor.ledger_retention %s must be longer than condor.janitor.retention %s", cl.ledgerRetention, cl.janitor.Retention)
+	}
+	return nil
+}
+
+// pruneLedger removes the launch records that were submitted longer ago than
+// the retention period.
+func pruneLedger(cl *CondorLauncher, now time.Time) error {
+	n, err := cl.ledger.Prune(now.Add(-cl.ledgerRetention))
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Infof("Pruned %d launch records submitted more than %s ago", n, cl.ledgerRetention)
+	}
+	return nil
+}
+
+// EventLogOffset returns the number of bytes of the event log at logPath that
+// have been read.
+func (l *BoltLedger) EventLogOffset(logPath string) (int64, error) {
+	var offset int64
+	err := l.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(eventLogOffsetsBucket).Get([]byte(logPath))
+		if value == nil {
+			return nil
+		}
+		var err error
+		offset, err = strconv.ParseInt(string(value), 10, 64)
+		return err
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to look up the offset of the event log %s", logPath)
+	}
+	return offset, nil
+}
+
+// SetEventLogOffset stores the number of bytes of the event log at logPath
+// that have been read.
+func (l *BoltLedger) SetEventLogOffset(logPath string, offset int64) error {
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(eventLogOffsetsBucket)
+		if offset == 0 {
+			return b.Delete([]byte(logPath))
+		}
+		return b.Put([]byte(logPath), []byte(strconv.FormatInt(offset, 10)))
+	})
+	return errors.Wrapf(err, "failed to store the offset of the event log %s", logPath)
+}
+
+// Close closes the underlying database.
+func (l *BoltLedger) Close() error {
+	return l.db.Close()
+}
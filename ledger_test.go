@@ -0,0 +1,240 @@
+package main
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/condor-launcher/test"
+	bolt "go.etcd.io/bbolt"
+)
+
+// newTestLedger returns a *BoltLedger stored in a temporary directory that is
+// closed when the test finishes.
+func newTestLedger(t *testing.T) *BoltLedger {
+	return newTestLedgerAt(t, path.Join(t.TempDir(), "ledger.db"))
+}
+
+// newTestLedgerAt opens the *BoltLedger at dbPath, closing it when the test
+// finishes.
+func newTestLedgerAt(t *testing.T, dbPath string) *BoltLedger {
+	l, err := NewBoltLedger(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestLedgerRecordLookup(t *testing.T) {
+	l := newTestLedger(t)
+	expected := &LaunchRecord{
+		InvocationID:    "07b04ce2-7757-4b21-9e15-0b4c2f44be26",
+		ClusterID:       "10000",
+		SubmittedAt:     time.Date(2019, 10, 10, 12, 0, 0, 0, time.UTC),
+		Submitter:       "test_this_is_a_test",
+		ExecutionTarget: "condor",
+		SubmissionDir:   "/tmp/test_this_is_a_test/Word_Count_analysis1__/logs",
+	}
+	if err := l.Record(expected); err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := l.Lookup(expected.InvocationID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual == nil {
+		t.Fatal("Lookup did not find the recorded launch")
+	}
+	if *actual != *expected {
+		t.Errorf("Lookup returned %#v instead of %#v", actual, expected)
+	}
+}
+
+func TestLedgerLookupMissing(t *testing.T) {
+	l := newTestLedger(t)
+	actual, err := l.Lookup("missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual != nil {
+		t.Errorf("Lookup returned %#v for a missing invocation", actual)
+	}
+}
+
+func TestLedgerDelete(t *testing.T) {
+	l := newTestLedger(t)
+	if err := l.Record(&LaunchRecord{InvocationID: "gone", ClusterID: "10000"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Delete("gone"); err != nil {
+		t.Fatal(err)
+	}
+	if actual, err := l.Lookup("gone"); err != nil || actual != nil {
+		t.Errorf("Lookup returned %#v after the record was deleted: %v", actual, err)
+	}
+	if err := l.Delete("missing"); err != nil {
+		t.Errorf("deleting a missing record returned %v", err)
+	}
+}
+
+func TestLedgerRecent(t *testing.T) {
+	l := newTestLedger(t)
+	now := time.Now()
+	for i, id := range []string{"a", "b", "c"} {
+		err := l.Record(&LaunchRecord{
+			InvocationID: id,
+			SubmittedAt:  now.Add(time.Duration(i) * time.Minute),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := l.Recent(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Recent returned %d records instead of 2", len(records))
+	}
+	if records[0].InvocationID != "c" || records[1].InvocationID != "b" {
+		t.Errorf("Recent returned %s, %s instead of c, b", records[0].InvocationID, records[1].InvocationID)
+	}
+}
+
+func TestLedgerSince(t *testing.T) {
+	l := newTestLedger(t)
+	now := time.Now()
+	for i, id := range []string{"a", "b", "c"} {
+		err := l.Record(&LaunchRecord{
+			InvocationID: id,
+			SubmittedAt:  now.Add(time.Duration(i) * time.Hour),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Recording a launch again moves it in the index.
+	if err := l.Record(&LaunchRecord{InvocationID: "a", SubmittedAt: now.Add(3 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := l.Since(now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, r := range records {
+		ids = append(ids, r.InvocationID)
+	}
+	if len(ids) != 3 || ids[0] != "a" || ids[1] != "c" || ids[2] != "b" {
+		t.Errorf("Since returned %v instead of [a c b]", ids)
+	}
+}
+
+func TestLedgerPrune(t *testing.T) {
+	l := newTestLedger(t)
+	now := time.Now()
+	old := &LaunchRecord{InvocationID: "old", SubmittedAt: now.Add(-48 * time.Hour), SubmissionDir: "/condor/logs/old"}
+	for _, r := range []*LaunchRecord{old, {InvocationID: "new", SubmittedAt: now}} {
+		if err := l.Record(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logPath := path.Join(old.SubmissionDir, jobEventLogName)
+	if err := l.SetEventLogOffset(logPath, 1234); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := l.Prune(now.Add(-24 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("Prune removed %d records instead of 1", n)
+	}
+	if r, err := l.Lookup("old"); err != nil || r != nil {
+		t.Errorf("Lookup returned %#v for a pruned record: %v", r, err)
+	}
+	if offset, err := l.EventLogOffset(logPath); err != nil || offset != 0 {
+		t.Errorf("the offset of a pruned record's event log was %d: %v", offset, err)
+	}
+	if records, err := l.Recent(0); err != nil || len(records) != 1 || records[0].InvocationID != "new" {
+		t.Errorf("Recent returned %v after pruning: %v", records, err)
+	}
+}
+
+func TestNewBoltLedgerBuildsIndex(t *testing.T) {
+	dbPath := path.Join(t.TempDir(), "ledger.db")
+	l, err := NewBoltLedger(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range []string{"a", "b"} {
+		if err = l.Record(&LaunchRecord{InvocationID: id, SubmittedAt: time.Now().Add(time.Duration(i) * time.Minute)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Drop the index, as in a ledger written before it existed.
+	err = l.db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(launchTimesBucket)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	l = newTestLedgerAt(t, dbPath)
+	records, err := l.Recent(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].InvocationID != "b" || records[1].InvocationID != "a" {
+		t.Errorf("Recent returned %v from the rebuilt index", records)
+	}
+}
+
+func TestCheckLedgerRetention(t *testing.T) {
+	cfg := test.InitConfig(t)
+	cl, _, _ := newTestLauncher(t)
+	if cl.ledgerRetention = ledgerRetention(cfg); cl.ledgerRetention != defaultLedgerRetention {
+		t.Errorf("the default retention was %s", cl.ledgerRetention)
+	}
+	if err := cl.checkLedgerRetention(); err != nil {
+		t.Error(err)
+	}
+
+	cl.ledgerRetention = cl.statusPoller.Lookback / 2
+	if err := cl.checkLedgerRetention(); err == nil {
+		t.Error("checkLedgerRetention accepted a retention shorter than the status lookback")
+	}
+	cl.ledgerRetention = cl.janitor.Retention
+	cl.janitor.Enabled = true
+	if err := cl.checkLedgerRetention(); err == nil {
+		t.Error("checkLedgerRetention accepted a retention no longer than the janitor's")
+	}
+}
+
+func TestLedgerEventLogOffsets(t *testing.T) {
+	l := newTestLedger(t)
+	logPath := "/condor/logs/ipcdev/job/logs/condor.log"
+	if offset, err := l.EventLogOffset(logPath); err != nil || offset != 0 {
+		t.Fatalf("the offset of an unread log was %d: %v", offset, err)
+	}
+	if err := l.SetEventLogOffset(logPath, 1234); err != nil {
+		t.Fatal(err)
+	}
+	if offset, err := l.EventLogOffset(logPath); err != nil || offset != 1234 {
+		t.Errorf("the offset was %d instead of 1234: %v", offset, err)
+	}
+	if err := l.SetEventLogOffset(logPath, 0); err != nil {
+		t.Fatal(err)
+	}
+	if offset, err := l.EventLogOffset(logPath); err != nil || offset != 0 {
+		t.Errorf("the offset of a forgotten log was %d: %v", offset, err)
+	}
+}
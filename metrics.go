@@ -0,0 +1,315 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/viper"
+)
+
+const metricsNamespace = "condor_launcher"
+
+// newMetricsServer returns an *http.Server that only serves the Prometheus
+// metrics at /metrics, or nil if metrics.listen_port isn't set. Like the admin
+// API, it listens on metrics.listen_address, which defaults to 127.0.0.1.
+// Unlike the admin API, which also serves /metrics, it can listen on
+// addresses reachable from other hosts without exposing the endpoints that
+// stop jobs.
+func newMetricsServer(cfg *viper.Viper) *http.Server {
+	port := cfg.GetInt("metrics.listen_port")
+	if port == 0 {
+		return nil
+	}
+	addr := cfg.GetString("metrics.listen_address")
+	if addr == "" {
+		addr = "127.0.0.1"
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return &http.Server{Addr: fmt.Sprintf("%s:%d", addr, port), Handler: mux}
+}
+
+var (
+	// launchesTotal counts launch requests by execution target and result.
+	launchesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "launches_total",
+			Help:      "The number of launch requests handled, by execution target and result (success, failure, deferred or interrupted).",
+		},
+		[]string{"execution_target", "result"},
+	)
+
+	// stopsTotal counts stop requests by result.
+	stopsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "stops_total",
+			Help:      "The number of stop requests handled, by result.",
+		},
+		[]string{"result"},
+	)
+
+	// heldJobsKilledTotal counts the held jobs killed across all sweeps.
+	heldJobsKilledTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "held_jobs_killed_total",
+			Help:      "The number of held jobs killed by held job sweeps.",
+		},
+	)
+
+	// heldJobsKilledLastSweep is the number of held jobs killed by the most
+	// recent sweep.
+	heldJobsKilledLastSweep = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "held_jobs_killed_last_sweep",
+			Help:      "The number of held jobs killed by the most recent held job sweep.",
+		},
+	)
+
+	// heldJobActionsTotal counts the actions taken on held jobs by the held
+	// job policy.
+	heldJobActionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "held_job_actions_total",
+			Help:      "The number of actions taken on held jobs, by action.",
+		},
+		[]string{"action"},
+	)
+
+	// submissionDirsCleanedTotal counts the submission directories archived
+	// or deleted by the janitor.
+	submissionDirsCleanedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "submission_dirs_cleaned_total",
+			Help:      "The number of submission directories cleaned up by the janitor, by action.",
+		},
+		[]string{"action"},
+	)
+
+	// delayedLaunchRetriesTotal counts the launch requests published to the
+	// delay queue to be retried later.
+	delayedLaunchRetriesTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "delayed_launch_retries_total",
+			Help:      "The number of failed launch requests scheduled to be retried later.",
+		},
+	)
+
+	// jobStatusChangesTotal counts the job status changes seen by the status
+	// poller, split by the new status.
+	jobStatusChangesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "job_status_changes_total",
+			Help:      "The number of job status changes seen by the status poller.",
+		},
+		[]string{"status"},
+	)
+
+	// jobEventsTotal counts the events read from the HTCondor job event logs
+	// for launched jobs, split by the type of event.
+	jobEventsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "job_events_total",
+			Help:      "The number of HTCondor job events read for launched jobs.",
+		},
+		[]string{"event"},
+	)
+
+	// quotaExceededTotal counts the launch requests that would have exceeded
+	// a quota, split by the quota's scope and the action taken.
+	quotaExceededTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "quota_exceeded_total",
+			Help:      "The number of launch requests that would have exceeded a quota, by scope and action.",
+		},
+		[]string{"scope", "action"},
+	)
+
+	// deadLettersTotal counts the messages published to the dead-letter
+	// exchange, split by the reason they were dead-lettered.
+	deadLettersTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "dead_letters_total",
+			Help:      "The number of messages that were dead-lettered.",
+		},
+		[]string{"reason"},
+	)
+
+	// submitQueueLength is the number of launches waiting for the submit
+	// limits of each pool.
+	submitQueueLength = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "submit_queue_length",
+			Help:      "The number of launches waiting to submit their job, by pool.",
+		},
+		[]string{"pool"},
+	)
+
+	// submitWaitSeconds tracks how long launches wait for the submit limits.
+	submitWaitSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "submit_wait_seconds",
+			Help:      "The time launches waited for the submit limits before submitting their job, by pool.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+		},
+		[]string{"pool"},
+	)
+
+	// submitsInFlight is the number of submissions running in each pool.
+	submitsInFlight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "submits_in_flight",
+			Help:      "The number of job submissions running, by pool.",
+		},
+		[]string{"pool"},
+	)
+
+	// deliveryRejectsTotal counts rejected AMQP deliveries, split by whether
+	// they were requeued.
+	deliveryRejectsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "amqp_rejects_total",
+			Help:      "The number of AMQP deliveries rejected, by whether they were requeued.",
+		},
+		[]string{"requeue"},
+	)
+
+	// condorCommandDuration tracks how long the scheduler operations take.
+	condorCommandDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "condor_command_duration_seconds",
+			Help:      "The time taken to run condor_submit, condor_rm, condor_release and condor_q.",
+			Buckets:   prometheus.ExponentialBuckets(0.05, 2, 12),
+		},
+		[]string{"command", "result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		launchesTotal,
+		stopsTotal,
+		heldJobsKilledTotal,
+		heldJobsKilledLastSweep,
+		heldJobActionsTotal,
+		submissionDirsCleanedTotal,
+		delayedLaunchRetriesTotal,
+		deadLettersTotal,
+		quotaExceededTotal,
+		jobStatusChangesTotal,
+		jobEventsTotal,
+		submitQueueLength,
+		submitWaitSeconds,
+		submitsInFlight,
+		deliveryRejectsTotal,
+		condorCommandDuration,
+	)
+}
+
+// resultLabel returns the value of the result label for an operation that
+// returned err.
+func resultLabel(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// launchResult returns the value of the result label for a launch that
+// returned err. Launches deferred by the quota policy or interrupted by
+// shutdown will be tried again, so they aren't counted as failures.
+func (cl *CondorLauncher) launchResult(err error) string {
+	switch {
+	case cl.quotaDeferred(err):
+		return "deferred"
+	case interrupted(err):
+		return "interrupted"
+	default:
+		return resultLabel(err)
+	}
+}
+
+// observeCondorCommand records the execution time of a condor command that
+// was started at start and returned err.
+func observeCondorCommand(command string, start time.Time, err error) {
+	condorCommandDuration.WithLabelValues(command, resultLabel(err)).Observe(time.Since(start).Seconds())
+}
+
+// observeReject counts a rejected AMQP delivery.
+func observeReject(requeue bool) {
+	deliveryRejectsTotal.WithLabelValues(strconv.FormatBool(requeue)).Inc()
+}
+
+// instrumentedScheduler wraps a Scheduler, recording the execution time of
+// each operation under the name of the equivalent condor command.
+type instrumentedScheduler struct {
+	Scheduler
+}
+
+func (s *instrumentedScheduler) Submit(submissionPath string) (string, []byte, error) {
+	start := time.Now()
+	id, output, err := s.Scheduler.Submit(submissionPath)
+	observeCondorCommand("condor_submit", start, err)
+	return id, output, err
+}
+
+func (s *instrumentedScheduler) Remove(invocationID string) ([]byte, error) {
+	start := time.Now()
+	output, err := s.Scheduler.Remove(invocationID)
+	observeCondorCommand("condor_rm", start, err)
+	return output, err
+}
+
+func (s *instrumentedScheduler) RemoveCluster(clusterID string) ([]byte, error) {
+	start := time.Now()
+	output, err := s.Scheduler.RemoveCluster(clusterID)
+	observeCondorCommand("condor_rm", start, err)
+	return output, err
+}
+
+func (s *instrumentedScheduler) Release(clusterID string) ([]byte, error) {
+	start := time.Now()
+	output, err := s.Scheduler.Release(clusterID)
+	observeCondorCommand("condor_release", start, err)
+	return output, err
+}
+
+func (s *instrumentedScheduler) QueryHeld() ([]HeldJob, error) {
+	start := time.Now()
+	jobs, err := s.Scheduler.QueryHeld()
+	observeCondorCommand("condor_q", start, err)
+	return jobs, err
+}
+
+func (s *instrumentedScheduler) Query(constraint string, attrs ...string) ([]JobAd, error) {
+	start := time.Now()
+	ads, err := s.Scheduler.Query(constraint, attrs...)
+	observeCondorCommand("condor_q", start, err)
+	return ads, err
+}
+
+func (s *instrumentedScheduler) History(constraint string, attrs ...string) ([]JobAd, error) {
+	start := time.Now()
+	ads, err := s.Scheduler.History(constraint, attrs...)
+	observeCondorCommand("condor_history", start, err)
+	return ads, err
+}
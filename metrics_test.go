@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cyverse-de/condor-launcher/test"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLaunchMetrics(t *testing.T) {
+	cl, scheduler, _ := newTestLauncher(t)
+	successes := testutil.ToFloat64(launchesTotal.WithLabelValues("condor", "success"))
+	failures := testutil.ToFloat64(launchesTotal.WithLabelValues("condor", "failure"))
+
+	cl.handleLaunchRequests()(launchDelivery(t, cl, false))
+	if actual := testutil.ToFloat64(launchesTotal.WithLabelValues("condor", "success")); actual != successes+1 {
+		t.Errorf("launch successes was %f instead of %f", actual, successes+1)
+	}
+
+	cl, scheduler, _ = newTestLauncher(t)
+	cl.delayedRetries.MaxRetries = 0
+	scheduler.submitErr = errors.New("schedd unavailable")
+	rejects := testutil.ToFloat64(deliveryRejectsTotal.WithLabelValues("true"))
+	cl.handleLaunchRequests()(launchDelivery(t, cl, false))
+	if actual := testutil.ToFloat64(launchesTotal.WithLabelValues("condor", "failure")); actual != failures+1 {
+		t.Errorf("launch failures was %f instead of %f", actual, failures+1)
+	}
+	if actual := testutil.ToFloat64(deliveryRejectsTotal.WithLabelValues("true")); actual != rejects+1 {
+		t.Errorf("requeued rejects was %f instead of %f", actual, rejects+1)
+	}
+}
+
+func TestLaunchResult(t *testing.T) {
+	cl, _, _ := newTestLauncher(t)
+	tests := []struct {
+		err      error
+		expected string
+	}{
+		{nil, "success"},
+		{transientError("submit", errors.New("schedd unavailable")), "failure"},
+		{permanentError("quota", &QuotaExceededError{User: "ipcdev", Active: 1, Limit: 1}), "deferred"},
+		{transientError("submit", errShuttingDown), "interrupted"},
+	}
+	for _, tt := range tests {
+		if actual := cl.launchResult(tt.err); actual != tt.expected {
+			t.Errorf("result for %v was %s instead of %s", tt.err, actual, tt.expected)
+		}
+	}
+
+	cl.quotas.OnExceeded = QuotaFail
+	if actual := cl.launchResult(permanentError("quota", &QuotaExceededError{User: "ipcdev", Active: 1, Limit: 1})); actual != "failure" {
+		t.Errorf("result for a failed quota check was %s instead of failure", actual)
+	}
+}
+
+func TestHeldJobMetrics(t *testing.T) {
+	cl, scheduler, _ := newTestLauncher(t)
+	scheduler.held = []HeldJob{
+		{InvocationID: "63c5523d-d8a5-49bc-addc-99a73566cd89", ClusterID: "10000"},
+		{InvocationID: "eca67a7c-e745-4e98-b892-67a9948bc2cb", ClusterID: "10001"},
+	}
+	total := testutil.ToFloat64(heldJobsKilledTotal)
+
+	sweepHeldJobs(cl)
+	if actual := testutil.ToFloat64(heldJobsKilledTotal); actual != total+2 {
+		t.Errorf("held jobs killed was %f instead of %f", actual, total+2)
+	}
+	if actual := testutil.ToFloat64(heldJobsKilledLastSweep); actual != 2 {
+		t.Errorf("held jobs killed in the last sweep was %f instead of 2", actual)
+	}
+}
+
+func TestInstrumentedScheduler(t *testing.T) {
+	s := &instrumentedScheduler{newtsched()}
+	if _, err := s.Remove("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.QueryHeld(); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.CollectAndCount(condorCommandDuration); n < 2 {
+		t.Errorf("found %d condor command series instead of at least 2", n)
+	}
+}
+
+func TestAdminMetrics(t *testing.T) {
+	cl, _, _ := newTestLauncherWith(t, adminFixture())
+	srv := startTestAdmin(t, cl)
+	status, body := adminRequest(t, http.MethodGet, srv.URL+"/metrics")
+	if status != http.StatusOK {
+		t.Fatalf("status was %d", status)
+	}
+	if !strings.Contains(body, "condor_launcher_") {
+		t.Error("the metrics endpoint did not expose the condor-launcher metrics")
+	}
+}
+
+func TestMetricsServer(t *testing.T) {
+	cfg := test.InitConfig(t)
+	if srv := newMetricsServer(cfg); srv != nil {
+		t.Fatalf("returned a metrics server listening on %s without metrics.listen_port", srv.Addr)
+	}
+
+	cfg.Set("metrics.listen_port", 9100)
+	if srv := newMetricsServer(cfg); srv == nil || srv.Addr != "127.0.0.1:9100" {
+		t.Fatalf("unexpected metrics server %+v", srv)
+	}
+	cfg.Set("metrics.listen_address", "0.0.0.0")
+	metricsServer := newMetricsServer(cfg)
+	if metricsServer == nil || metricsServer.Addr != "0.0.0.0:9100" {
+		t.Fatalf("unexpected metrics server %+v", metricsServer)
+	}
+	srv := httptest.NewServer(metricsServer.Handler)
+	t.Cleanup(srv.Close)
+
+	status, body := adminRequest(t, http.MethodGet, srv.URL+"/metrics")
+	if status != http.StatusOK || !strings.Contains(body, "condor_launcher_") {
+		t.Errorf("metrics request returned %d", status)
+	}
+	if status, _ = adminRequest(t, http.MethodGet, srv.URL+"/jobs"); status != http.StatusNotFound {
+		t.Errorf("the metrics server served the admin API with status %d", status)
+	}
+}
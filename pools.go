@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"gopkg.in/cyverse-de/model.v4"
+)
+
+// defaultPoolName is the name of the pool built from the top-level condor
+// settings when condor.pools isn't set.
+const defaultPoolName = "default"
+
+// Pool is an HTCondor pool that jobs can be launched on.
+type Pool struct {
+	Name      string
+	Scheduler Scheduler
+
+	// limiter limits the rate and concurrency of submissions to the pool's
+	// schedd.
+	limiter *SubmitLimiter
+
+	// cfg is a copy of the configuration with the pool's condor and irods
+	// settings applied. It's used to generate the job's submission files.
+	cfg *viper.Viper
+}
+
+// poolConfig is a single entry in condor.pools. Empty settings fall back to
+// the top-level condor and irods settings.
+type poolConfig struct {
+	Name         string            `mapstructure:"name"`
+	CondorConfig string            `mapstructure:"condor_config"`
+	PathEnvVar   string            `mapstructure:"path_env_var"`
+	Backend      string            `mapstructure:"backend"`
+	RESTBaseURL  string            `mapstructure:"rest_base_url"`
+	Schedd       string            `mapstructure:"schedd"`
+	IRODS        map[string]string `mapstructure:"irods"`
+}
+
+// poolRoute is a single entry in condor.routes. A job matches the route if
+// it matches every setting that isn't empty.
+type poolRoute struct {
+	Pool            string `mapstructure:"pool"`
+	ExecutionTarget string `mapstructure:"execution_target"`
+	UserGroup       string `mapstructure:"user_group"`
+	AppID           string `mapstructure:"app_id"`
+}
+
+// matches returns true if the job matches the route.
+func (r *poolRoute) matches(job *model.Job) bool {
+	if r.ExecutionTarget != "" && r.ExecutionTarget != job.ExecutionTarget {
+		return false
+	}
+	if r.AppID != "" && r.AppID != job.AppID {
+		return false
+	}
+	if r.UserGroup != "" {
+		found := false
+		for _, group := range job.UserGroups {
+			if group == r.UserGroup {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Pools is the set of HTCondor pools that the launcher submits jobs to, along
+// with the rules used to pick a pool for each job. It's configured with the
+// condor.pools and condor.routes settings, for example:
+//
+//	condor:
+//	  default_pool: main
+//	  pools:
+//	    - name: main
+//	      condor_config: /etc/condor/condor_config
+//	      path_env_var: /usr/bin:/bin
+//	    - name: gpu
+//	      condor_config: /etc/condor-gpu/condor_config
+//	      path_env_var: /opt/condor-gpu/bin:/usr/bin:/bin
+//	      irods:
+//	        host: data.example.org
+//	  routes:
+//	    - pool: gpu
+//	      user_group: gpu-users
+//
+// The first matching route wins. Jobs that don't match any route go to the
+// default pool, which is the first pool unless condor.default_pool is set.
+// When condor.pools isn't set, a single pool is built from the top-level
+// condor settings.
+type Pools struct {
+	pools       []*Pool
+	byName      map[string]*Pool
+	routes      []poolRoute
+	defaultPool *Pool
+}
+
+// NewPools returns a new *Pools based on the configuration, using
+// newScheduler to create the scheduler for each pool.
+func NewPools(cfg *viper.Viper, newScheduler func(*viper.Viper) (Scheduler, error)) (*Pools, error) {
+	var configs []poolConfig
+	if err := cfg.UnmarshalKey("condor.pools", &configs); err != nil {
+		return nil, errors.Wrap(err, "failed to parse condor.pools")
+	}
+	if len(configs) == 0 {
+		configs = []poolConfig{{Name: defaultPoolName}}
+	}
+
+	p := &Pools{byName: make(map[string]*Pool)}
+	for _, pc := range configs {
+		if pc.Name == "" {
+			return nil, errors.New("every entry in condor.pools must have a name")
+		}
+		if _, ok := p.byName[pc.Name]; ok {
+			return nil, fmt.Errorf("duplicate pool name %s", pc.Name)
+		}
+
+		poolCfg := pc.apply(cfg)
+		scheduler, err := newScheduler(poolCfg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to set up the scheduler for pool %s", pc.Name)
+		}
+
+		limiter, err := NewSubmitLimiter(poolCfg)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := &Pool{Name: pc.Name, Scheduler: scheduler, limiter: limiter, cfg: poolCfg}
+		p.pools = append(p.pools, pool)
+		p.byName[pool.Name] = pool
+	}
+
+	p.defaultPool = p.pools[0]
+	if name := cfg.GetString("condor.default_pool"); name != "" {
+		if p.defaultPool = p.byName[name]; p.defaultPool == nil {
+			return nil, fmt.Errorf("the default pool %s is not defined in condor.pools", name)
+		}
+	}
+
+	if err := cfg.UnmarshalKey("condor.routes", &p.routes); err != nil {
+		return nil, errors.Wrap(err, "failed to parse condor.routes")
+	}
+	for _, route := range p.routes {
+		if _, ok := p.byName[route.Pool]; !ok {
+			return nil, fmt.Errorf("condor.routes refers to undefined pool %s", route.Pool)
+		}
+	}
+
+	return p, nil
+}
+
+// SinglePool returns a *Pools containing a single default pool that uses the
+// given scheduler without limiting submissions.
+func SinglePool(cfg *viper.Viper, scheduler Scheduler) *Pools {
+	pool := &Pool{Name: defaultPoolName, Scheduler: scheduler, limiter: DefaultSubmitLimiter(), cfg: cfg}
+	return &Pools{
+		pools:       []*Pool{pool},
+		byName:      map[string]*Pool{pool.Name: pool},
+		defaultPool: pool,
+	}
+}
+
+// apply returns a copy of the configuration with the pool's settings applied.
+func (pc *poolConfig) apply(cfg *viper.Viper) *viper.Viper {
+	poolCfg := CopyConfig(cfg)
+	overrides := map[string]string{
+		"condor.condor_config": pc.CondorConfig,
+		"condor.path_env_var":  pc.PathEnvVar,
+		"condor.backend":       pc.Backend,
+		"condor.rest.base_url": pc.RESTBaseURL,
+		"condor.schedd":        pc.Schedd,
+	}
+	for k, v := range pc.IRODS {
+		overrides[fmt.Sprintf("irods.%s", k)] = v
+	}
+	for k, v := range overrides {
+		if v != "" {
+			poolCfg.Set(k, v)
+		}
+	}
+	return poolCfg
+}
+
+// Route returns the pool that the job should be launched on.
+func (p *Pools) Route(job *model.Job) *Pool {
+	for _, route := range p.routes {
+		if route.matches(job) {
+			return p.byName[route.Pool]
+		}
+	}
+	return p.defaultPool
+}
+
+// Get returns the named pool. The default pool is returned for an empty name,
+// which is what launches recorded before pools were introduced contain.
+func (p *Pools) Get(name string) *Pool {
+	if name == "" {
+		return p.defaultPool
+	}
+	return p.byName[name]
+}
+
+// All returns every pool.
+func (p *Pools) All() []*Pool {
+	return p.pools
+}
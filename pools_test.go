@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cyverse-de/condor-launcher/test"
+	"github.com/cyverse-de/configurate"
+	"github.com/spf13/viper"
+	"gopkg.in/cyverse-de/model.v4"
+)
+
+// poolsConfig is appended to the condor section of the test configuration.
+const poolsConfig = `
+  default_pool: main
+  pools:
+    - name: main
+    - name: gpu
+      condor_config: /etc/condor-gpu/condor_config
+      path_env_var: /opt/condor-gpu/bin
+      irods:
+        host: gpu-data.example.org
+    - name: interactive
+      backend: rest
+      rest_base_url: http://schedd.example.org:8080
+      schedd: interactive-schedd
+  routes:
+    - pool: interactive
+      execution_target: interapps
+    - pool: gpu
+      user_group: gpu-users
+    - pool: gpu
+      app_id: c7f05682-23c8-4182-b9a2-e09650a5f49b
+`
+
+// initPoolsConfig returns the test configuration with the pools defined.
+func initPoolsConfig(t *testing.T) *viper.Viper {
+	base, err := os.ReadFile("test/test_config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfgPath := path.Join(t.TempDir(), "config.yaml")
+	if err = os.WriteFile(cfgPath, append(base, []byte(poolsConfig)...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := configurate.InitDefaults(cfgPath, configurate.JobServicesDefaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// newTestPools returns pools for the configuration that use a separate tsched
+// for each pool.
+func newTestPools(t *testing.T, cfg *viper.Viper) (*Pools, map[string]*tsched) {
+	pools, err := NewPools(cfg, func(*viper.Viper) (Scheduler, error) { return newtsched(), nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pools, testSchedulers(pools)
+}
+
+// testSchedulers returns the tsched for each pool, by pool name.
+func testSchedulers(pools *Pools) map[string]*tsched {
+	named := make(map[string]*tsched)
+	for _, pool := range pools.All() {
+		named[pool.Name] = pool.Scheduler.(*tsched)
+	}
+	return named
+}
+
+func TestNewPools(t *testing.T) {
+	pools, _ := newTestPools(t, initPoolsConfig(t))
+
+	var names []string
+	for _, pool := range pools.All() {
+		names = append(names, pool.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"main", "gpu", "interactive"}) {
+		t.Errorf("pools were %v", names)
+	}
+
+	main, gpu, interactive := pools.Get("main"), pools.Get("gpu"), pools.Get("interactive")
+	if actual := main.cfg.GetString("condor.condor_config"); actual != "/etc/condor/condor_config" {
+		t.Errorf("main pool condor_config was %s", actual)
+	}
+	if actual := gpu.cfg.GetString("condor.condor_config"); actual != "/etc/condor-gpu/condor_config" {
+		t.Errorf("gpu pool condor_config was %s", actual)
+	}
+	if actual := gpu.cfg.GetString("condor.path_env_var"); actual != "/opt/condor-gpu/bin" {
+		t.Errorf("gpu pool path_env_var was %s", actual)
+	}
+	if actual := gpu.cfg.GetString("irods.host"); actual != "gpu-data.example.org" {
+		t.Errorf("gpu pool irods.host was %s", actual)
+	}
+	if actual := gpu.cfg.GetString("irods.zone"); actual != "iplant" {
+		t.Errorf("gpu pool irods.zone was %s instead of the top-level setting", actual)
+	}
+	if actual := interactive.cfg.GetString("condor.schedd"); actual != "interactive-schedd" {
+		t.Errorf("interactive pool schedd was %s", actual)
+	}
+	if pools.Get("") != main {
+		t.Error("the default pool was not returned for an empty name")
+	}
+}
+
+func TestNewPoolsDefault(t *testing.T) {
+	pools, _ := newTestPools(t, test.InitConfig(t))
+	if len(pools.All()) != 1 || pools.All()[0].Name != defaultPoolName {
+		t.Fatalf("pools were %v instead of a single default pool", pools.All())
+	}
+	if actual := pools.All()[0].cfg.GetString("condor.condor_config"); actual != "/condor/config" {
+		t.Errorf("default pool condor_config was %s", actual)
+	}
+}
+
+func TestNewPoolsErrors(t *testing.T) {
+	tests := map[string]func(cfg *viper.Viper){
+		"undefined default pool": func(cfg *viper.Viper) { cfg.Set("condor.default_pool", "missing") },
+		"undefined route pool": func(cfg *viper.Viper) {
+			cfg.Set("condor.routes", []map[string]interface{}{{"pool": "missing", "execution_target": "condor"}})
+		},
+		"duplicate pool": func(cfg *viper.Viper) {
+			cfg.Set("condor.pools", []map[string]interface{}{{"name": "main"}, {"name": "main"}})
+		},
+		"unnamed pool": func(cfg *viper.Viper) {
+			cfg.Set("condor.pools", []map[string]interface{}{{"condor_config": "/etc/condor/condor_config"}})
+		},
+		"invalid submit limits": func(cfg *viper.Viper) { cfg.Set("condor.submit_limits.max_concurrent", -1) },
+	}
+	for name, setup := range tests {
+		cfg := initPoolsConfig(t)
+		setup(cfg)
+		if _, err := NewPools(cfg, func(*viper.Viper) (Scheduler, error) { return newtsched(), nil }); err == nil {
+			t.Errorf("%s: NewPools did not return an error", name)
+		}
+	}
+}
+
+func TestPoolsRoute(t *testing.T) {
+	pools, _ := newTestPools(t, initPoolsConfig(t))
+
+	tests := []struct {
+		job      *model.Job
+		expected string
+	}{
+		{&model.Job{ExecutionTarget: "condor"}, "main"},
+		{&model.Job{ExecutionTarget: "interapps", UserGroups: []string{"gpu-users"}}, "interactive"},
+		{&model.Job{ExecutionTarget: "condor", UserGroups: []string{"de-users", "gpu-users"}}, "gpu"},
+		{&model.Job{ExecutionTarget: "condor", AppID: "c7f05682-23c8-4182-b9a2-e09650a5f49b"}, "gpu"},
+	}
+	for _, tt := range tests {
+		if actual := pools.Route(tt.job).Name; actual != tt.expected {
+			t.Errorf("job %+v was routed to %s instead of %s", tt.job, actual, tt.expected)
+		}
+	}
+}
+
+func TestLaunchRoutesToPool(t *testing.T) {
+	cl, _, _ := newTestLauncherWith(t, launcherFixture{cfg: initPoolsConfig(t)})
+	schedulers := testSchedulers(cl.pools)
+	j := testJob(t, cl)
+	j.UserGroups = append(j.UserGroups, "gpu-users")
+
+	if _, err := cl.launch(j); err != nil {
+		t.Fatal(err)
+	}
+	if len(schedulers["gpu"].submitted) != 1 || len(schedulers["main"].submitted) != 0 {
+		t.Fatalf("submitted %v to gpu and %v to main", schedulers["gpu"].submitted, schedulers["main"].submitted)
+	}
+	irodsConfig, err := cl.fs.ReadFile(path.Join(submissionDir(j), "irods-config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(irodsConfig), "gpu-data.example.org") {
+		t.Errorf("the irods config did not use the gpu pool settings:\n%s", irodsConfig)
+	}
+
+	record, err := cl.ledger.Lookup(j.InvocationID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Pool != "gpu" {
+		t.Errorf("recorded pool %s instead of gpu", record.Pool)
+	}
+
+	if err = cl.stopJob(j.InvocationID); err != nil {
+		t.Fatal(err)
+	}
+	if len(schedulers["gpu"].clusters) != 1 || len(schedulers["main"].clusters) != 0 {
+		t.Errorf("removed %v from gpu and %v from main", schedulers["gpu"].clusters, schedulers["main"].clusters)
+	}
+}
+
+func TestStopJobFansOutToPools(t *testing.T) {
+	cl, _, client := newTestLauncherWith(t, launcherFixture{cfg: initPoolsConfig(t)})
+	schedulers := testSchedulers(cl.pools)
+	if err := cl.stopJob("unknown"); err != nil {
+		t.Fatal(err)
+	}
+	for name, s := range schedulers {
+		if len(s.removed) != 1 || s.removed[0] != "unknown" {
+			t.Errorf("removed %v from pool %s", s.removed, name)
+		}
+	}
+	if len(client.updates) != 1 {
+		t.Errorf("published %d updates instead of 1", len(client.updates))
+	}
+}
+
+func TestSweepHeldJobsFansOutToPools(t *testing.T) {
+	cl, _, _ := newTestLauncherWith(t, launcherFixture{cfg: initPoolsConfig(t)})
+	schedulers := testSchedulers(cl.pools)
+	cl.heldPolicy.Rules[13] = HeldRule{Code: 13, Action: HeldActionRelease, MaxReleases: 1}
+	for name, s := range schedulers {
+		s.held = []HeldJob{{InvocationID: fmt.Sprintf("%s-job", name), ClusterID: name, HoldReasonCode: 13, NumHolds: 1}}
+	}
+
+	sweepHeldJobs(cl)
+	for name, s := range schedulers {
+		if !reflect.DeepEqual(s.released, []string{name}) {
+			t.Errorf("released %v in pool %s instead of [%s]", s.released, name, name)
+		}
+	}
+}
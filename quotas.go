@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"gopkg.in/cyverse-de/messaging.v6"
+	"gopkg.in/cyverse-de/model.v4"
+)
+
+// Where the quota policy counts active jobs.
+const (
+	// QuotaCountLedger counts the jobs in the launch ledger that haven't
+	// finished, as recorded by the status poller or the event log.
+	QuotaCountLedger = "ledger"
+
+	// QuotaCountQueue counts the jobs in the queue of every pool.
+	QuotaCountQueue = "queue"
+)
+
+// What to do with a launch request that would exceed a quota.
+const (
+	// QuotaDefer publishes the request to a delay queue so that it's tried
+	// again once the delay has passed.
+	QuotaDefer = "defer"
+
+	// QuotaFail fails the launch and tells the user that their quota was
+	// exceeded.
+	QuotaFail = "fail"
+)
+
+const (
+	// defaultQuotaDeferDelay is how long a launch request that would exceed a
+	// quota is deferred for when condor.quotas.defer_delay isn't set.
+	defaultQuotaDeferDelay = 5 * time.Minute
+
+	// defaultMaxDeferrals is how many times a launch request is deferred
+	// before it fails when condor.quotas.max_deferrals isn't set.
+	defaultMaxDeferrals = 12
+)
+
+// activeJobsConstraint matches the jobs submitted by condor-launcher that
+// haven't been removed or completed.
+const activeJobsConstraint = "IpcUuid =!= undefined && JobStatus =!= 3 && JobStatus =!= 4"
+
+// UserQuota overrides the per-user limit for a single user.
+type UserQuota struct {
+	User    string `mapstructure:"user"`
+	MaxJobs int    `mapstructure:"max_jobs"`
+}
+
+// QuotaPolicy limits how many jobs can be active at once, both for each user
+// and across all users. It's configured with the condor.quotas settings, for
+// example:
+//
+//	condor:
+//	  quotas:
+//	    enabled: true
+//	    count_from: ledger
+//	    max_jobs: 2000
+//	    max_jobs_per_user: 100
+//	    users:
+//	      - user: ipcdev
+//	        max_jobs: 500
+//	    on_exceeded: defer
+//	    defer_delay: 5m
+//	    max_deferrals: 12
+//
+// A limit of 0 means there's no limit. Active jobs are counted from the
+// launch ledger, which needs the status poller or the event log to notice
+// when jobs finish, or from the queue of every pool. Jobs launched in the
+// ledger longer ago than the status poller's lookback period aren't counted.
+// Requests that would exceed a quota are either deferred, without using up
+// any of their delayed retries, or failed. The user is told when a request is
+// first deferred, and the launch fails once it has been deferred
+// max_deferrals times.
+type QuotaPolicy struct {
+	Enabled        bool
+	CountFrom      string
+	MaxJobs        int
+	MaxJobsPerUser int
+	Users          map[string]int // user -> limit, overriding MaxJobsPerUser
+	OnExceeded     string
+	DeferDelay     time.Duration
+	MaxDeferrals   int
+
+	mu      sync.Mutex     // held while checking the quotas
+	pending map[string]int // user -> launches that have passed the check but haven't been recorded
+}
+
+// DefaultQuotaPolicy returns a disabled *QuotaPolicy.
+func DefaultQuotaPolicy() *QuotaPolicy {
+	return &QuotaPolicy{
+		CountFrom:    QuotaCountLedger,
+		Users:        map[string]int{},
+		OnExceeded:   QuotaDefer,
+		DeferDelay:   defaultQuotaDeferDelay,
+		MaxDeferrals: defaultMaxDeferrals,
+		pending:      map[string]int{},
+	}
+}
+
+// NewQuotaPolicy returns a *QuotaPolicy based on the condor.quotas settings.
+func NewQuotaPolicy(cfg *viper.Viper) (*QuotaPolicy, error) {
+	p := DefaultQuotaPolicy()
+	p.Enabled = cfg.GetBool("condor.quotas.enabled")
+
+	if countFrom := cfg.GetString("condor.quotas.count_from"); countFrom != "" {
+		if countFrom != QuotaCountLedger && countFrom != QuotaCountQueue {
+			return nil, fmt.Errorf("invalid condor.quotas.count_from %s", countFrom)
+		}
+		p.CountFrom = countFrom
+	}
+	p.MaxJobs = cfg.GetInt("condor.quotas.max_jobs")
+	p.MaxJobsPerUser = cfg.GetInt("condor.quotas.max_jobs_per_user")
+	if p.MaxJobs < 0 || p.MaxJobsPerUser < 0 {
+		return nil, fmt.Errorf("invalid condor.quotas limits %d and %d", p.MaxJobs, p.MaxJobsPerUser)
+	}
+
+	var users []UserQuota
+	if err := cfg.UnmarshalKey("condor.quotas.users", &users); err != nil {
+		return nil, errors.Wrap(err, "failed to parse condor.quotas.users")
+	}
+	for _, u := range users {
+		if u.User == "" || u.MaxJobs < 0 {
+			return nil, fmt.Errorf("invalid quota of %d jobs for user %q", u.MaxJobs, u.User)
+		}
+		p.Users[u.User] = u.MaxJobs
+	}
+
+	if action := cfg.GetString("condor.quotas.on_exceeded"); action != "" {
+		if action != QuotaDefer && action != QuotaFail {
+			return nil, fmt.Errorf("invalid condor.quotas.on_exceeded %s", action)
+		}
+		p.OnExceeded = action
+	}
+	if d := cfg.GetDuration("condor.quotas.defer_delay"); d > 0 {
+		p.DeferDelay = d
+	}
+	if cfg.IsSet("condor.quotas.max_deferrals") {
+		p.MaxDeferrals = cfg.GetInt("condor.quotas.max_deferrals")
+		if p.MaxDeferrals <= 0 {
+			return nil, fmt.Errorf("invalid condor.quotas.max_deferrals %d", p.MaxDeferrals)
+		}
+	}
+	return p, nil
+}
+
+// checkQuotaPolicy returns an error if the quotas are counted from the launch
+// ledger but nothing records when jobs finish, in which case every job would
+// count against the quotas for the whole lookback period.
+func (cl *CondorLauncher) checkQuotaPolicy() error {
+	q := cl.quotas
+	if q.Enabled && q.CountFrom == QuotaCountLedger && !cl.statusPoller.Enabled && !cl.eventLog.Enabled {
+		return errors.New("condor.quotas.count_from is ledger, which needs condor.status_poller or condor.event_log to be enabled")
+	}
+	return nil
+}
+
+// userLimit returns the most active jobs the user can have, or 0 if there's
+// no limit.
+func (p *QuotaPolicy) userLimit(user string) int {
+	if limit, ok := p.Users[user]; ok {
+		return limit
+	}
+	return p.MaxJobsPerUser
+}
+
+// QuotaExceededError is returned for a launch that would exceed a quota.
+type QuotaExceededError struct {
+	User   string
+	Global bool // true if the limit across all users was exceeded
+	Active int
+	Limit  int
+}
+
+func (e *QuotaExceededError) Error() string {
+	if e.Global {
+		return fmt.Sprintf("quota exceeded: %d jobs are already active, and at most %d are allowed", e.Active, e.Limit)
+	}
+	return fmt.Sprintf("quota exceeded: %s already has %d active jobs, and at most %d are allowed", e.User, e.Active, e.Limit)
+}
+
+// scope returns the value of the scope label for the exceeded quota.
+func (e *QuotaExceededError) scope() string {
+	if e.Global {
+		return "global"
+	}
+	return "user"
+}
+
+// quotaExceeded returns the *QuotaExceededError in err's chain of causes, or
+// nil if there isn't one.
+func quotaExceeded(err error) *QuotaExceededError {
+	if le := findLaunchError(err); le != nil {
+		if qe, ok := le.Err.(*QuotaExceededError); ok {
+			return qe
+		}
+	}
+	return nil
+}
+
+// activeJobs returns the number of active jobs the user has, along with the
+// number of active jobs across all users.
+func (cl *CondorLauncher) activeJobs(user string, now time.Time) (int, int, error) {
+	var userJobs, total int
+	if cl.quotas.CountFrom == QuotaCountQueue {
+		for _, pool := range cl.pools.All() {
+			ads, err := pool.Scheduler.Query(activeJobsConstraint, "IpcUsername")
+			if err != nil {
+				return 0, 0, errors.Wrapf(err, "failed to count the active jobs in pool %s", pool.Name)
+			}
+			for _, ad := range ads {
+				if ad.IpcUsername == user {
+					userJobs++
+				}
+			}
+			total += len(ads)
+		}
+		return userJobs, total, nil
+	}
+
+	records, err := cl.ledger.Since(now.Add(-cl.statusPoller.Lookback))
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, r := range records {
+		if r.ClusterID == "" || terminalJobStatus(r.Status) {
+			continue
+		}
+		if r.Submitter == user {
+			userJobs++
+		}
+		total++
+	}
+	return userJobs, total, nil
+}
+
+// reserveQuota checks that launching the job won't exceed the user's quota or
+// the global quota. If it won't, the launch is counted as active until the
+// returned function is called, which should happen once the launch has been
+// recorded or has failed. Launches that would exceed a quota fail with a
+// permanent *QuotaExceededError so that the quota policy decides whether
+// they're deferred instead of the delayed retry policy.
+//
+// The active jobs are counted with the lock held, so that a launch that's
+// recorded and released during another launch's check is counted exactly
+// once, either in the ledger or the queue or as pending.
+func (cl *CondorLauncher) reserveQuota(s *model.Job) (func(), error) {
+	q := cl.quotas
+	if !q.Enabled {
+		return func() {}, nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	userJobs, total, err := cl.activeJobs(s.Submitter, time.Now())
+	if err != nil {
+		return nil, transientError("quota", err)
+	}
+
+	pendingTotal := 0
+	for _, n := range q.pending {
+		pendingTotal += n
+	}
+	userJobs += q.pending[s.Submitter]
+	total += pendingTotal
+
+	var qe *QuotaExceededError
+	if limit := q.userLimit(s.Submitter); limit > 0 && userJobs >= limit {
+		qe = &QuotaExceededError{User: s.Submitter, Active: userJobs, Limit: limit}
+	} else if q.MaxJobs > 0 && total >= q.MaxJobs {
+		qe = &QuotaExceededError{User: s.Submitter, Global: true, Active: total, Limit: q.MaxJobs}
+	}
+	if qe != nil {
+		quotaExceededTotal.WithLabelValues(qe.scope(), q.OnExceeded).Inc()
+		return nil, permanentError("quota", qe)
+	}
+
+	q.pending[s.Submitter]++
+	return func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if q.pending[s.Submitter]--; q.pending[s.Submitter] <= 0 {
+			delete(q.pending, s.Submitter)
+		}
+	}, nil
+}
+
+// quotaDeferred returns true if the launch failed because it would exceed a
+// quota and the quota policy defers such launches.
+func (cl *CondorLauncher) quotaDeferred(err error) bool {
+	return cl.quotas.OnExceeded == QuotaDefer && quotaExceeded(err) != nil
+}
+
+// deferLaunch publishes the launch request to the delay queue to be tried
+// again after the quota policy's delay, as the given deferral, counting from
+// 1. The number of delayed retries made for the request is left as it is. The
+// user is told that the job is waiting when it's first deferred.
+func (cl *CondorLauncher) deferLaunch(body []byte, retries, deferral int, err error) error {
+	log.Infof("Deferring the launch request for %s (deferral %d of %d): %s", cl.quotas.DeferDelay, deferral, cl.quotas.MaxDeferrals, err)
+	if perr := cl.client.PublishDelayed(launchesQueue, body, delayHeaders(retries, deferral), cl.quotas.DeferDelay); perr != nil {
+		return errors.Wrap(perr, "failed to defer the launch request")
+	}
+	if job := launchRequestJob(body); job != nil && deferral == 1 {
+		perr := cl.client.PublishJobUpdate(&messaging.UpdateMessage{
+			Job:     job,
+			State:   messaging.QueuedState,
+			Message: fmt.Sprintf("Waiting to launch the job, %s", quotaExceeded(err)),
+		})
+		if perr != nil {
+			log.Errorf("%+v\n", errors.Wrap(perr, "failed to publish the deferred launch job update"))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/condor-launcher/test"
+	"gopkg.in/cyverse-de/messaging.v6"
+)
+
+func TestNewQuotaPolicy(t *testing.T) {
+	cfg := test.InitConfig(t)
+	p, err := NewQuotaPolicy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Enabled || p.CountFrom != QuotaCountLedger || p.OnExceeded != QuotaDefer || p.DeferDelay != defaultQuotaDeferDelay {
+		t.Errorf("unexpected default quota policy %#v", p)
+	}
+
+	cfg.Set("condor.quotas.enabled", true)
+	cfg.Set("condor.quotas.count_from", "queue")
+	cfg.Set("condor.quotas.max_jobs", 2000)
+	cfg.Set("condor.quotas.max_jobs_per_user", 100)
+	cfg.Set("condor.quotas.users", []map[string]interface{}{{"user": "ipcdev", "max_jobs": 500}})
+	cfg.Set("condor.quotas.on_exceeded", "fail")
+	cfg.Set("condor.quotas.defer_delay", "1m")
+	cfg.Set("condor.quotas.max_deferrals", 3)
+	if p, err = NewQuotaPolicy(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !p.Enabled || p.CountFrom != QuotaCountQueue || p.MaxJobs != 2000 || p.OnExceeded != QuotaFail || p.DeferDelay != time.Minute || p.MaxDeferrals != 3 {
+		t.Errorf("unexpected quota policy %#v", p)
+	}
+	if p.userLimit("ipcdev") != 500 || p.userLimit("someone") != 100 {
+		t.Errorf("unexpected user limits %v", p.Users)
+	}
+
+	for key, value := range map[string]interface{}{
+		"condor.quotas.count_from":    "condor_q",
+		"condor.quotas.on_exceeded":   "drop",
+		"condor.quotas.max_jobs":      -1,
+		"condor.quotas.max_deferrals": 0,
+	} {
+		cfg := test.InitConfig(t)
+		cfg.Set(key, value)
+		if _, err = NewQuotaPolicy(cfg); err == nil {
+			t.Errorf("NewQuotaPolicy accepted %s %v", key, value)
+		}
+	}
+}
+
+// recordActiveJobs adds n jobs that haven't finished for the user to the
+// ledger.
+func recordActiveJobs(t *testing.T, cl *CondorLauncher, user string, n int) {
+	for i := 0; i < n; i++ {
+		err := cl.ledger.Record(&LaunchRecord{
+			InvocationID: fmt.Sprintf("%s-%d", user, i),
+			ClusterID:    fmt.Sprintf("%d", 20000+i),
+			SubmittedAt:  time.Now(),
+			Submitter:    user,
+			Status:       JobStatusRunning,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHandleLaunchRequestsDefersOverUserQuota(t *testing.T) {
+	cl, scheduler, client := newTestLauncher(t)
+	cl.quotas.Enabled = true
+	cl.quotas.MaxJobsPerUser = 2
+	user := testJob(t, cl).Submitter
+	recordActiveJobs(t, cl, user, 2)
+	recordActiveJobs(t, cl, "someone-else", 5)
+
+	cl.handleLaunchRequests()(retryDelivery(t, cl, 2))
+	if len(scheduler.submitted) != 0 {
+		t.Errorf("submitted %v over the user's quota", scheduler.submitted)
+	}
+	if len(client.delayed) != 1 {
+		t.Fatalf("scheduled %d deferrals instead of 1", len(client.delayed))
+	}
+	if d := client.delayed[0]; d.retries != 2 || d.deferrals != 1 || d.delay != defaultQuotaDeferDelay {
+		t.Errorf("unexpected deferral %+v", d)
+	}
+	if len(client.updates) != 1 || client.updates[0].State != messaging.QueuedState {
+		t.Fatalf("published %v instead of a single queued update for a deferred launch", client.updates)
+	}
+
+	// The user is only told the first time the launch is deferred.
+	delivery := retryDelivery(t, cl, 2)
+	delivery.Headers = delayHeaders(2, 1)
+	cl.handleLaunchRequests()(delivery)
+	if len(client.delayed) != 2 || client.delayed[1].deferrals != 2 || len(client.updates) != 1 {
+		t.Errorf("unexpected second deferral %+v with updates %v", client.delayed[1:], client.updates)
+	}
+
+	// Once one of the user's jobs finishes, the launch goes ahead.
+	record, err := cl.ledger.Lookup(user + "-0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	record.Status = JobStatusCompleted
+	if err = cl.ledger.Record(record); err != nil {
+		t.Fatal(err)
+	}
+	cl.handleLaunchRequests()(delivery)
+	if len(scheduler.submitted) != 1 {
+		t.Errorf("submitted %d jobs instead of 1", len(scheduler.submitted))
+	}
+}
+
+func TestHandleLaunchRequestsFailsOverGlobalQuota(t *testing.T) {
+	cl, scheduler, client := newTestLauncher(t)
+	cl.quotas.Enabled = true
+	cl.quotas.CountFrom = QuotaCountQueue
+	cl.quotas.MaxJobs = 2
+	cl.quotas.OnExceeded = QuotaFail
+	scheduler.queryAds = []JobAd{{IpcUsername: "a"}, {IpcUsername: "b"}}
+
+	cl.handleLaunchRequests()(launchDelivery(t, cl, false))
+	if len(scheduler.submitted) != 0 {
+		t.Errorf("submitted %v over the global quota", scheduler.submitted)
+	}
+	if len(scheduler.queries) != 1 || scheduler.queries[0] != activeJobsConstraint {
+		t.Errorf("unexpected queries %v", scheduler.queries)
+	}
+	if len(client.delayed) != 0 {
+		t.Errorf("deferred %v instead of failing it", client.delayed)
+	}
+	if len(client.updates) != 1 || client.updates[0].State != messaging.FailedState || !strings.Contains(client.updates[0].Message, "quota exceeded") {
+		t.Fatalf("published %v instead of a quota exceeded update", client.updates)
+	}
+}
+
+func TestReserveQuotaCountsPendingLaunches(t *testing.T) {
+	cl, _, _ := newTestLauncher(t)
+	cl.quotas.Enabled = true
+	cl.quotas.MaxJobsPerUser = 1
+	job := testJob(t, cl)
+
+	release, err := cl.reserveQuota(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cl.reserveQuota(job); quotaExceeded(err) == nil {
+		t.Errorf("a second launch while the first was pending returned %v", err)
+	}
+	release()
+	if _, err = cl.reserveQuota(job); err != nil {
+		t.Errorf("a launch after the first was released returned %v", err)
+	}
+}
+
+func TestHandleLaunchRequestsFailsAfterMaxDeferrals(t *testing.T) {
+	cl, scheduler, client := newTestLauncher(t)
+	cl.quotas.Enabled = true
+	cl.quotas.MaxJobs = 1
+	recordActiveJobs(t, cl, "someone-else", 1)
+
+	delivery := launchDelivery(t, cl, false)
+	delivery.Headers = delayHeaders(0, defaultMaxDeferrals)
+	cl.handleLaunchRequests()(delivery)
+	if len(scheduler.submitted) != 0 || len(client.delayed) != 0 {
+		t.Errorf("submitted %v and deferred %v after the last deferral", scheduler.submitted, client.delayed)
+	}
+	if len(client.updates) != 1 || client.updates[0].State != messaging.FailedState || !strings.Contains(client.updates[0].Message, "quota exceeded") {
+		t.Errorf("published %v instead of a quota exceeded update", client.updates)
+	}
+}
+
+func TestCheckQuotaPolicy(t *testing.T) {
+	cl, _, _ := newTestLauncher(t)
+	cl.quotas.Enabled = true
+	if err := cl.checkQuotaPolicy(); err == nil {
+		t.Error("checkQuotaPolicy accepted quotas counted from a ledger that nothing updates")
+	}
+	cl.statusPoller.Enabled = true
+	if err := cl.checkQuotaPolicy(); err != nil {
+		t.Error(err)
+	}
+	cl.statusPoller.Enabled = false
+	cl.quotas.CountFrom = QuotaCountQueue
+	if err := cl.checkQuotaPolicy(); err != nil {
+		t.Error(err)
+	}
+}
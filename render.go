@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/cyverse-de/configurate"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"gopkg.in/cyverse-de/model.v4"
+)
+
+// readJobFile returns the contents of the named job file, reading from stdin
+// if the name is "-".
+func readJobFile(name string, stdin io.Reader) ([]byte, error) {
+	if name == "-" {
+		data, err := io.ReadAll(stdin)
+		return data, errors.Wrap(err, "failed to read the job from stdin")
+	}
+	data, err := os.ReadFile(name)
+	return data, errors.Wrapf(err, "failed to read the job from %s", name)
+}
+
+// submitCommand returns the shell command that would be run to submit the
+// submission file with condor_submit, using the same arguments as CondorCLI.
+func submitCommand(cfg *viper.Viper, submissionPath string) string {
+	return fmt.Sprintf(
+		"cd %s && PATH=%s CONDOR_CONFIG=%s condor_submit %s",
+		path.Dir(submissionPath),
+		cfg.GetString("condor.path_env_var"),
+		cfg.GetString("condor.condor_config"),
+		strings.Join(condorArgs(cfg.GetString("condor.schedd"), path.Base(submissionPath)), " "),
+	)
+}
+
+// renderCommand implements the render subcommand, which writes the submission
+// files for a job to a local directory without submitting the job. Nothing is
+// sent to AMQP or HTCondor. The iRODS config gets a placeholder instead of the
+// iRODS password or a ticket unless --credentials is set, in which case they're
+// looked up or issued just as they are for a launch.
+//
+//	condor-launcher render --config <file> --job <job.json|-> --out <dir> [--credentials]
+func renderCommand(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("render", flag.ContinueOnError)
+	var (
+		cfgPath = flags.String("config", "", "Path to the config file. Required.")
+		jobPath = flags.String("job", "", "Path to the job JSON, or - to read it from stdin. Required.")
+		outDir  = flags.String("out", "", "Directory to write the submission files to. Required.")
+		creds   = flags.Bool("credentials", false, "Look up the iRODS password or issue a ticket instead of writing a placeholder.")
+	)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *cfgPath == "" || *jobPath == "" || *outDir == "" {
+		flags.PrintDefaults()
+		return errors.New("--config, --job and --out must be set")
+	}
+
+	cfg, err := configurate.InitDefaults(*cfgPath, configurate.JobServicesDefaults)
+	if err != nil {
+		return errors.Wrap(err, "failed to initialize configuration defaults")
+	}
+
+	data, err := readJobFile(*jobPath, stdin)
+	if err != nil {
+		return err
+	}
+	job, err := model.NewFromData(cfg, data)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse the job")
+	}
+
+	sdir, err := filepath.Abs(*outDir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get the absolute path to %s", *outDir)
+	}
+
+	// The rendered files replace the output directory, so refuse to clobber
+	// anything that's already there.
+	if entries, err := os.ReadDir(sdir); err == nil && len(entries) > 0 {
+		return fmt.Errorf("the output directory %s is not empty", sdir)
+	}
+
+	// The schedulers aren't needed since nothing is submitted.
+	pools, err := NewPools(cfg, func(*viper.Viper) (Scheduler, error) { return nil, nil })
+	if err != nil {
+		return err
+	}
+	pool := pools.Route(job)
+
+	launcher := New(cfg, nil, &osys{}, pools, nil)
+	launcher.placeholderCredentials = !*creds
+	submissionPath, err := launcher.prepare(job, pool, sdir)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "Wrote the submission files for %s in pool %s to %s\n", job.InvocationID, pool.Name, sdir)
+	fmt.Fprintln(stdout, submitCommand(pool.cfg, submissionPath))
+	return nil
+}
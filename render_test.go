@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestRenderCommand(t *testing.T) {
+	outDir := t.TempDir()
+	var stdout bytes.Buffer
+	args := []string{
+		"--config", "test/test_config.yaml",
+		"--job", "test/test_submission.json",
+		"--out", outDir,
+	}
+	if err := renderCommand(args, nil, &stdout); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"iplant.cmd", "config", "job", "irods-config"} {
+		if _, err := os.Stat(path.Join(outDir, name)); err != nil {
+			t.Errorf("%s was not rendered: %s", name, err)
+		}
+	}
+	contents, err := os.ReadFile(path.Join(outDir, "irods-config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(contents), "porklock.irods-pass = "+placeholderCredential+"\n") {
+		t.Errorf("irods-config did not contain the placeholder password:\n%s", contents)
+	}
+	expected := "cd " + outDir + " && PATH=/usr/bin/:/usr/local/bin/:/bin/ CONDOR_CONFIG=/etc/condor/condor_config condor_submit iplant.cmd"
+	if !strings.Contains(stdout.String(), expected) {
+		t.Errorf("output %q did not contain %q", stdout.String(), expected)
+	}
+}
+
+func TestRenderCommandSchedd(t *testing.T) {
+	base, err := os.ReadFile("test/test_config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pools := `
+  default_pool: main
+  pools:
+    - name: main
+      schedd: schedd.example.org
+`
+	cfgPath := path.Join(t.TempDir(), "config.yaml")
+	if err = os.WriteFile(cfgPath, append(base, []byte(pools)...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout bytes.Buffer
+	args := []string{
+		"--config", cfgPath,
+		"--job", "test/test_submission.json",
+		"--out", t.TempDir(),
+	}
+	if err = renderCommand(args, nil, &stdout); err != nil {
+		t.Fatal(err)
+	}
+	expected := "condor_submit -name schedd.example.org iplant.cmd"
+	if !strings.Contains(stdout.String(), expected) {
+		t.Errorf("output %q did not contain %q", stdout.String(), expected)
+	}
+}
+
+func TestRenderCommandCredentials(t *testing.T) {
+	outDir := t.TempDir()
+	args := []string{
+		"--config", "test/test_config.yaml",
+		"--job", "test/test_submission.json",
+		"--out", outDir,
+		"--credentials",
+	}
+	if err := renderCommand(args, nil, &bytes.Buffer{}); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := os.ReadFile(path.Join(outDir, "irods-config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(contents), "porklock.irods-pass = wut\n") {
+		t.Errorf("irods-config did not contain the configured password:\n%s", contents)
+	}
+}
+
+func TestRenderCommandStdin(t *testing.T) {
+	data, err := os.ReadFile("test/test_submission.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outDir := t.TempDir()
+	args := []string{"--config", "test/test_config.yaml", "--job", "-", "--out", outDir}
+	if err = renderCommand(args, bytes.NewReader(data), &bytes.Buffer{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(path.Join(outDir, "iplant.cmd")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRenderCommandNonEmptyOutput(t *testing.T) {
+	outDir := t.TempDir()
+	if err := os.WriteFile(path.Join(outDir, "notes.txt"), []byte("keep me"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"--config", "test/test_config.yaml", "--job", "test/test_submission.json", "--out", outDir}
+	if err := renderCommand(args, nil, &bytes.Buffer{}); err == nil {
+		t.Error("renderCommand did not return an error for a non-empty output directory")
+	}
+	if _, err := os.Stat(path.Join(outDir, "notes.txt")); err != nil {
+		t.Errorf("the existing file was removed: %s", err)
+	}
+}
+
+func TestRenderCommandRequiresFlags(t *testing.T) {
+	if err := renderCommand([]string{"--job", "test/test_submission.json"}, nil, &bytes.Buffer{}); err == nil {
+		t.Error("renderCommand did not return an error without --config and --out")
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/cyverse-de/configurate"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+	"gopkg.in/cyverse-de/messaging.v6"
+)
+
+// printMessenger is an implementation of Messenger that prints the job status
+// updates that would have been published instead of sending them to AMQP.
+type printMessenger struct {
+	out     io.Writer
+	updates []*messaging.UpdateMessage
+}
+
+func (m *printMessenger) AddConsumer(string, string, string, string, messaging.MessageHandler, int) {}
+func (m *printMessenger) Close()                                                                    {}
+func (m *printMessenger) Listen()                                                                   {}
+func (m *printMessenger) Publish(string, []byte) error                                              { return nil }
+func (m *printMessenger) SetupPublishing(string) error                                              { return nil }
+func (m *printMessenger) DeleteQueue(string) error                                                  { return nil }
+
+func (m *printMessenger) PublishDelayed(queue string, body []byte, headers amqp.Table, delay time.Duration) error {
+	if deferrals := deliveryDeferrals(headers); deferrals > 0 {
+		fmt.Fprintf(m.out, "Deferral %d would have been published to %s after %s\n", deferrals, queue, delay)
+		return nil
+	}
+	fmt.Fprintf(m.out, "Retry %d would have been published to %s after %s\n", deliveryRetries(headers), queue, delay)
+	return nil
+}
+
+func (m *printMessenger) PublishDeadLetter(body []byte, headers amqp.Table) error {
+	fmt.Fprintf(m.out, "The message would have been dead-lettered (%s)\n", headers[deadLetterReasonHeader])
+	return nil
+}
+
+func (m *printMessenger) PublishJobUpdate(u *messaging.UpdateMessage) error {
+	m.updates = append(m.updates, u)
+	msgJSON, err := json.MarshalIndent(u, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal the job update")
+	}
+	fmt.Fprintf(m.out, "Job update that would have been published:\n%s\n", msgJSON)
+	return nil
+}
+
+// printAcknowledger is an amqp.Acknowledger that prints what would have
+// happened to a replayed delivery.
+type printAcknowledger struct {
+	out io.Writer
+}
+
+func (a *printAcknowledger) Ack(tag uint64, multiple bool) error {
+	fmt.Fprintln(a.out, "The launch request would have been acknowledged.")
+	return nil
+}
+
+func (a *printAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	return a.Reject(tag, requeue)
+}
+
+func (a *printAcknowledger) Reject(tag uint64, requeue bool) error {
+	if requeue {
+		fmt.Fprintln(a.out, "The launch request would have been requeued.")
+	} else {
+		fmt.Fprintln(a.out, "The launch request would have been rejected.")
+	}
+	return nil
+}
+
+// replayLaunch runs a launch request through the same code path as the AMQP
+// handler and prints the result.
+func replayLaunch(launcher *CondorLauncher, body []byte, redelivered bool, stdout io.Writer) error {
+	jobID, err := launcher.handleLaunchDelivery(amqp.Delivery{
+		Acknowledger: &printAcknowledger{out: stdout},
+		Body:         body,
+		Redelivered:  redelivered,
+	})
+	if err != nil {
+		return err
+	}
+	if jobID != "" {
+		fmt.Fprintf(stdout, "Condor ID: %s\n", jobID)
+	}
+	return nil
+}
+
+// launchCommand implements the launch subcommand, which replays a launch
+// request read from a file or stdin. The job is submitted with the configured
+// scheduler, but status updates are printed instead of being published.
+//
+//	condor-launcher launch --config <file> --job <request.json|-> [--redelivered] [--ledger <file>]
+func launchCommand(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("launch", flag.ContinueOnError)
+	var (
+		cfgPath     = flags.String("config", "", "Path to the config file. Required.")
+		jobPath     = flags.String("job", "", "Path to the launch request JSON, or - to read it from stdin. Required.")
+		redelivered = flags.Bool("redelivered", false, "Handle the request as if it had been redelivered by the broker.")
+		ledgerPath  = flags.String("ledger", "", "Path to the launch ledger. A temporary ledger is used by default.")
+	)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *cfgPath == "" || *jobPath == "" {
+		flags.PrintDefaults()
+		return errors.New("--config and --job must be set")
+	}
+
+	cfg, err := configurate.InitDefaults(*cfgPath, configurate.JobServicesDefaults)
+	if err != nil {
+		return errors.Wrap(err, "failed to initialize configuration defaults")
+	}
+
+	body, err := readJobFile(*jobPath, stdin)
+	if err != nil {
+		return err
+	}
+
+	fs := &osys{}
+	pools, err := NewPools(cfg, func(cfg *viper.Viper) (Scheduler, error) { return NewScheduler(cfg, fs) })
+	if err != nil {
+		return errors.Wrap(err, "failed to set up the HTCondor pools")
+	}
+
+	if *ledgerPath == "" {
+		dir, err := os.MkdirTemp("", "condor-launcher-")
+		if err != nil {
+			return errors.Wrap(err, "failed to create a temporary ledger directory")
+		}
+		defer os.RemoveAll(dir)
+		*ledgerPath = path.Join(dir, "ledger.db")
+	}
+	ledger, err := NewBoltLedger(*ledgerPath)
+	if err != nil {
+		return err
+	}
+	defer ledger.Close()
+
+	launcher := New(cfg, &printMessenger{out: stdout}, fs, pools, ledger)
+	if err = launcher.configure(cfg); err != nil {
+		return err
+	}
+	return replayLaunch(launcher, body, *redelivered, stdout)
+}
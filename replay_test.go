@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"gopkg.in/cyverse-de/messaging.v6"
+)
+
+func TestReplayLaunch(t *testing.T) {
+	cl, _, _ := newTestLauncher(t)
+	var stdout bytes.Buffer
+	client := &printMessenger{out: &stdout}
+	cl.client = client
+
+	if err := replayLaunch(cl, launchDelivery(t, cl, false).Body, false, &stdout); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stdout.String(), "Condor ID: 10000") {
+		t.Errorf("output %q did not contain the Condor ID", stdout.String())
+	}
+	if len(client.updates) != 1 || client.updates[0].State != messaging.SubmittedState {
+		t.Fatalf("printed updates %v instead of a single submitted update", client.updates)
+	}
+	if !strings.Contains(stdout.String(), "Launched Condor ID 10000") {
+		t.Errorf("output %q did not contain the job update", stdout.String())
+	}
+}
+
+func TestReplayLaunchFailure(t *testing.T) {
+	cl, scheduler, _ := newTestLauncher(t)
+	scheduler.submitErr = errors.New("schedd unavailable")
+	var stdout bytes.Buffer
+	client := &printMessenger{out: &stdout}
+	cl.client = client
+
+	if err := replayLaunch(cl, launchDelivery(t, cl, false).Body, false, &stdout); err == nil {
+		t.Fatal("replayLaunch did not return the launch error")
+	}
+	if len(client.updates) != 0 {
+		t.Errorf("printed %d updates for a request that would have been retried", len(client.updates))
+	}
+	if !strings.Contains(stdout.String(), "Retry 1 would have been published") || !strings.Contains(stdout.String(), "acknowledged") {
+		t.Errorf("output %q did not mention the delayed retry", stdout.String())
+	}
+
+	// Without delayed retries, the request is requeued and then fails.
+	cl.delayedRetries.MaxRetries = 0
+	stdout.Reset()
+	if err := replayLaunch(cl, launchDelivery(t, cl, false).Body, false, &stdout); err == nil {
+		t.Fatal("replayLaunch did not return the launch error")
+	}
+	if len(client.updates) != 0 || !strings.Contains(stdout.String(), "requeued") {
+		t.Errorf("output %q did not mention the requeue", stdout.String())
+	}
+
+	stdout.Reset()
+	if err := replayLaunch(cl, launchDelivery(t, cl, true).Body, true, &stdout); err == nil {
+		t.Fatal("replayLaunch did not return the launch error")
+	}
+	if len(client.updates) != 1 || client.updates[0].State != messaging.FailedState {
+		t.Fatalf("printed updates %v instead of a single failed update", client.updates)
+	}
+	if !strings.Contains(stdout.String(), "schedd unavailable") || !strings.Contains(stdout.String(), "rejected") {
+		t.Errorf("output %q did not contain the failure", stdout.String())
+	}
+}
+
+func TestReplayLaunchInvalidRequest(t *testing.T) {
+	cl, _, _ := newTestLauncher(t)
+	if err := replayLaunch(cl, []byte("{"), true, &bytes.Buffer{}); err == nil {
+		t.Error("replayLaunch did not return an error for an invalid request")
+	}
+}
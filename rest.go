@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CondorREST is an implementation of Scheduler that talks to the HTCondor REST
+// API exposed by a schedd host instead of forking the condor command-line
+// tools.
+type CondorREST struct {
+	baseURL string
+	schedd  string
+	client  *http.Client
+	fs      fsys // used to read the submission files
+}
+
+// restSubmitRequest is the body of a job submission request.
+type restSubmitRequest struct {
+	Submit     string `json:"submit"`
+	InitialDir string `json:"initialdir"`
+}
+
+// restSubmitResponse is the body of the response to a job submission request.
+type restSubmitResponse struct {
+	ClusterID int    `json:"cluster_id"`
+	Message   string `json:"message"`
+}
+
+// restJob is a single entry in the response to a job query.
+type restJob struct {
+	JobID   string `json:"jobid"`
+	ClassAd JobAd  `json:"classad"`
+}
+
+// NewCondorREST returns a new *CondorREST that sends requests for the named
+// schedd to the REST API at baseURL, reading the submission files from fs.
+func NewCondorREST(baseURL, schedd string, timeout time.Duration, fs fsys) *CondorREST {
+	return &CondorREST{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		schedd:  schedd,
+		client:  &http.Client{Timeout: timeout},
+		fs:      fs,
+	}
+}
+
+// jobsURL returns the URL of the jobs collection for the schedd, with the
+// given query parameters.
+func (c *CondorREST) jobsURL(params url.Values) string {
+	return c.collectionURL("jobs", params)
+}
+
+// collectionURL returns the URL of the named collection (jobs or history) for
+// the schedd, with the given query parameters.
+func (c *CondorREST) collectionURL(collection string, params url.Values) string {
+	u := fmt.Sprintf("%s/v1/%s/%s", c.baseURL, collection, url.PathEscape(c.schedd))
+	if len(params) > 0 {
+		u = fmt.Sprintf("%s?%s", u, params.Encode())
+	}
+	return u
+}
+
+// do sends the request and returns the response body, treating any non-2xx
+// status as an error.
+func (c *CondorREST) do(req *http.Request) ([]byte, error) {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to send %s %s", req.Method, req.URL)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the response to %s %s", req.Method, req.URL)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return body, &httpStatusError{
+			StatusCode: resp.StatusCode,
+			msg:        fmt.Sprintf("%s %s returned %s: %s", req.Method, req.URL, resp.Status, bytes.TrimSpace(body)),
+		}
+	}
+	return body, nil
+}
+
+// httpStatusError is returned when the HTCondor REST API responds with an
+// unsuccessful status code.
+type httpStatusError struct {
+	StatusCode int
+	msg        string
+}
+
+func (e *httpStatusError) Error() string {
+	return e.msg
+}
+
+// Submit posts the contents of the submission file to the schedd. The
+// submission directory is sent along as the job's initial directory, so it
+// must be visible to the schedd host.
+func (c *CondorREST) Submit(submissionPath string) (string, []byte, error) {
+	contents, err := c.fs.ReadFile(submissionPath)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "failed to read %s", submissionPath)
+	}
+
+	reqBody, err := json.Marshal(&restSubmitRequest{
+		Submit:     string(contents),
+		InitialDir: path.Dir(submissionPath),
+	})
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to marshal the submit request")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.jobsURL(nil), bytes.NewReader(reqBody))
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to create the submit request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	output, err := c.do(req)
+	log.Infof("Output of the HTCondor REST submission:\n%s\n", output)
+	if err != nil {
+		return "", output, err
+	}
+
+	submitResp := &restSubmitResponse{}
+	if err = json.Unmarshal(output, submitResp); err != nil {
+		return "", output, errors.Wrap(err, "failed to parse the submit response")
+	}
+	return fmt.Sprintf("%d", submitResp.ClusterID), output, nil
+}
+
+// Remove deletes the jobs matching an IpcUuid constraint for the given
+// invocationID.
+func (c *CondorREST) Remove(invocationID string) ([]byte, error) {
+	params := url.Values{}
+	params.Set("constraint", fmt.Sprintf(`IpcUuid =?= "%s"`, invocationID))
+
+	req, err := http.NewRequest(http.MethodDelete, c.jobsURL(params), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create the remove request")
+	}
+	return c.do(req)
+}
+
+// RemoveCluster deletes the jobs in the given cluster.
+func (c *CondorREST) RemoveCluster(clusterID string) ([]byte, error) {
+	params := url.Values{}
+	params.Set("constraint", fmt.Sprintf("ClusterId == %s", clusterID))
+
+	req, err := http.NewRequest(http.MethodDelete, c.jobsURL(params), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create the remove request")
+	}
+	return c.do(req)
+}
+
+// queryAds lists the jobs in the collection (jobs or history) matching the
+// constraint, returning the requested attributes of each job.
+func (c *CondorREST) queryAds(collection, constraint string, attrs ...string) ([]JobAd, error) {
+	params := url.Values{}
+	params.Set("constraint", constraint)
+	params.Set("projection", strings.Join(attrs, ","))
+
+	req, err := http.NewRequest(http.MethodGet, c.collectionURL(collection, params), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create the query request")
+	}
+	body, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []restJob
+	if err = json.Unmarshal(body, &jobs); err != nil {
+		return nil, errors.Wrap(err, "failed to parse the query response")
+	}
+	ads := make([]JobAd, len(jobs))
+	for i := range jobs {
+		ads[i] = jobs[i].ClassAd
+	}
+	return ads, nil
+}
+
+// Release releases the jobs in the given cluster from the held state.
+func (c *CondorREST) Release(clusterID string) ([]byte, error) {
+	params := url.Values{}
+	params.Set("constraint", fmt.Sprintf("ClusterId == %s", clusterID))
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/release?%s", c.jobsURL(nil), params.Encode()), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create the release request")
+	}
+	return c.do(req)
+}
+
+// Query lists the jobs in the queue matching the constraint.
+func (c *CondorREST) Query(constraint string, attrs ...string) ([]JobAd, error) {
+	return c.queryAds("jobs", constraint, attrs...)
+}
+
+// History lists the jobs that have left the queue matching the constraint.
+func (c *CondorREST) History(constraint string, attrs ...string) ([]JobAd, error) {
+	return c.queryAds("history", constraint, attrs...)
+}
+
+// QueryHeld returns the jobs in the held state.
+func (c *CondorREST) QueryHeld() ([]HeldJob, error) {
+	ads, err := c.queryAds("jobs", "JobStatus =?= 5", heldJobAttrs...)
+	if err != nil {
+		return nil, err
+	}
+	return heldJobs(ads), nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// restStandIn is a local stand-in for the HTCondor REST API.
+type restStandIn struct {
+	submitted []restSubmitRequest
+	removed   []string
+	released  []string
+	queried   []string
+	histories []string
+}
+
+func (r *restStandIn) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/v1/jobs/test-schedd/release" && req.Method == http.MethodPost {
+		r.released = append(r.released, req.URL.Query().Get("constraint"))
+		w.Write([]byte(`{"message":"released"}`))
+		return
+	}
+	if req.URL.Path == "/v1/history/test-schedd" && req.Method == http.MethodGet {
+		r.histories = append(r.histories, req.URL.Query().Get("constraint"))
+		w.Write([]byte(`[{"jobid": "3.0", "classad": {"ipcuuid": "eca67a7c-e745-4e98-b892-67a9948bc2cb", "clusterid": 3, "jobstatus": 4, "exitcode": 1, "exitbysignal": false}}]`))
+		return
+	}
+	if req.URL.Path != "/v1/jobs/test-schedd" {
+		http.NotFound(w, req)
+		return
+	}
+	switch req.Method {
+	case http.MethodPost:
+		body := restSubmitRequest{}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.submitted = append(r.submitted, body)
+		json.NewEncoder(w).Encode(&restSubmitResponse{ClusterID: 10000, Message: "submitted"})
+	case http.MethodDelete:
+		r.removed = append(r.removed, req.URL.Query().Get("constraint"))
+		w.Write([]byte(`{"message":"removed"}`))
+	case http.MethodGet:
+		r.queried = append(r.queried, req.URL.Query().Get("constraint"))
+		w.Write([]byte(`[
+			{"jobid": "1.0", "classad": {"ipcuuid": "63c5523d-d8a5-49bc-addc-99a73566cd89", "clusterid": 1, "holdreasoncode": 13, "holdreasonsubcode": 256, "numholds": 2, "enteredcurrentstatus": 1500000000, "holdreason": "Transfer input files failure"}},
+			{"jobid": "2.0", "classad": {"ipcuuid": "b788569f-6948-4586-b5bd-5ea096986331", "clusterid": 2}}
+		]`))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func newRESTStandIn(t *testing.T) (*restStandIn, *CondorREST) {
+	standIn := &restStandIn{}
+	srv := httptest.NewServer(standIn)
+	t.Cleanup(srv.Close)
+	return standIn, NewCondorREST(srv.URL+"/", "test-schedd", 5*time.Second, newMemFS())
+}
+
+func TestCondorRESTSubmit(t *testing.T) {
+	standIn, c := newRESTStandIn(t)
+
+	// The submission file is only in the launcher's filesystem.
+	submissionPath := "/condor/logs/ipcdev/job/logs/iplant.cmd"
+	if err := c.fs.MkdirAll(path.Dir(submissionPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.fs.WriteFile(submissionPath, []byte("universe = vanilla\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	id, _, err := c.Submit(submissionPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "10000" {
+		t.Errorf("Submit returned ID %s instead of 10000", id)
+	}
+	if len(standIn.submitted) != 1 {
+		t.Fatalf("%d submissions were received instead of 1", len(standIn.submitted))
+	}
+	if standIn.submitted[0].Submit != "universe = vanilla\n" {
+		t.Errorf("submit description was %q", standIn.submitted[0].Submit)
+	}
+	if standIn.submitted[0].InitialDir != path.Dir(submissionPath) {
+		t.Errorf("initialdir was %s instead of %s", standIn.submitted[0].InitialDir, path.Dir(submissionPath))
+	}
+}
+
+func TestCondorRESTRemove(t *testing.T) {
+	standIn, c := newRESTStandIn(t)
+
+	if _, err := c.Remove("foo"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{`IpcUuid =?= "foo"`}
+	if !reflect.DeepEqual(standIn.removed, expected) {
+		t.Errorf("remove constraints were %v instead of %v", standIn.removed, expected)
+	}
+}
+
+func TestCondorRESTQueryHeld(t *testing.T) {
+	standIn, c := newRESTStandIn(t)
+
+	actual, err := c.QueryHeld()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []HeldJob{
+		{
+			InvocationID:      "63c5523d-d8a5-49bc-addc-99a73566cd89",
+			ClusterID:         "1",
+			HoldReasonCode:    13,
+			HoldReasonSubCode: 256,
+			NumHolds:          2,
+			HeldSince:         time.Unix(1500000000, 0),
+			HoldReason:        "Transfer input files failure",
+		},
+		{
+			InvocationID: "b788569f-6948-4586-b5bd-5ea096986331",
+			ClusterID:    "2",
+		},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("QueryHeld returned %+v instead of %+v", actual, expected)
+	}
+	if !reflect.DeepEqual(standIn.queried, []string{"JobStatus =?= 5"}) {
+		t.Errorf("query constraints were %v", standIn.queried)
+	}
+}
+
+func TestCondorRESTRelease(t *testing.T) {
+	standIn, c := newRESTStandIn(t)
+
+	if _, err := c.Release("10000"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"ClusterId == 10000"}
+	if !reflect.DeepEqual(standIn.released, expected) {
+		t.Errorf("release constraints were %v instead of %v", standIn.released, expected)
+	}
+}
+
+func TestCondorRESTHistory(t *testing.T) {
+	standIn, c := newRESTStandIn(t)
+
+	ads, err := c.History("ClusterId == 3", statusAttrs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	one := 1
+	expected := []JobAd{{IpcUUID: "eca67a7c-e745-4e98-b892-67a9948bc2cb", ClusterID: 3, JobStatus: 4, ExitCode: &one}}
+	if !reflect.DeepEqual(ads, expected) {
+		t.Errorf("History returned %+v instead of %+v", ads, expected)
+	}
+	if !reflect.DeepEqual(standIn.histories, []string{"ClusterId == 3"}) {
+		t.Errorf("history constraints were %v", standIn.histories)
+	}
+}
+
+func TestCondorRESTError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "schedd unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	c := NewCondorREST(srv.URL, "test-schedd", 5*time.Second, newMemFS())
+	if _, err := c.Remove("foo"); err == nil {
+		t.Error("Remove did not return an error for a 503 response")
+	}
+}
+
+func TestNewSchedulerBackends(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("condor.backend", "rest")
+	cfg.Set("condor.rest.base_url", "http://localhost:8080")
+	s, err := NewScheduler(cfg, newMemFS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	instrumented, ok := s.(*instrumentedScheduler)
+	if !ok {
+		t.Fatalf("NewScheduler returned a %T instead of an *instrumentedScheduler", s)
+	}
+	if _, ok = instrumented.Scheduler.(*CondorREST); !ok {
+		t.Errorf("NewScheduler wrapped a %T instead of a *CondorREST", instrumented.Scheduler)
+	}
+
+	cfg.Set("condor.backend", "bogus")
+	if _, err = NewScheduler(cfg, newMemFS()); err == nil {
+		t.Error("NewScheduler did not return an error for an unrecognized backend")
+	}
+}
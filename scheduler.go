@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"gopkg.in/cyverse-de/model.v4"
+)
+
+// Scheduler defines an interface for the operations condor-launcher performs
+// against the batch system. Launches, stops and held job sweeps all go through
+// a Scheduler so that alternative backends can be plugged in and so that those
+// code paths can be tested without HTCondor installed.
+type Scheduler interface {
+	// Submit submits the job described by the submission file at the given
+	// path. It returns the ID assigned to the job along with the raw output
+	// of the submission.
+	Submit(submissionPath string) (string, []byte, error)
+
+	// Remove removes all jobs associated with the given invocation ID and
+	// returns the raw output of the removal.
+	Remove(invocationID string) ([]byte, error)
+
+	// RemoveCluster removes the jobs in the given cluster and returns the raw
+	// output of the removal.
+	RemoveCluster(clusterID string) ([]byte, error)
+
+	// Release releases the jobs in the given cluster from the held state and
+	// returns the raw output of the release.
+	Release(clusterID string) ([]byte, error)
+
+	// QueryHeld returns all jobs in the held state.
+	QueryHeld() ([]HeldJob, error)
+
+	// Query returns the ClassAds of the jobs in the queue matching the given
+	// constraint, with the requested attributes set.
+	Query(constraint string, attrs ...string) ([]JobAd, error)
+
+	// History returns the ClassAds of the jobs that have left the queue
+	// matching the given constraint, with the requested attributes set.
+	History(constraint string, attrs ...string) ([]JobAd, error)
+}
+
+// NewScheduler returns the Scheduler implementation selected by the
+// condor.backend configuration setting. A backend of 'cli' (the default) shells
+// out to the HTCondor command-line tools, while 'rest' uses the HTCondor REST
+// API at condor.rest.base_url. Both talk to the schedd named by condor.schedd
+// (or condor.rest.schedd for the rest backend) if it's set. The returned
+// Scheduler records the execution time of each operation. The rest backend
+// reads the submission files from fs, while condor_submit reads them from the
+// local filesystem itself.
+func NewScheduler(cfg *viper.Viper, fs fsys) (Scheduler, error) {
+	backend := cfg.GetString("condor.backend")
+	switch backend {
+	case "", "cli":
+		cli, err := NewCondorCLI(cfg.GetString("condor.path_env_var"), cfg.GetString("condor.condor_config"))
+		if err != nil {
+			return nil, err
+		}
+		cli.schedd = cfg.GetString("condor.schedd")
+		return &instrumentedScheduler{cli}, nil
+	case "rest":
+		baseURL := cfg.GetString("condor.rest.base_url")
+		if baseURL == "" {
+			return nil, errors.New("condor.rest.base_url must be set when using the rest backend")
+		}
+		timeout := cfg.GetDuration("condor.rest.timeout")
+		if timeout == 0 {
+			timeout = 30 * time.Second
+		}
+		schedd := cfg.GetString("condor.schedd")
+		if schedd == "" {
+			schedd = cfg.GetString("condor.rest.schedd")
+		}
+		return &instrumentedScheduler{NewCondorREST(baseURL, schedd, timeout, fs)}, nil
+	default:
+		return nil, fmt.Errorf("unrecognized condor backend: %s", backend)
+	}
+}
+
+// CondorCLI is an implementation of Scheduler that shells out to the HTCondor
+// command-line tools.
+type CondorCLI struct {
+	condorPath    string // value of PATH in the environment of the condor commands
+	condorConfig  string // value of CONDOR_CONFIG in the environment of the condor commands
+	condorSubmit  string // path to the condor_submit executable
+	condorRm      string // path to the condor_rm executable
+	condorQ       string // path to the condor_q executable
+	condorRelease string // path to the condor_release executable
+	condorHistory string // path to the condor_history executable
+	schedd        string // name of the schedd passed to the condor commands, or empty for the local schedd
+}
+
+// NewCondorCLI returns a new *CondorCLI. The condor_submit, condor_rm,
+// condor_q, condor_release and condor_history executables are located on the
+// $PATH once, up front.
+func NewCondorCLI(condorPath, condorConfig string) (*CondorCLI, error) {
+	var err error
+
+	c := &CondorCLI{
+		condorPath:   condorPath,
+		condorConfig: condorConfig,
+	}
+	if c.condorSubmit, err = lookupExecPath("condor_submit"); err != nil {
+		return nil, err
+	}
+	if c.condorRm, err = lookupExecPath("condor_rm"); err != nil {
+		return nil, err
+	}
+	if c.condorQ, err = lookupExecPath("condor_q"); err != nil {
+		return nil, err
+	}
+	if c.condorRelease, err = lookupExecPath("condor_release"); err != nil {
+		return nil, err
+	}
+	if c.condorHistory, err = lookupExecPath("condor_history"); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// env returns the environment the condor commands are executed with.
+func (c *CondorCLI) env() []string {
+	return []string{
+		fmt.Sprintf("PATH=%s", c.condorPath),
+		fmt.Sprintf("CONDOR_CONFIG=%s", c.condorConfig),
+	}
+}
+
+// condorArgs returns the arguments for a condor command, preceded by -name if
+// the command talks to the named schedd instead of the local one.
+func condorArgs(schedd string, args ...string) []string {
+	if schedd == "" {
+		return args
+	}
+	return append([]string{"-name", schedd}, args...)
+}
+
+// args returns the arguments for one of the CLI's condor commands.
+func (c *CondorCLI) args(args ...string) []string {
+	return condorArgs(c.schedd, args...)
+}
+
+// run executes a condor command in the given working directory and returns its
+// combined output.
+func (c *CondorCLI) run(dir, execPath string, args ...string) ([]byte, error) {
+	cmd := exec.Command(execPath, args...)
+	cmd.Dir = dir
+	cmd.Env = c.env()
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return output, errors.Wrapf(err, "failed to get the output of '%s %s'", execPath, strings.Join(args, " "))
+	}
+	return output, nil
+}
+
+// output executes a condor command and returns its standard output, which
+// isn't mixed with any warnings the command writes to standard error.
+func (c *CondorCLI) output(execPath string, args ...string) ([]byte, error) {
+	cmd := exec.Command(execPath, args...)
+	cmd.Env = c.env()
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return output, errors.Wrapf(err, "failed to get the output of '%s %s': %s", execPath, strings.Join(args, " "), bytes.TrimSpace(stderr.Bytes()))
+	}
+	return output, nil
+}
+
+// submitRejection matches the errors condor_submit reports for submission
+// files that it can't parse or that are invalid, which happen again every
+// time the file is submitted.
+var submitRejection = regexp.MustCompile(`(?m)^ERROR: (on Line \d+ of submit file|Parse error|Failed to parse command file|Executable file .* does not exist|(?i:invalid)).*$`)
+
+// submitRejectedError is returned by CondorCLI.Submit when condor_submit
+// rejects the submission file, as opposed to failing to reach the schedd.
+type submitRejectedError struct {
+	Reason string // the error reported by condor_submit
+}
+
+func (e *submitRejectedError) Error() string {
+	return fmt.Sprintf("condor_submit rejected the submission file: %s", e.Reason)
+}
+
+// Submit runs condor_submit from the directory containing the submission file.
+func (c *CondorCLI) Submit(submissionPath string) (string, []byte, error) {
+	output, err := c.run(path.Dir(submissionPath), c.condorSubmit, c.args(submissionPath)...)
+	log.Infof("Output of condor_submit:\n%s\n", output)
+	if err != nil {
+		if reason := submitRejection.Find(output); reason != nil && len(model.ExtractJobID(output)) == 0 {
+			err = &submitRejectedError{Reason: strings.TrimSpace(string(reason))}
+		}
+		return "", output, errors.Wrapf(err, "failed to execute %s", c.condorSubmit)
+	}
+	return string(model.ExtractJobID(output)), output, nil
+}
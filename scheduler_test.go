@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"testing"
+
+	"github.com/cyverse-de/condor-launcher/test"
+	"github.com/spf13/viper"
+	"gopkg.in/cyverse-de/messaging.v6"
+)
+
+// tsched is an in-memory implementation of Scheduler for use in tests.
+type tsched struct {
+	nextID    int
+	submitted []string
+	removed   []string
+	clusters  []string
+	released  []string
+	held      []HeldJob
+	queries   []string
+	queryAds  []JobAd
+	queryErr  error
+	submitErr error
+
+	histories  []string
+	historyAds []JobAd
+
+	// submitErrs are returned by the next calls to Submit, one at a time,
+	// before submitErr is considered.
+	submitErrs []error
+}
+
+func newtsched() *tsched {
+	return &tsched{nextID: 10000}
+}
+
+func (s *tsched) Submit(submissionPath string) (string, []byte, error) {
+	if len(s.submitErrs) > 0 {
+		err := s.submitErrs[0]
+		s.submitErrs = s.submitErrs[1:]
+		return "", nil, err
+	}
+	if s.submitErr != nil {
+		return "", nil, s.submitErr
+	}
+	s.submitted = append(s.submitted, submissionPath)
+	id := fmt.Sprintf("%d", s.nextID)
+	s.nextID++
+	return id, []byte(fmt.Sprintf("1 job(s) submitted to cluster %s.", id)), nil
+}
+
+func (s *tsched) Remove(invocationID string) ([]byte, error) {
+	s.removed = append(s.removed, invocationID)
+	return []byte(fmt.Sprintf("IpcUuid =?= \"%s\" was stopped\n", invocationID)), nil
+}
+
+func (s *tsched) RemoveCluster(clusterID string) ([]byte, error) {
+	s.clusters = append(s.clusters, clusterID)
+	return []byte(fmt.Sprintf("All jobs in cluster %s have been marked for removal\n", clusterID)), nil
+}
+
+func (s *tsched) Release(clusterID string) ([]byte, error) {
+	s.released = append(s.released, clusterID)
+	return []byte(fmt.Sprintf("All jobs in cluster %s have been released\n", clusterID)), nil
+}
+
+func (s *tsched) QueryHeld() ([]HeldJob, error) {
+	return s.held, nil
+}
+
+func (s *tsched) Query(constraint string, attrs ...string) ([]JobAd, error) {
+	s.queries = append(s.queries, constraint)
+	if s.queryErr != nil {
+		return nil, s.queryErr
+	}
+	return s.queryAds, nil
+}
+
+func (s *tsched) History(constraint string, attrs ...string) ([]JobAd, error) {
+	s.histories = append(s.histories, constraint)
+	return s.historyAds, nil
+}
+
+// launcherFixture describes the state of a launcher returned by
+// newTestLauncherWith.
+type launcherFixture struct {
+	cfg     *viper.Viper      // the test configuration if nil
+	dirs    []string          // created in the launcher's filesystem
+	files   map[string]string // path -> contents, written to the launcher's filesystem
+	records []*LaunchRecord   // recorded in the ledger
+}
+
+// newTestLauncherWith returns a launcher with an in-memory filesystem, a
+// tsched for each pool and the state in the fixture, along with the scheduler
+// for the default pool and the messenger. The schedulers for the other pools
+// are returned by testSchedulers.
+func newTestLauncherWith(t *testing.T, f launcherFixture) (*CondorLauncher, *tsched, *tmessenger) {
+	cfg := f.cfg
+	if cfg == nil {
+		cfg = test.InitConfig(t)
+	}
+	cfg.Set("condor.log_path", t.TempDir())
+
+	var pools *Pools
+	if cfg.IsSet("condor.pools") {
+		pools, _ = newTestPools(t, cfg)
+	} else {
+		pools = SinglePool(cfg, newtsched())
+	}
+	client := &tmessenger{}
+	cl := New(cfg, client, newMemFS(), pools, newTestLedger(t))
+
+	for _, dir := range f.dirs {
+		if err := cl.fs.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, contents := range f.files {
+		if err := cl.fs.MkdirAll(path.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := cl.fs.WriteFile(name, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, r := range f.records {
+		if err := cl.ledger.Record(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cl, pools.Get("").Scheduler.(*tsched), client
+}
+
+// newTestLauncher returns a launcher with a single pool and nothing recorded.
+func newTestLauncher(t *testing.T) (*CondorLauncher, *tsched, *tmessenger) {
+	return newTestLauncherWith(t, launcherFixture{})
+}
+
+func TestLaunchUsesScheduler(t *testing.T) {
+	cl, scheduler, _ := newTestLauncher(t)
+	j := testJob(t, cl)
+
+	id, err := cl.launch(j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "10000" {
+		t.Errorf("launch returned %s instead of 10000", id)
+	}
+	if len(scheduler.submitted) != 1 {
+		t.Fatalf("%d jobs were submitted instead of 1", len(scheduler.submitted))
+	}
+	if path.Base(scheduler.submitted[0]) != "iplant.cmd" {
+		t.Errorf("submitted %s instead of an iplant.cmd file", scheduler.submitted[0])
+	}
+}
+
+func TestStopJobUsesScheduler(t *testing.T) {
+	cl, scheduler, client := newTestLauncher(t)
+	invID := "b788569f-6948-4586-b5bd-5ea096986331"
+
+	if err := cl.stopJob(invID); err != nil {
+		t.Fatal(err)
+	}
+	if len(scheduler.removed) != 1 || scheduler.removed[0] != invID {
+		t.Errorf("removed %v instead of [%s]", scheduler.removed, invID)
+	}
+	if len(client.updates) != 1 {
+		t.Fatalf("published %d updates instead of 1", len(client.updates))
+	}
+	if client.updates[0].State != messaging.FailedState {
+		t.Errorf("published state %s instead of %s", client.updates[0].State, messaging.FailedState)
+	}
+	if len(client.deletedQueues) != 1 || client.deletedQueues[0] != messaging.StopQueueName(invID) {
+		t.Errorf("deleted queues %v instead of [%s]", client.deletedQueues, messaging.StopQueueName(invID))
+	}
+}
+
+func TestSweepHeldJobsUsesScheduler(t *testing.T) {
+	cl, scheduler, client := newTestLauncher(t)
+	scheduler.held = []HeldJob{
+		{InvocationID: "63c5523d-d8a5-49bc-addc-99a73566cd89", ClusterID: "10000"},
+		{InvocationID: "eca67a7c-e745-4e98-b892-67a9948bc2cb", ClusterID: "10001"},
+	}
+
+	sweepHeldJobs(cl)
+	if len(scheduler.removed) != len(scheduler.held) {
+		t.Errorf("removed %d jobs instead of %d", len(scheduler.removed), len(scheduler.held))
+	}
+	if len(client.updates) != len(scheduler.held) {
+		t.Errorf("published %d updates instead of %d", len(client.updates), len(scheduler.held))
+	}
+}
+
+func TestStopJobUsesLedgerClusterID(t *testing.T) {
+	cl, scheduler, _ := newTestLauncher(t)
+	j := testJob(t, cl)
+	id, err := cl.launch(j)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = cl.stopJob(j.InvocationID); err != nil {
+		t.Fatal(err)
+	}
+	if len(scheduler.removed) != 0 {
+		t.Errorf("removed by invocation ID %v instead of by cluster", scheduler.removed)
+	}
+	if len(scheduler.clusters) != 1 || scheduler.clusters[0] != id {
+		t.Errorf("removed clusters %v instead of [%s]", scheduler.clusters, id)
+	}
+}
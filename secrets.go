@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"gopkg.in/cyverse-de/model.v4"
+)
+
+// SecretProvider defines an interface for looking up a secret, such as the
+// iRODS password, from wherever it's stored.
+type SecretProvider interface {
+	Secret() (string, error)
+}
+
+// valueSecret is a SecretProvider for a secret stored in the configuration.
+type valueSecret string
+
+func (v valueSecret) Secret() (string, error) {
+	return string(v), nil
+}
+
+// envSecret is a SecretProvider that reads a secret from an environment
+// variable.
+type envSecret string
+
+func (e envSecret) Secret() (string, error) {
+	value, ok := os.LookupEnv(string(e))
+	if !ok {
+		return "", fmt.Errorf("the environment variable %s is not set", string(e))
+	}
+	return value, nil
+}
+
+// fileSecret is a SecretProvider that reads a secret from a file. Trailing
+// whitespace is removed from the contents of the file.
+type fileSecret string
+
+func (f fileSecret) Secret() (string, error) {
+	contents, err := os.ReadFile(string(f))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read the secret from %s", string(f))
+	}
+	return strings.TrimRight(string(contents), "\r\n\t "), nil
+}
+
+// vaultSecret is a SecretProvider that reads a secret from a key/value store
+// with a Vault-compatible HTTP API. Both version 1 and version 2 of the KV
+// secrets engine are supported.
+type vaultSecret struct {
+	address string
+	path    string
+	key     string
+	token   string
+	client  *http.Client
+}
+
+// vaultResponse is the body of a Vault read request. Version 1 of the KV
+// secrets engine returns the secret in data. Version 2 nests it in data.data.
+type vaultResponse struct {
+	Data map[string]interface{} `json:"data"`
+}
+
+func (v *vaultSecret) Secret() (string, error) {
+	u := fmt.Sprintf("%s/v1/%s", strings.TrimSuffix(v.address, "/"), strings.TrimPrefix(v.path, "/"))
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create the secret request")
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read the secret from %s", u)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("reading the secret from %s returned %s", u, resp.Status)
+	}
+
+	body := &vaultResponse{}
+	if err = json.NewDecoder(resp.Body).Decode(body); err != nil {
+		return "", errors.Wrapf(err, "failed to parse the secret from %s", u)
+	}
+	data := body.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	value, ok := data[v.key].(string)
+	if !ok {
+		return "", fmt.Errorf("the secret at %s has no %s key", u, v.key)
+	}
+	return value, nil
+}
+
+// NewIRODSPasswordProvider returns the SecretProvider for the iRODS password
+// based on the irods.password_source setting:
+//
+//	config  the password is irods.pass (the default)
+//	env     the password is read from the environment variable named by irods.password_env
+//	file    the password is read from the file named by irods.password_file
+//	vault   the password is read from irods.vault_address, using the secret at
+//	        irods.vault_path and the key irods.vault_key (default: password). The
+//	        token is read from the environment variable named by
+//	        irods.vault_token_env (default: VAULT_TOKEN), which must be set
+//	        when the launcher starts.
+func NewIRODSPasswordProvider(cfg *viper.Viper) (SecretProvider, error) {
+	source := cfg.GetString("irods.password_source")
+	switch source {
+	case "", "config":
+		return valueSecret(cfg.GetString("irods.pass")), nil
+	case "env":
+		name := cfg.GetString("irods.password_env")
+		if name == "" {
+			return nil, errors.New("irods.password_env must be set when irods.password_source is env")
+		}
+		return envSecret(name), nil
+	case "file":
+		name := cfg.GetString("irods.password_file")
+		if name == "" {
+			return nil, errors.New("irods.password_file must be set when irods.password_source is file")
+		}
+		return fileSecret(name), nil
+	case "vault":
+		v := &vaultSecret{
+			address: cfg.GetString("irods.vault_address"),
+			path:    cfg.GetString("irods.vault_path"),
+			key:     cfg.GetString("irods.vault_key"),
+			client:  &http.Client{Timeout: 10 * time.Second},
+		}
+		if v.address == "" || v.path == "" {
+			return nil, errors.New("irods.vault_address and irods.vault_path must be set when irods.password_source is vault")
+		}
+		if v.key == "" {
+			v.key = "password"
+		}
+		tokenEnv := cfg.GetString("irods.vault_token_env")
+		if tokenEnv == "" {
+			tokenEnv = "VAULT_TOKEN"
+		}
+		if v.token = os.Getenv(tokenEnv); v.token == "" {
+			return nil, fmt.Errorf("the environment variable %s must contain the Vault token when irods.password_source is vault", tokenEnv)
+		}
+		return v, nil
+	default:
+		return nil, fmt.Errorf("unrecognized irods.password_source: %s", source)
+	}
+}
+
+// checkCredentials returns an error if the iRODS password source of a pool
+// that doesn't issue tickets is incomplete, so that it's reported at startup
+// instead of failing every launch.
+func (cl *CondorLauncher) checkCredentials() error {
+	for _, pool := range cl.pools.All() {
+		if NewTicketIssuer(pool.cfg) != nil {
+			continue
+		}
+		if _, err := NewIRODSPasswordProvider(pool.cfg); err != nil {
+			return errors.Wrapf(err, "invalid iRODS password source for pool %s", pool.Name)
+		}
+	}
+	return nil
+}
+
+// TicketIssuer defines an interface for issuing short-lived iRODS tickets
+// that grant a job access to its input and output paths.
+type TicketIssuer interface {
+	IssueTicket(job *model.Job) (string, error)
+}
+
+// defaultTicketLifetime is how long issued tickets last when
+// irods.ticket_lifetime isn't set.
+const defaultTicketLifetime = 72 * time.Hour
+
+// httpTicketIssuer is a TicketIssuer that requests tickets from an HTTP
+// service.
+type httpTicketIssuer struct {
+	url      string
+	lifetime time.Duration
+	client   *http.Client
+}
+
+// ticketRequest is the body of a ticket request.
+type ticketRequest struct {
+	InvocationID    string   `json:"invocation_id"`
+	Username        string   `json:"username"`
+	Paths           []string `json:"paths"`
+	LifetimeSeconds int64    `json:"lifetime_seconds"`
+}
+
+// ticketResponse is the body of the response to a ticket request.
+type ticketResponse struct {
+	Ticket string `json:"ticket"`
+}
+
+// NewTicketIssuer returns the TicketIssuer configured with irods.ticket_url
+// and irods.ticket_lifetime, or nil if irods.ticket_url isn't set.
+func NewTicketIssuer(cfg *viper.Viper) TicketIssuer {
+	u := cfg.GetString("irods.ticket_url")
+	if u == "" {
+		return nil
+	}
+	lifetime := cfg.GetDuration("irods.ticket_lifetime")
+	if lifetime == 0 {
+		lifetime = defaultTicketLifetime
+	}
+	return &httpTicketIssuer{
+		url:      u,
+		lifetime: lifetime,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (t *httpTicketIssuer) IssueTicket(job *model.Job) (string, error) {
+	req := &ticketRequest{
+		InvocationID:    job.InvocationID,
+		Username:        job.Submitter,
+		Paths:           []string{job.OutputDirectory()},
+		LifetimeSeconds: int64(t.lifetime / time.Second),
+	}
+	for _, input := range job.Inputs() {
+		req.Paths = append(req.Paths, input.IRODSPath())
+	}
+
+	reqBody, err := json.Marshal(req)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to marshal the ticket request")
+	}
+	resp, err := t.client.Post(t.url, "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to request a ticket for %s", job.InvocationID)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read the ticket response")
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("requesting a ticket for %s returned %s: %s", job.InvocationID, resp.Status, bytes.TrimSpace(body))
+	}
+
+	ticket := &ticketResponse{}
+	if err = json.Unmarshal(body, ticket); err != nil {
+		return "", errors.Wrap(err, "failed to parse the ticket response")
+	}
+	if ticket.Ticket == "" {
+		return "", fmt.Errorf("no ticket was issued for %s", job.InvocationID)
+	}
+	return ticket.Ticket, nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/cyverse-de/condor-launcher/test"
+	"gopkg.in/cyverse-de/model.v4"
+)
+
+func TestIRODSPasswordProviders(t *testing.T) {
+	passwordFile := path.Join(t.TempDir(), "irods-pass")
+	if err := os.WriteFile(passwordFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_IRODS_PASSWORD", "from-env")
+
+	tests := []struct {
+		settings map[string]string
+		expected string
+	}{
+		{map[string]string{}, "pass"},
+		{map[string]string{"irods.password_source": "config"}, "pass"},
+		{map[string]string{"irods.password_source": "env", "irods.password_env": "TEST_IRODS_PASSWORD"}, "from-env"},
+		{map[string]string{"irods.password_source": "file", "irods.password_file": passwordFile}, "from-file"},
+	}
+	for _, tt := range tests {
+		cfg := test.InitConfig(t)
+		for k, v := range tt.settings {
+			cfg.Set(k, v)
+		}
+		p, err := NewIRODSPasswordProvider(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := p.Secret()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != tt.expected {
+			t.Errorf("password for %v was %s instead of %s", tt.settings, actual, tt.expected)
+		}
+	}
+}
+
+func TestIRODSPasswordProviderErrors(t *testing.T) {
+	for _, source := range []string{"env", "file", "vault", "bogus"} {
+		cfg := test.InitConfig(t)
+		cfg.Set("irods.password_source", source)
+		if _, err := NewIRODSPasswordProvider(cfg); err == nil {
+			t.Errorf("NewIRODSPasswordProvider did not return an error for an incomplete %s source", source)
+		}
+	}
+
+	// A Vault source needs a token as well as the address and the path.
+	t.Setenv("TEST_VAULT_TOKEN", "")
+	cfg := test.InitConfig(t)
+	cfg.Set("irods.password_source", "vault")
+	cfg.Set("irods.vault_address", "http://vault.example.org:8200")
+	cfg.Set("irods.vault_path", "secret/data/irods")
+	cfg.Set("irods.vault_token_env", "TEST_VAULT_TOKEN")
+	if _, err := NewIRODSPasswordProvider(cfg); err == nil {
+		t.Error("NewIRODSPasswordProvider did not return an error for a Vault source without a token")
+	}
+
+	if _, err := envSecret("TEST_IRODS_PASSWORD_UNSET").Secret(); err == nil {
+		t.Error("envSecret did not return an error for an unset variable")
+	}
+}
+
+func TestCheckCredentials(t *testing.T) {
+	t.Setenv("TEST_VAULT_TOKEN", "")
+	cl, _, _ := newTestLauncher(t)
+	cl.cfg.Set("irods.password_source", "vault")
+	cl.cfg.Set("irods.vault_address", "http://vault.example.org:8200")
+	cl.cfg.Set("irods.vault_path", "secret/data/irods")
+	cl.cfg.Set("irods.vault_token_env", "TEST_VAULT_TOKEN")
+	if err := cl.configure(cl.cfg); err == nil {
+		t.Error("configure did not return an error for a Vault source without a token")
+	}
+
+	// The password isn't needed if tickets are issued instead.
+	cl.cfg.Set("irods.ticket_url", "http://tickets.example.org")
+	if err := cl.checkCredentials(); err != nil {
+		t.Error(err)
+	}
+
+	cl.cfg.Set("irods.ticket_url", "")
+	t.Setenv("TEST_VAULT_TOKEN", "test-token")
+	if err := cl.checkCredentials(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVaultSecret(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "test-token" {
+			http.Error(w, "permission denied", http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/irods":
+			w.Write([]byte(`{"data": {"data": {"password": "from-kv2"}, "metadata": {"version": 1}}}`))
+		case "/v1/kv/irods":
+			w.Write([]byte(`{"data": {"irods_password": "from-kv1"}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	t.Setenv("TEST_VAULT_TOKEN", "test-token")
+
+	tests := []struct {
+		path, key, expected string
+	}{
+		{"secret/data/irods", "", "from-kv2"},
+		{"/kv/irods", "irods_password", "from-kv1"},
+	}
+	for _, tt := range tests {
+		cfg := test.InitConfig(t)
+		cfg.Set("irods.password_source", "vault")
+		cfg.Set("irods.vault_address", srv.URL+"/")
+		cfg.Set("irods.vault_path", tt.path)
+		cfg.Set("irods.vault_key", tt.key)
+		cfg.Set("irods.vault_token_env", "TEST_VAULT_TOKEN")
+		p, err := NewIRODSPasswordProvider(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := p.Secret()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != tt.expected {
+			t.Errorf("password at %s was %s instead of %s", tt.path, actual, tt.expected)
+		}
+	}
+
+	cfg := test.InitConfig(t)
+	cfg.Set("irods.password_source", "vault")
+	cfg.Set("irods.vault_address", srv.URL)
+	cfg.Set("irods.vault_path", "secret/data/missing")
+	cfg.Set("irods.vault_token_env", "TEST_VAULT_TOKEN")
+	p, err := NewIRODSPasswordProvider(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = p.Secret(); err == nil {
+		t.Error("vaultSecret did not return an error for a missing secret")
+	}
+}
+
+func TestStoreConfigPermissions(t *testing.T) {
+	cl, _, _ := newTestLauncher(t)
+	sdir := "/submissions/test"
+	fname := path.Join(sdir, "irods-config")
+	if err := cl.fs.MkdirAll(sdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.fs.WriteFile(fname, []byte("stale"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cl.storeConfig(cl.cfg, &model.Job{InvocationID: "test"}, sdir); err != nil {
+		t.Fatal(err)
+	}
+	info, err := cl.fs.Stat(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("irods-config mode was %o instead of 600", info.Mode().Perm())
+	}
+	contents, err := cl.fs.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(contents), "porklock.irods-pass = pass\n") {
+		t.Errorf("irods-config did not contain the password:\n%s", contents)
+	}
+}
+
+func TestStoreConfigTicket(t *testing.T) {
+	var received ticketRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"ticket": "abc123"}`))
+	}))
+	defer srv.Close()
+
+	cl, _, _ := newTestLauncher(t)
+	cl.cfg.Set("irods.ticket_url", srv.URL)
+	cl.cfg.Set("irods.ticket_lifetime", "1h")
+	j := testJob(t, cl)
+
+	sdir := "/submissions/test"
+	if err := cl.fs.MkdirAll(sdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.storeConfig(cl.cfg, j, sdir); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := cl.fs.ReadFile(path.Join(sdir, "irods-config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(contents), "porklock.irods-ticket = abc123\n") {
+		t.Errorf("irods-config did not contain the ticket:\n%s", contents)
+	}
+	if strings.Contains(string(contents), "irods-pass") {
+		t.Errorf("irods-config contained the password:\n%s", contents)
+	}
+
+	if received.InvocationID != j.InvocationID || received.Username != j.Submitter {
+		t.Errorf("ticket was requested for %s/%s", received.Username, received.InvocationID)
+	}
+	if received.LifetimeSeconds != 3600 {
+		t.Errorf("ticket lifetime was %d instead of 3600", received.LifetimeSeconds)
+	}
+	if len(received.Paths) != len(j.Inputs())+1 || received.Paths[0] != j.OutputDirectory() {
+		t.Errorf("ticket paths were %v", received.Paths)
+	}
+}
+
+func TestStoreConfigPlaceholderCredentials(t *testing.T) {
+	requested := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = true
+		w.Write([]byte(`{"ticket": "abc123"}`))
+	}))
+	defer srv.Close()
+
+	cl, _, _ := newTestLauncher(t)
+	cl.placeholderCredentials = true
+	cl.cfg.Set("irods.ticket_url", srv.URL)
+	j := testJob(t, cl)
+	sdir := "/submissions/test"
+	if err := cl.fs.MkdirAll(sdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.storeConfig(cl.cfg, j, sdir); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := cl.fs.ReadFile(path.Join(sdir, "irods-config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(contents), "porklock.irods-ticket = "+placeholderCredential+"\n") {
+		t.Errorf("irods-config did not contain the placeholder ticket:\n%s", contents)
+	}
+	if requested {
+		t.Error("a ticket was issued for placeholder credentials")
+	}
+}
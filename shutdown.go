@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultShutdownTimeout is how long the launcher waits for in-flight work
+// to finish during shutdown when condor.shutdown_timeout isn't set.
+const defaultShutdownTimeout = 60 * time.Second
+
+// errShuttingDown is the cause of the errors returned by launches that gave up
+// waiting because the launcher started shutting down.
+var errShuttingDown = errors.New("the launcher is shutting down")
+
+// interrupted returns true if err is from a launch that gave up waiting
+// because the launcher started shutting down. The launch request is given
+// back to the broker instead of being retried or failed.
+func interrupted(err error) bool {
+	return err != nil && causeOf(err) == errShuttingDown
+}
+
+// sleepUntilStopped waits for d to pass. It returns false if stop was closed
+// first.
+func sleepUntilStopped(d time.Duration, stop <-chan struct{}) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// begin registers the start of a unit of work, such as handling a delivery or
+// sweeping held jobs. It returns false if the launcher is shutting down, in
+// which case the work must not be started. Every call that returns true must
+// be paired with a call to finish.
+func (cl *CondorLauncher) begin() bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.draining {
+		return false
+	}
+	cl.inflight.Add(1)
+	return true
+}
+
+// finish registers the end of a unit of work started with begin.
+func (cl *CondorLauncher) finish() {
+	cl.inflight.Done()
+}
+
+// stop stops the launcher from starting new work and interrupts launches that
+// are waiting to be submitted. Deliveries that arrive afterwards are left
+// unacknowledged for the broker to redeliver.
+func (cl *CondorLauncher) stop() {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if !cl.draining {
+		cl.draining = true
+		close(cl.stopping)
+	}
+}
+
+// drain stops the launcher and waits until ctx is done for the work that's
+// already in flight to finish. It returns false if ctx was done first.
+func (cl *CondorLauncher) drain(ctx context.Context) bool {
+	cl.stop()
+
+	done := make(chan struct{})
+	go func() {
+		cl.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// shutdownTimeout returns the value of the condor.shutdown_timeout setting.
+func (cl *CondorLauncher) shutdownTimeout() time.Duration {
+	timeout := cl.cfg.GetDuration("condor.shutdown_timeout")
+	if timeout == 0 {
+		timeout = defaultShutdownTimeout
+	}
+	return timeout
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// drainWithin drains the launcher, waiting up to timeout for the work in
+// flight to finish.
+func drainWithin(cl *CondorLauncher, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return cl.drain(ctx)
+}
+
+func TestDrainWaitsForInFlightWork(t *testing.T) {
+	cl, _, _ := newTestLauncher(t)
+	if !cl.begin() {
+		t.Fatal("begin refused work before shutdown")
+	}
+
+	finished := make(chan bool)
+	go func() {
+		finished <- drainWithin(cl, 5*time.Second)
+	}()
+
+	select {
+	case <-finished:
+		t.Fatal("drain returned while work was still in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cl.finish()
+	if !<-finished {
+		t.Error("drain timed out after the in-flight work finished")
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	cl, _, _ := newTestLauncher(t)
+	if !cl.begin() {
+		t.Fatal("begin refused work before shutdown")
+	}
+	defer cl.finish()
+
+	if drainWithin(cl, 10*time.Millisecond) {
+		t.Error("drain did not time out while work was still in flight")
+	}
+}
+
+func TestHandlersRefuseWorkWhileDraining(t *testing.T) {
+	cl, scheduler, client := newTestLauncher(t)
+	if !drainWithin(cl, time.Second) {
+		t.Fatal("drain timed out with no work in flight")
+	}
+	if cl.begin() {
+		t.Error("begin accepted work after shutdown started")
+	}
+
+	cl.handleLaunchRequests()(launchDelivery(t, cl, false))
+	if len(scheduler.submitted) != 0 {
+		t.Errorf("submitted %d jobs during shutdown", len(scheduler.submitted))
+	}
+	if len(client.updates) != 0 {
+		t.Errorf("published %d updates during shutdown", len(client.updates))
+	}
+}
+
+func TestDrainInterruptsSubmitLimitWaits(t *testing.T) {
+	cl, scheduler, client := newTestLauncher(t)
+	cl.cfg.Set("condor.submit_limits.max_concurrent", 1)
+	limiter, err := NewSubmitLimiter(cl.cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := cl.pools.Get("")
+	pool.limiter = limiter
+	limiter.slots <- struct{}{}
+
+	rejects := testutil.ToFloat64(deliveryRejectsTotal.WithLabelValues("true"))
+	go cl.handleLaunchRequests()(launchDelivery(t, cl, false))
+	for testutil.ToFloat64(submitQueueLength.WithLabelValues(pool.Name)) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if !drainWithin(cl, time.Second) {
+		t.Fatal("drain timed out waiting for a launch that was waiting to be submitted")
+	}
+	if actual := testutil.ToFloat64(deliveryRejectsTotal.WithLabelValues("true")); actual != rejects+1 {
+		t.Errorf("requeued rejects was %f instead of %f", actual, rejects+1)
+	}
+	if len(scheduler.submitted) != 0 || len(client.updates) != 0 || len(client.delayed) != 0 {
+		t.Errorf("submitted %v, published %v and delayed %v for an interrupted launch", scheduler.submitted, client.updates, client.delayed)
+	}
+}
+
+func TestTicker(t *testing.T) {
+	cl, _, _ := newTestLauncher(t)
+	done := make(chan struct{})
+	calls := make(chan struct{}, 1)
+	cl.startTicker(time.Millisecond, done, func() {
+		select {
+		case calls <- struct{}{}:
+		default:
+		}
+	})
+	select {
+	case <-calls:
+	case <-time.After(time.Second):
+		t.Fatal("the ticker didn't call its function")
+	}
+	close(done)
+	if !drainWithin(cl, time.Second) {
+		t.Error("drain timed out after the ticker was stopped")
+	}
+}
+
+func TestHeldTickerStops(t *testing.T) {
+	cl, _, _ := newTestLauncher(t)
+	done := make(chan struct{})
+	if _, err := startHeldTicker(cl, done); err != nil {
+		t.Fatal(err)
+	}
+	close(done)
+	if !drainWithin(cl, time.Second) {
+		t.Error("drain timed out after the held ticker was stopped")
+	}
+}
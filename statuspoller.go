@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"gopkg.in/cyverse-de/messaging.v6"
+	"gopkg.in/cyverse-de/model.v4"
+)
+
+// The job statuses recorded in the launch ledger by the status poller.
+const (
+	JobStatusIdle      = "idle"
+	JobStatusRunning   = "running"
+	JobStatusHeld      = "held"
+	JobStatusCompleted = "completed"
+	JobStatusRemoved   = "removed"
+)
+
+const (
+	// defaultStatusInterval is how often job statuses are polled when
+	// condor.status_poller.interval isn't set.
+	defaultStatusInterval = time.Minute
+
+	// defaultStatusLookback is how long after its launch a job's status is
+	// polled when condor.status_poller.lookback isn't set.
+	defaultStatusLookback = 7 * 24 * time.Hour
+
+	// statusBatchSize is the most clusters looked up by a single query.
+	statusBatchSize = 100
+)
+
+// statusAttrs are the job attributes requested by the status poller.
+var statusAttrs = []string{"IpcUuid", "ClusterId", "JobStatus", "ExitCode", "ExitBySignal", "ExitSignal"}
+
+// StatusPoller publishes status updates for the jobs the launcher submitted,
+// as they start running and finish, based on the HTCondor queue and history.
+// It's configured with the condor.status_poller settings, for example:
+//
+//	condor:
+//	  status_poller:
+//	    enabled: true
+//	    interval: 1m
+//	    lookback: 168h
+//
+// Only jobs in the launch ledger that were launched within the lookback
+// period are polled. Jobs that are held are left to the held job policy.
+type StatusPoller struct {
+	Enabled  bool
+	Interval time.Duration
+	Lookback time.Duration
+}
+
+// DefaultStatusPoller returns a disabled *StatusPoller.
+func DefaultStatusPoller() *StatusPoller {
+	return &StatusPoller{
+		Interval: defaultStatusInterval,
+		Lookback: defaultStatusLookback,
+	}
+}
+
+// NewStatusPoller returns a *StatusPoller based on the condor.status_poller
+// settings.
+func NewStatusPoller(cfg *viper.Viper) *StatusPoller {
+	p := DefaultStatusPoller()
+	p.Enabled = cfg.GetBool("condor.status_poller.enabled")
+	if interval := cfg.GetDuration("condor.status_poller.interval"); interval > 0 {
+		p.Interval = interval
+	}
+	if lookback := cfg.GetDuration("condor.status_poller.lookback"); lookback > 0 {
+		p.Lookback = lookback
+	}
+	return p
+}
+
+// jobStatus is the status of a single job as reported by HTCondor.
+type jobStatus struct {
+	InvocationID string
+	ClusterID    string
+	Status       string
+	ExitCode     *int
+	ExitBySignal bool
+	ExitSignal   int
+}
+
+// condorJobStatus returns the ledger status for an HTCondor JobStatus value.
+// Jobs that are transferring their output or are suspended are still
+// considered to be running.
+func condorJobStatus(code int) string {
+	switch code {
+	case 1:
+		return JobStatusIdle
+	case 2, 6, 7:
+		return JobStatusRunning
+	case 3:
+		return JobStatusRemoved
+	case 4:
+		return JobStatusCompleted
+	case 5:
+		return JobStatusHeld
+	}
+	return ""
+}
+
+// jobStatusOf returns the status of the job described by the ClassAd, which
+// must include the statusAttrs. Its Status is empty if the JobStatus is
+// unknown.
+func jobStatusOf(ad *JobAd) jobStatus {
+	return jobStatus{
+		InvocationID: ad.IpcUUID,
+		ClusterID:    ad.Cluster(),
+		Status:       condorJobStatus(ad.JobStatus),
+		ExitCode:     ad.ExitCode,
+		ExitBySignal: ad.ExitBySignal,
+		ExitSignal:   ad.ExitSignal,
+	}
+}
+
+// jobStatuses adds the statuses of the jobs described by the ClassAds to the
+// statuses, by cluster ID. Jobs with an unknown JobStatus are left out.
+func jobStatuses(ads []JobAd, statuses map[string]jobStatus) {
+	for i := range ads {
+		if st := jobStatusOf(&ads[i]); st.Status != "" {
+			statuses[st.ClusterID] = st
+		}
+	}
+}
+
+// terminalJobStatus returns true if the job won't change status again.
+func terminalJobStatus(status string) bool {
+	return status == JobStatusCompleted || status == JobStatusRemoved
+}
+
+// statusUpdate returns the job state and message to publish when a job
+// changes to the given status, or an empty state if nothing is published.
+func statusUpdate(st jobStatus) (messaging.JobState, string) {
+	switch st.Status {
+	case JobStatusRunning:
+		return messaging.RunningState, fmt.Sprintf("Job is running in HTCondor cluster %s", st.ClusterID)
+	case JobStatusCompleted:
+		switch {
+		case st.ExitBySignal:
+			return messaging.FailedState, fmt.Sprintf("Job was killed by signal %d", st.ExitSignal)
+		case st.ExitCode == nil:
+			return messaging.SucceededState, "Job completed"
+		case *st.ExitCode != 0:
+			return messaging.FailedState, fmt.Sprintf("Job exited with code %d", *st.ExitCode)
+		default:
+			return messaging.SucceededState, "Job completed with exit code 0"
+		}
+	case JobStatusRemoved:
+		return messaging.FailedState, "Job was removed from HTCondor"
+	}
+	return "", ""
+}
+
+// clusterConstraint returns a constraint matching the clusters of the
+// records.
+func clusterConstraint(records []*LaunchRecord) string {
+	clauses := make([]string, len(records))
+	for i, r := range records {
+		clauses[i] = fmt.Sprintf("ClusterId == %s", r.ClusterID)
+	}
+	return strings.Join(clauses, " || ")
+}
+
+// pollJobStatuses publishes an update for each job in the ledger whose status
+// has changed since it was last polled. Jobs that have left the queue are
+// looked up in the history.
+func pollJobStatuses(cl *CondorLauncher, now time.Time) error {
+	records, err := cl.ledger.Since(now.Add(-cl.statusPoller.Lookback))
+	if err != nil {
+		return err
+	}
+
+	byPool := map[string][]*LaunchRecord{}
+	for _, r := range records {
+		if r.ClusterID == "" || terminalJobStatus(r.Status) {
+			continue
+		}
+		byPool[r.Pool] = append(byPool[r.Pool], r)
+	}
+
+	for name, records := range byPool {
+		pool := cl.pools.Get(name)
+		if pool == nil {
+			log.Errorf("%d jobs were launched on unknown pool %s", len(records), name)
+			continue
+		}
+		for len(records) > 0 {
+			n := statusBatchSize
+			if n > len(records) {
+				n = len(records)
+			}
+			if err = cl.pollBatch(pool, records[:n], now); err != nil {
+				log.Errorf("%+v\n", err)
+			}
+			records = records[n:]
+		}
+	}
+	return nil
+}
+
+// pollBatch updates the status of the records, which were all launched on the
+// pool.
+func (cl *CondorLauncher) pollBatch(pool *Pool, records []*LaunchRecord, now time.Time) error {
+	ads, err := pool.Scheduler.Query(clusterConstraint(records), statusAttrs...)
+	if err != nil {
+		return errors.Wrapf(err, "failed to poll job statuses in pool %s", pool.Name)
+	}
+	statuses := map[string]jobStatus{}
+	jobStatuses(ads, statuses)
+
+	var gone []*LaunchRecord
+	for _, r := range records {
+		if _, ok := statuses[r.ClusterID]; !ok {
+			gone = append(gone, r)
+		}
+	}
+	if len(gone) > 0 {
+		ads, err = pool.Scheduler.History(clusterConstraint(gone), statusAttrs...)
+		if err != nil {
+			return errors.Wrapf(err, "failed to look up finished jobs in pool %s", pool.Name)
+		}
+		jobStatuses(ads, statuses)
+	}
+
+	for _, r := range records {
+		if st, ok := statuses[r.ClusterID]; ok {
+			cl.updateJobStatus(r, st, now)
+		}
+	}
+	return nil
+}
+
+// updateJobStatus publishes the update for a job that changed status and
+// records the new status in the ledger. The status isn't recorded if the
+// update can't be published, so that it's tried again on the next poll.
+func (cl *CondorLauncher) updateJobStatus(record *LaunchRecord, st jobStatus, now time.Time) {
+	if st.Status == record.Status {
+		return
+	}
+	log.Infof("Job %s (cluster %s) changed from %q to %q", record.InvocationID, record.ClusterID, record.Status, st.Status)
+
+	if state, message := statusUpdate(st); state != "" {
+		fauxJob := model.New(cl.cfg)
+		fauxJob.InvocationID = record.InvocationID
+		update := &messaging.UpdateMessage{
+			Job:     fauxJob,
+			State:   state,
+			Message: message,
+		}
+		if err := cl.client.PublishJobUpdate(update); err != nil {
+			log.Errorf("%+v\n", errors.Wrapf(err, "failed to publish the status update for %s", record.InvocationID))
+			return
+		}
+	}
+
+	record.Status = st.Status
+	record.StatusChangedAt = now
+	record.ExitCode = st.ExitCode
+	if err := cl.ledger.Record(record); err != nil {
+		log.Errorf("%+v\n", err)
+	}
+	jobStatusChangesTotal.WithLabelValues(st.Status).Inc()
+}
+
+// markJobRemoved records that the job was removed by the launcher, which has
+// already told the user, so that the status poller doesn't publish another
+// update for it.
+func (cl *CondorLauncher) markJobRemoved(invocationID string, now time.Time) {
+	record, err := cl.ledger.Lookup(invocationID)
+	if err != nil {
+		log.Errorf("%+v\n", err)
+		return
+	}
+	if record == nil || terminalJobStatus(record.Status) {
+		return
+	}
+	record.Status = JobStatusRemoved
+	record.StatusChangedAt = now
+	if err = cl.ledger.Record(record); err != nil {
+		log.Errorf("%+v\n", err)
+	}
+}
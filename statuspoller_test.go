@@ -0,0 +1,129 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/condor-launcher/test"
+	"gopkg.in/cyverse-de/messaging.v6"
+)
+
+func TestNewStatusPoller(t *testing.T) {
+	cfg := test.InitConfig(t)
+	p := NewStatusPoller(cfg)
+	if p.Enabled || p.Interval != defaultStatusInterval || p.Lookback != defaultStatusLookback {
+		t.Errorf("unexpected default status poller %#v", p)
+	}
+
+	cfg.Set("condor.status_poller.enabled", true)
+	cfg.Set("condor.status_poller.interval", "10s")
+	cfg.Set("condor.status_poller.lookback", "24h")
+	p = NewStatusPoller(cfg)
+	if !p.Enabled || p.Interval != 10*time.Second || p.Lookback != 24*time.Hour {
+		t.Errorf("unexpected status poller %#v", p)
+	}
+}
+
+func TestJobStatusOf(t *testing.T) {
+	three := 3
+	ads := []JobAd{
+		{IpcUUID: "a", ClusterID: 10000, JobStatus: 2},
+		{IpcUUID: "b", ClusterID: 10001, JobStatus: 4, ExitCode: &three},
+		{IpcUUID: "c", ClusterID: 10002, JobStatus: 4, ExitBySignal: true, ExitSignal: 9},
+		{IpcUUID: "d", ClusterID: 10003, JobStatus: 42},
+	}
+	expected := map[string]jobStatus{
+		"10000": {InvocationID: "a", ClusterID: "10000", Status: JobStatusRunning},
+		"10001": {InvocationID: "b", ClusterID: "10001", Status: JobStatusCompleted, ExitCode: &three},
+		"10002": {InvocationID: "c", ClusterID: "10002", Status: JobStatusCompleted, ExitBySignal: true, ExitSignal: 9},
+	}
+	actual := map[string]jobStatus{}
+	jobStatuses(ads, actual)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("jobStatuses returned %+v instead of %+v", actual, expected)
+	}
+}
+
+func TestPollJobStatuses(t *testing.T) {
+	cl, scheduler, client := newTestLauncher(t)
+	now := time.Now()
+	records := []*LaunchRecord{
+		{InvocationID: "running", ClusterID: "10000", SubmittedAt: now.Add(-time.Hour)},
+		{InvocationID: "succeeded", ClusterID: "10001", SubmittedAt: now.Add(-time.Hour)},
+		{InvocationID: "failed", ClusterID: "10002", SubmittedAt: now.Add(-time.Hour)},
+		{InvocationID: "old", ClusterID: "10003", SubmittedAt: now.Add(-30 * 24 * time.Hour)},
+		{InvocationID: "done", ClusterID: "10004", SubmittedAt: now.Add(-time.Hour), Status: JobStatusCompleted},
+	}
+	for _, r := range records {
+		if err := cl.ledger.Record(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	zero, one := 0, 1
+	scheduler.queryAds = []JobAd{{IpcUUID: "running", ClusterID: 10000, JobStatus: 2}}
+	scheduler.historyAds = []JobAd{
+		{IpcUUID: "succeeded", ClusterID: 10001, JobStatus: 4, ExitCode: &zero},
+		{IpcUUID: "failed", ClusterID: 10002, JobStatus: 4, ExitCode: &one},
+	}
+
+	if err := pollJobStatuses(cl, now); err != nil {
+		t.Fatal(err)
+	}
+	if len(scheduler.queries) != 1 || strings.Contains(scheduler.queries[0], "10003") || strings.Contains(scheduler.queries[0], "10004") {
+		t.Errorf("unexpected queries %v", scheduler.queries)
+	}
+	if len(scheduler.histories) != 1 || strings.Contains(scheduler.histories[0], "10000") {
+		t.Errorf("unexpected history queries %v", scheduler.histories)
+	}
+
+	states := map[string]messaging.JobState{}
+	for _, u := range client.updates {
+		states[u.Job.InvocationID] = u.State
+	}
+	expected := map[string]messaging.JobState{
+		"running":   messaging.RunningState,
+		"succeeded": messaging.SucceededState,
+		"failed":    messaging.FailedState,
+	}
+	if len(client.updates) != 3 || !reflect.DeepEqual(states, expected) {
+		t.Errorf("published %v instead of %v", states, expected)
+	}
+
+	record, err := cl.ledger.Lookup("failed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Status != JobStatusCompleted || record.ExitCode == nil || *record.ExitCode != 1 {
+		t.Errorf("unexpected ledger record %+v", record)
+	}
+
+	// Nothing changed, so nothing should be published on the next poll.
+	if err = pollJobStatuses(cl, now); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.updates) != 3 {
+		t.Errorf("published %d updates for jobs that didn't change", len(client.updates)-3)
+	}
+}
+
+func TestPollJobStatusesSkipsStoppedJobs(t *testing.T) {
+	cl, scheduler, client := newTestLauncher(t)
+	now := time.Now()
+	err := cl.ledger.Record(&LaunchRecord{InvocationID: "stopped", ClusterID: "10000", SubmittedAt: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cl.stopJob("stopped"); err != nil {
+		t.Fatal(err)
+	}
+	scheduler.historyAds = []JobAd{{IpcUUID: "stopped", ClusterID: 10000, JobStatus: 3}}
+
+	if err = pollJobStatuses(cl, now); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.updates) != 1 {
+		t.Errorf("published %d updates for a stopped job instead of 1", len(client.updates))
+	}
+}
@@ -1,100 +1,113 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
-	"os/exec"
-	"path"
-	"path/filepath"
 	"strings"
-
-	"github.com/pkg/errors"
+	"time"
 )
 
-// ExecCondorQHeldIDs runs the
-// `condor_q -constraint 'JobStatus =?= 5' -format "%s\n" IpcUuid`
-// command and returns its output.
-func ExecCondorQHeldIDs(condorPath, condorConfig string) ([]byte, error) {
-	var (
-		output []byte
-		err    error
-	)
-	csPath, err := exec.LookPath("condor_q")
-	if err != nil {
-		return output, errors.Wrap(err, "failed to find condor_q on the $PATH")
-	}
-	if !path.IsAbs(csPath) {
-		csPath, err = filepath.Abs(csPath)
-		if err != nil {
-			return output, errors.Wrapf(err, "failed to get the absolute path of %s", csPath)
-		}
-	}
+// heldJobAttrs are the job attributes requested when listing held jobs.
+var heldJobAttrs = []string{
+	"IpcUuid",
+	"ClusterId",
+	"HoldReasonCode",
+	"HoldReasonSubCode",
+	"NumHolds",
+	"EnteredCurrentStatus",
+	"HoldReason",
+}
+
+// HeldJob describes a job in the held state.
+type HeldJob struct {
+	InvocationID      string
+	ClusterID         string
+	HoldReasonCode    int
+	HoldReasonSubCode int
+	NumHolds          int
+	HeldSince         time.Time
+	HoldReason        string
+}
 
-	cmdArgs := []string{
-		"-constraint",
-		"JobStatus =?= 5",
-		"-format",
-		"%s\\n",
-		"IpcUuid"}
+// holdReasonExplanations describes the common HoldReasonCode values in terms
+// that make sense to DE users. See the HTCondor manual for the full list.
+var holdReasonExplanations = map[int]string{
+	1:  "The job was put on hold by an administrator.",
+	3:  "The job was put on hold by a job policy.",
+	6:  "The job's executable could not be started.",
+	7:  "The job's standard output file could not be opened.",
+	12: "The job's output files could not be transferred.",
+	13: "The job's input files could not be transferred.",
+	14: "The job's working directory could not be accessed.",
+	21: "The execution node refused to run the job.",
+	22: "The job's event log could not be written.",
+	26: "The job was put on hold by a system policy.",
+	34: "The job used more memory or disk than it requested.",
+	35: "The job's Docker image could not be used.",
+}
 
-	cmd := exec.Command(csPath, cmdArgs...)
-	cmd.Env = []string{
-		fmt.Sprintf("PATH=%s", condorPath),
-		fmt.Sprintf("CONDOR_CONFIG=%s", condorConfig),
+// Explanation returns a description of why the job is being held, combining
+// a plain-language explanation of the HoldReasonCode with the HoldReason
+// reported by HTCondor.
+func (h HeldJob) Explanation() string {
+	var parts []string
+	if explanation, ok := holdReasonExplanations[h.HoldReasonCode]; ok {
+		parts = append(parts, explanation)
 	}
-	output, err = cmd.CombinedOutput()
-	if err != nil {
-		return output, errors.Wrapf(err,
-			"failed to get the output of the command '%s %s'",
-			csPath,
-			strings.Join(cmdArgs, " "))
+	if h.HoldReason != "" {
+		parts = append(parts, fmt.Sprintf("HTCondor reported: %s", h.HoldReason))
 	}
-	return output, nil
+	if h.HoldReasonCode != 0 {
+		parts = append(parts, fmt.Sprintf("(hold reason code %d, subcode %d)", h.HoldReasonCode, h.HoldReasonSubCode))
+	}
+	return strings.Join(parts, " ")
 }
 
-// ExecCondorRm runs condor_rm with an IpcUuid constraint for the given invocationID.
-// Returns the output of the command and possibly an error.
-func ExecCondorRm(invocationID, condorPath, condorConfig string) ([]byte, error) {
-	var (
-		output []byte
-		err    error
-	)
-	crPath, err := exec.LookPath("condor_rm")
-	log.Infof("condor_rm found at %s", crPath)
+// Query runs `condor_q -constraint <constraint> -json -attributes <attrs>`
+// and decodes the ClassAds in its output.
+func (c *CondorCLI) Query(constraint string, attrs ...string) ([]JobAd, error) {
+	output, err := c.output(c.condorQ, c.args(queryArgs(constraint, attrs)...)...)
 	if err != nil {
-		return output, errors.Wrap(err, "failed to find condor_rm on the $PATH")
-	}
-	if !path.IsAbs(crPath) {
-		crPath, err = filepath.Abs(crPath)
-		if err != nil {
-			return output, errors.Wrapf(err, "failed to get the absolute path of %s", crPath)
-		}
+		return nil, err
 	}
+	return decodeJobAds(output)
+}
 
-	// condor_rm -constraint 'IpcUuid =?= "<uuid>"'
-	constraintIpcUUID := fmt.Sprintf(`IpcUuid =?= "%s"`, invocationID)
-	cmd := exec.Command(crPath, "-constraint", constraintIpcUUID)
-	cmd.Env = []string{
-		fmt.Sprintf("PATH=%s", condorPath),
-		fmt.Sprintf("CONDOR_CONFIG=%s", condorConfig),
+// History runs
+// `condor_history -constraint <constraint> -json -attributes <attrs>` and
+// decodes the ClassAds in its output.
+func (c *CondorCLI) History(constraint string, attrs ...string) ([]JobAd, error) {
+	output, err := c.output(c.condorHistory, c.args(queryArgs(constraint, attrs)...)...)
+	if err != nil {
+		return nil, err
 	}
-	output, err = cmd.CombinedOutput()
+	return decodeJobAds(output)
+}
+
+// QueryHeld runs the
+// `condor_q -constraint 'JobStatus =?= 5' -json -attributes IpcUuid,...`
+// command and returns the held jobs listed in its output.
+func (c *CondorCLI) QueryHeld() ([]HeldJob, error) {
+	ads, err := c.Query("JobStatus =?= 5", heldJobAttrs...)
 	if err != nil {
-		return output, errors.Wrapf(err, "failed to get the output of '%s %s %s'", crPath, "-constraint", constraintIpcUUID)
+		return nil, err
 	}
-	return output, nil
+	return heldJobs(ads), nil
 }
 
-func heldQueueInvocationIDs(condorQFormattedOutput []byte) []string {
-	var retval []string
+// Remove runs condor_rm with an IpcUuid constraint for the given invocationID.
+// Returns the output of the command and possibly an error.
+func (c *CondorCLI) Remove(invocationID string) ([]byte, error) {
+	// condor_rm -constraint 'IpcUuid =?= "<uuid>"'
+	constraintIpcUUID := fmt.Sprintf(`IpcUuid =?= "%s"`, invocationID)
+	return c.run("", c.condorRm, c.args("-constraint", constraintIpcUUID)...)
+}
 
-	lines := bytes.Split(condorQFormattedOutput, []byte("\n"))
-	for _, line := range lines {
-		invocationID := bytes.TrimSpace(line)
-		if len(invocationID) > 0 {
-			retval = append(retval, string(invocationID))
-		}
-	}
+// RemoveCluster runs condor_rm for the given cluster ID.
+func (c *CondorCLI) RemoveCluster(clusterID string) ([]byte, error) {
+	return c.run("", c.condorRm, c.args(clusterID)...)
+}
 
-	return retval
+// Release runs condor_release for the given cluster ID.
+func (c *CondorCLI) Release(clusterID string) ([]byte, error) {
+	return c.run("", c.condorRelease, c.args(clusterID)...)
 }
@@ -13,11 +13,12 @@ var (
 )
 
 // IRODSConfigTemplateText is the text of the template for porklock's iRODS
-// config file.
+// config file. The password is left out when the job has been issued a
+// ticket.
 const IRODSConfigTemplateText = `porklock.irods-host = {{.IRODSHost}}
 porklock.irods-port = {{.IRODSPort}}
 porklock.irods-user = {{.IRODSUser}}
-porklock.irods-pass = {{.IRODSPass}}
+{{if .IRODSTicket}}porklock.irods-ticket = {{.IRODSTicket}}{{else}}porklock.irods-pass = {{.IRODSPass}}{{end}}
 porklock.irods-home = {{.IRODSBase}}
 porklock.irods-zone = {{.IRODSZone}}
 porklock.irods-resc = {{.IRODSResc}}
@@ -26,13 +27,14 @@ porklock.irods-resc = {{.IRODSResc}}
 // IRODSConfig contains all of the values for the IRODS configuration file used
 // by the porklock tool out on a HTCondor compute node.
 type IRODSConfig struct {
-	IRODSHost string
-	IRODSPort string
-	IRODSUser string
-	IRODSPass string
-	IRODSZone string
-	IRODSBase string
-	IRODSResc string
+	IRODSHost   string
+	IRODSPort   string
+	IRODSUser   string
+	IRODSPass   string
+	IRODSTicket string
+	IRODSZone   string
+	IRODSBase   string
+	IRODSResc   string
 }
 
 // GenerateFile applies the data to the given template and returns a *bytes.Buffer